@@ -57,6 +57,14 @@ func httpPost(addr string, path string, contentType string, body io.Reader) (*ht
 	return makeHttpClient(addr).Post("http://."+path, contentType, body)
 }
 
+func httpDo(addr string, method string, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://."+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return makeHttpClient(addr).Do(req)
+}
+
 func SendReloadRequest(addr string, stdout, stderr io.Writer) error {
 	resp, err := httpPost(addr, "/reload", "application/json", nil)
 	if err != nil {
@@ -141,6 +149,10 @@ func SendConnectionsRequest(addr string, stdout, stderr io.Writer) error {
 			RemoteAddr    string    `json:"remote"`
 			Module        string    `json:"module"`
 			Upstream      string    `json:"upstream"`
+			State         string    `json:"state"`
+			StateSince    time.Time `json:"stateSince"`
+			QueuePosition int       `json:"queuePosition"`
+			QueueLength   int       `json:"queueLength"`
 			ConnectedAt   time.Time `json:"connected"`
 			ReceivedBytes int64     `json:"receivedBytes"`
 			SentBytes     int64     `json:"sentBytes"`
@@ -176,18 +188,28 @@ func SendConnectionsRequest(addr string, stdout, stderr io.Writer) error {
 			tw.AlignRight,   // RemoteAddr
 			tw.AlignDefault, // Module
 			tw.AlignDefault, // Upstream
+			tw.AlignDefault, // State
 			tw.AlignDefault, // ConnectedAt
 			tw.AlignRight,   // ReceivedBytes
 			tw.AlignRight,   // SentBytes
 		}),
 	)
-	table.Header("Index", "Remote", "Module", "Upstream", "Connected", "Received", "Sent")
+	table.Header("Index", "Remote", "Module", "Upstream", "State", "Connected", "Received", "Sent")
+	now := time.Now()
 	for _, conn := range result.Connections {
+		state := conn.State
+		if conn.QueuePosition > 0 {
+			state += fmt.Sprintf(" %d/%d", conn.QueuePosition, conn.QueueLength)
+		}
+		if !conn.StateSince.IsZero() {
+			state += fmt.Sprintf(" (%s)", now.Sub(conn.StateSince).Truncate(time.Second))
+		}
 		_ = table.Append([]string{
 			strconv.Itoa(conn.Index),
 			conn.RemoteAddr,
 			conn.Module,
 			conn.Upstream,
+			state,
 			conn.ConnectedAt.Format(time.DateTime),
 			formatSizeColored(conn.ReceivedBytes),
 			formatSizeColored(conn.SentBytes),
@@ -228,6 +250,104 @@ func SendUpstreamModulesRequest(addr string, upstream string, forceDiscover bool
 	return nil
 }
 
+func SendBansRequest(addr string, stdout, stderr io.Writer) error {
+	resp, err := httpGet(addr, "/bans")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(stderr, resp.Body)
+		return fmt.Errorf("failed to get bans")
+	}
+
+	var result struct {
+		Bans  []server.Ban `json:"bans"`
+		Count int          `json:"count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if result.Count == 0 {
+		_, _ = fmt.Fprintln(stdout, "No banned clients")
+		return nil
+	}
+
+	table := tablewriter.NewTable(
+		stdout,
+		tablewriter.WithRendition(tw.Rendition{
+			Borders: tw.BorderNone,
+			Settings: tw.Settings{
+				Lines:      tw.LinesNone,
+				Separators: tw.SeparatorsNone,
+			},
+		}),
+		tablewriter.WithPadding(tw.Padding{
+			Right:     "  ",
+			Overwrite: true,
+		}),
+		tablewriter.WithHeaderAutoFormat(tw.Off),
+	)
+	table.Header("Client", "Until", "Reason")
+	for _, ban := range result.Bans {
+		_ = table.Append([]string{
+			ban.IP,
+			ban.Until.Local().Format(time.DateTime),
+			ban.Reason,
+		})
+	}
+	return table.Render()
+}
+
+func SendBanRequest(addr string, ip string, duration time.Duration, reason string, stdout, stderr io.Writer) error {
+	form := url.Values{}
+	form.Set("ip", ip)
+	if duration > 0 {
+		form.Set("duration", duration.String())
+	}
+	if reason != "" {
+		form.Set("reason", reason)
+	}
+	resp, err := httpPost(addr, "/bans", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(stderr, resp.Body)
+		return fmt.Errorf("failed to ban client")
+	}
+
+	var ban server.Ban
+	if err := json.NewDecoder(resp.Body).Decode(&ban); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	_, _ = fmt.Fprintf(stdout, "%s is banned until %s\n", ban.IP, ban.Until.Local().Format(time.DateTime))
+	return nil
+}
+
+func SendUnbanRequest(addr string, ip string, stdout, stderr io.Writer) error {
+	query := url.Values{}
+	query.Set("ip", ip)
+	resp, err := httpDo(addr, http.MethodDelete, "/bans?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out io.Writer
+	if resp.StatusCode < 300 {
+		out = stdout
+	} else {
+		out = stderr
+		err = fmt.Errorf("failed to unban client")
+	}
+	_, _ = io.Copy(out, resp.Body)
+	return err
+}
+
 func printVersion(out io.Writer, pretty bool) error {
 	type Info struct {
 		GitCommit string
@@ -320,6 +440,46 @@ func newUpstreamModulesCmd(s *server.Server) *cobra.Command {
 	return c
 }
 
+func newBansCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "bans",
+		Short: "Show banned clients",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SendBansRequest(daemonSocket, cmd.OutOrStdout(), cmd.ErrOrStderr())
+		},
+	}
+	return c
+}
+
+func newBanCmd() *cobra.Command {
+	var duration time.Duration
+	var reason string
+	c := &cobra.Command{
+		Use:   "ban <ip>",
+		Short: "Ban a client address",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SendBanRequest(daemonSocket, args[0], duration, reason, cmd.OutOrStdout(), cmd.ErrOrStderr())
+		},
+	}
+	c.Flags().DurationVarP(&duration, "duration", "d", 0, "How long the client is banned (default ban_duration)")
+	c.Flags().StringVarP(&reason, "reason", "r", "", "Why the client is banned")
+	return c
+}
+
+func newUnbanCmd() *cobra.Command {
+	c := &cobra.Command{
+		Use:   "unban <ip>",
+		Short: "Lift the ban of a client address",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return SendUnbanRequest(daemonSocket, args[0], cmd.OutOrStdout(), cmd.ErrOrStderr())
+		},
+	}
+	return c
+}
+
 func newVersionCmd() *cobra.Command {
 	var pretty bool
 	c := &cobra.Command{
@@ -369,6 +529,9 @@ func New() *cobra.Command {
 		newConnectionsCmd(),
 		newReloadCmd(),
 		newUpstreamModulesCmd(s),
+		newBansCmd(),
+		newBanCmd(),
+		newUnbanCmd(),
 		newVersionCmd(),
 	)
 
@@ -0,0 +1,97 @@
+// Package prefixset implements a set of IP prefixes as binary tries, so that
+// looking up an address takes at most one step per bit however many prefixes
+// the set holds.
+package prefixset
+
+import "net/netip"
+
+type node struct {
+	children [2]*node
+	// Whether the bits leading to the node form a prefix of the set
+	end bool
+}
+
+// Set is a set of IPv4 and IPv6 prefixes. The zero value is an empty set.
+type Set struct {
+	v4, v6 node
+}
+
+func (s *Set) root(addr netip.Addr) (_ *node, bits int) {
+	if addr.Is4() {
+		return &s.v4, 32
+	}
+	return &s.v6, 128
+}
+
+// addrBytes returns the 4 or 16 bytes of addr.
+func addrBytes(addr netip.Addr) []byte {
+	if addr.Is4() {
+		a := addr.As4()
+		return a[:]
+	}
+	a := addr.As16()
+	return a[:]
+}
+
+// bit returns the i-th bit of b, counting from the most significant one.
+func bit(b []byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// Add adds p to the set. IPv4-mapped IPv6 prefixes are added as IPv4 ones.
+func (s *Set) Add(p netip.Prefix) {
+	if !p.IsValid() {
+		return
+	}
+	p = p.Masked()
+	if addr := p.Addr(); addr.Is4In6() {
+		if p.Bits() < 96 {
+			// Covers more than the IPv4-mapped range, keep it as IPv6
+			s.add(p)
+			return
+		}
+		p = netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	s.add(p)
+}
+
+func (s *Set) add(p netip.Prefix) {
+	n, _ := s.root(p.Addr())
+	b := addrBytes(p.Addr())
+	for i := range p.Bits() {
+		if n.end {
+			// Already covered by a shorter prefix
+			return
+		}
+		next := &n.children[bit(b, i)]
+		if *next == nil {
+			*next = &node{}
+		}
+		n = *next
+	}
+	n.end = true
+	// Longer prefixes are covered by this one now
+	n.children = [2]*node{}
+}
+
+// Contains reports whether addr is in any prefix of the set.
+func (s *Set) Contains(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	n, bits := s.root(addr)
+	b := addrBytes(addr)
+	for i := 0; ; i++ {
+		if n.end {
+			return true
+		}
+		if i == bits {
+			return false
+		}
+		n = n.children[bit(b, i)]
+		if n == nil {
+			return false
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package prefixset
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContains(t *testing.T) {
+	var s Set
+	for _, p := range []string{"192.0.2.0/24", "198.51.100.7/32", "2001:db8::/32", "::ffff:203.0.113.0/120"} {
+		s.Add(netip.MustParsePrefix(p))
+	}
+
+	for addr, expected := range map[string]bool{
+		"192.0.2.0":           true,
+		"192.0.2.255":         true,
+		"192.0.3.0":           false,
+		"198.51.100.7":        true,
+		"198.51.100.8":        false,
+		"::ffff:192.0.2.1":    true,
+		"2001:db8:1::1":       true,
+		"2001:db9::1":         false,
+		"203.0.113.9":         true,
+		"10.0.0.1":            false,
+		"::":                  false,
+		"::ffff:198.51.100.7": true,
+	} {
+		assert.Equal(t, expected, s.Contains(netip.MustParseAddr(addr)), addr)
+	}
+	assert.False(t, s.Contains(netip.Addr{}))
+}
+
+func TestEmptySet(t *testing.T) {
+	var s Set
+	assert.False(t, s.Contains(netip.MustParseAddr("192.0.2.1")))
+	assert.False(t, s.Contains(netip.MustParseAddr("2001:db8::1")))
+}
+
+func TestAddCoveredPrefixes(t *testing.T) {
+	var s Set
+	s.Add(netip.MustParsePrefix("10.1.2.0/24"))
+	s.Add(netip.MustParsePrefix("10.0.0.0/8"))
+	// Covered by 10.0.0.0/8 already
+	s.Add(netip.MustParsePrefix("10.3.0.0/16"))
+	assert.True(t, s.Contains(netip.MustParseAddr("10.1.2.3")))
+	assert.True(t, s.Contains(netip.MustParseAddr("10.200.0.1")))
+	assert.False(t, s.Contains(netip.MustParseAddr("11.0.0.1")))
+
+	s.Add(netip.MustParsePrefix("0.0.0.0/0"))
+	assert.True(t, s.Contains(netip.MustParseAddr("11.0.0.1")))
+	assert.False(t, s.Contains(netip.MustParseAddr("2001:db8::1")))
+}
+
+func TestAddUnmaskedPrefix(t *testing.T) {
+	var s Set
+	s.Add(netip.MustParsePrefix("192.0.2.77/24"))
+	assert.True(t, s.Contains(netip.MustParseAddr("192.0.2.1")))
+}
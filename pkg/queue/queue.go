@@ -2,6 +2,8 @@ package queue
 
 import (
 	"runtime"
+	"slices"
+	"sort"
 	"sync"
 )
 
@@ -11,11 +13,39 @@ type Queue struct {
 	queued    []queueItem
 	maxQueued int
 
+	// In fair mode, queued items are promoted round-robin across keys
+	// rather than first come, first served
+	fair bool
+	// Round of the last promoted item
+	round uint64
+	// Last round assigned to each key with queued items
+	lastRounds map[string]uint64
+
+	// Active slots out of max that only clients of the given classes may
+	// use
+	reserved map[string]int
+
 	mu sync.Mutex
 }
 
 type queueItem struct {
-	ch chan Status
+	ch       chan Status
+	key      string
+	round    uint64
+	priority int
+	class    string
+	// Whether the item holds a slot reserved for its class
+	inReserved bool
+}
+
+// Client describes who asks for a slot.
+type Client struct {
+	// Tells clients apart in fair mode
+	Key string
+	// Queued clients with a higher priority are promoted first
+	Priority int
+	// Clients may use the slots reserved for their class
+	Class string
 }
 
 type Handle struct {
@@ -30,6 +60,8 @@ type internalHandle struct {
 }
 
 type Status struct {
+	// Index and Max are the position of a queued item, and may overstate it
+	// when slots are reserved
 	Index int
 	Max   int
 	Ok    bool
@@ -74,27 +106,160 @@ func (q *Queue) SetMax(max, maxQueued int) {
 	q.mu.Unlock()
 }
 
-func (q *Queue) Acquire() *Handle {
+// SetFair switches fair queueing on or off. Items already queued keep their
+// order.
+func (q *Queue) SetFair(fair bool) {
+	q.mu.Lock()
+	q.fair = fair
+	q.mu.Unlock()
+}
+
+func (q *Queue) IsFair() bool {
+	q.mu.Lock()
+	ret := q.fair
+	q.mu.Unlock()
+	return ret
+}
+
+// SetReserved reserves active slots for clients of the given classes. The
+// other clients share the rest of max. Clients of a class use the shared
+// slots once its reserved ones are taken.
+func (q *Queue) SetReserved(reserved map[string]int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reserved = reserved
+	q.promote()
+	q.broadcastStatus()
+}
+
+// GetReserved returns the number of active slots reserved for class.
+func (q *Queue) GetReserved(class string) int {
+	q.mu.Lock()
+	ret := q.reserved[class]
+	q.mu.Unlock()
+	return ret
+}
+
+// Acquire asks for a slot on behalf of the client identified by key, which
+// only matters in fair mode.
+func (q *Queue) Acquire(key string) *Handle {
+	return q.AcquireClient(Client{Key: key})
+}
+
+// AcquireClient asks for a slot on behalf of c.
+func (q *Queue) AcquireClient(c Client) *Handle {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
 	ch := make(chan Status, 1)
+	item := queueItem{ch: ch, key: c.Key, priority: c.Priority, class: c.Class}
+	ok, inReserved := q.slotFor(c.Class)
 	switch {
-	case len(q.active) < q.max || q.max == 0: // q.max == 0 => no limit
-		q.active = append(q.active, queueItem{ch})
+	case ok:
+		item.inReserved = inReserved
+		q.active = append(q.active, item)
 		ch <- Status{Ok: true}
 		close(ch)
-	case q.maxQueued > 0 && len(q.queued) >= q.maxQueued:
+	case q.maxQueued > 0 && len(q.queued) >= q.maxQueued && !q.displaceFor(item):
 		ch <- Status{Full: true}
 		close(ch)
-	default: // q.active >= q.max
-		q.queued = append(q.queued, queueItem{ch})
-		surplus := len(q.active) - q.max
-		ch <- Status{Index: surplus + len(q.queued) - 1, Max: surplus + len(q.queued)}
+	default: // no slot left for the client
+		i := q.enqueue(item)
+		surplus := q.surplus()
+		ch <- Status{Index: surplus + i, Max: surplus + len(q.queued)}
+		if i < len(q.queued)-1 {
+			// Items behind the new one moved back
+			q.broadcastStatus()
+		}
 	}
 	return q.makeHandle(ch)
 }
 
+// displaceFor makes room in the full queue for item by dropping the last
+// queued item if it has a lower priority. The dropped item is told that the
+// queue is full.
+//
+// Must be called with q.mu held
+func (q *Queue) displaceFor(item queueItem) bool {
+	last := q.queued[len(q.queued)-1]
+	if last.priority >= item.priority {
+		return false
+	}
+	trySend(last.ch, Status{Full: true})
+	close(last.ch)
+	q.queued = q.queued[:len(q.queued)-1]
+	q.dropRound(last.key)
+	return true
+}
+
+// slotFor tells whether a client of class may get an active slot now, and
+// whether it is one reserved for the class.
+//
+// Must be called with q.mu held
+func (q *Queue) slotFor(class string) (ok, inReserved bool) {
+	if q.max == 0 { // q.max == 0 => no limit
+		return true, false
+	}
+	var totalReserved, usedReserved, usedShared int
+	for _, n := range q.reserved {
+		totalReserved += n
+	}
+	for _, item := range q.active {
+		switch {
+		case !item.inReserved:
+			usedShared++
+		case item.class == class:
+			usedReserved++
+		}
+	}
+	if usedReserved < q.reserved[class] {
+		return true, true
+	}
+	return usedShared < q.max-totalReserved, false
+}
+
+// surplus returns how many active items exceed max, e.g. after max was
+// lowered.
+//
+// Must be called with q.mu held
+func (q *Queue) surplus() int {
+	return max(len(q.active)-q.max, 0)
+}
+
+// enqueue inserts item into the queued list and returns its index. The list
+// is ordered by priority, then by round. In fair mode, an item of a key joins
+// the round after the last one of that key, but not before the current
+// round; so a key that queued many items gets one promoted per round, and
+// keys that queued a few items overtake the rest. Otherwise the item joins
+// the last round.
+//
+// Must be called with q.mu held
+func (q *Queue) enqueue(item queueItem) int {
+	item.round = q.round
+	if !q.fair {
+		for _, queued := range q.queued {
+			item.round = max(item.round, queued.round)
+		}
+	} else {
+		if r, ok := q.lastRounds[item.key]; ok && r >= q.round {
+			item.round = r + 1
+		}
+		if q.lastRounds == nil {
+			q.lastRounds = make(map[string]uint64)
+		}
+		q.lastRounds[item.key] = item.round
+	}
+	i := sort.Search(len(q.queued), func(i int) bool {
+		queued := q.queued[i]
+		if queued.priority != item.priority {
+			return queued.priority < item.priority
+		}
+		return queued.round > item.round
+	})
+	q.queued = slices.Insert(q.queued, i, item)
+	return i
+}
+
 func (q *Queue) makeHandle(ch chan Status) *Handle {
 	h := &Handle{
 		C: ch,
@@ -107,13 +272,56 @@ func (q *Queue) makeHandle(ch chan Status) *Handle {
 	return h
 }
 
-// Move next queued handle to active queued
-func (q *Queue) popHead() {
-	head := q.queued[0]
-	trySend(head.ch, Status{Ok: true})
-	close(head.ch)
-	q.active = append(q.active, head)
-	q.queued = q.queued[1:]
+// Move the i-th queued handle to the active list
+//
+// Must be called with q.mu held
+func (q *Queue) popAt(i int, inReserved bool) {
+	item := q.queued[i]
+	trySend(item.ch, Status{Ok: true})
+	close(item.ch)
+	item.inReserved = inReserved
+	q.active = append(q.active, item)
+	q.queued = slices.Delete(q.queued, i, i+1)
+
+	q.round = max(q.round, item.round)
+	// Keys whose last round has passed join the current one again
+	for key, r := range q.lastRounds {
+		if r < q.round {
+			delete(q.lastRounds, key)
+		}
+	}
+}
+
+// dropRound updates the last round of key once one of its items left the
+// queue without being promoted, so that the key does not wait for rounds it
+// no longer has items in.
+//
+// Must be called with q.mu held
+func (q *Queue) dropRound(key string) {
+	if _, ok := q.lastRounds[key]; !ok {
+		return
+	}
+	delete(q.lastRounds, key)
+	for _, item := range q.queued {
+		if item.key == key {
+			q.lastRounds[key] = max(q.lastRounds[key], item.round)
+		}
+	}
+}
+
+// promote gives free slots to queued items in order. An item that cannot get
+// a slot does not hold back those behind it that can get one reserved for
+// their class.
+//
+// Must be called with q.mu held
+func (q *Queue) promote() {
+	for i := 0; i < len(q.queued); {
+		if ok, inReserved := q.slotFor(q.queued[i].class); ok {
+			q.popAt(i, inReserved)
+			continue
+		}
+		i++
+	}
 }
 
 func (q *Queue) releaseFromHandle(h *internalHandle) {
@@ -122,14 +330,17 @@ func (q *Queue) releaseFromHandle(h *internalHandle) {
 
 	// Remove this handle from queued list
 	newList := make([]queueItem, 0, len(q.queued))
+	var key string
 	for _, item := range q.queued {
 		if h.ch == item.ch {
+			key = item.key
 			continue
 		}
 		newList = append(newList, item)
 	}
 	if len(newList) != len(q.queued) {
 		q.queued = newList
+		q.dropRound(key)
 		q.broadcastStatus()
 		return
 	}
@@ -145,9 +356,7 @@ func (q *Queue) releaseFromHandle(h *internalHandle) {
 	}
 	q.active = newList
 
-	for len(q.queued) > 0 && (len(q.active) < q.max || q.max == 0) {
-		q.popHead()
-	}
+	q.promote()
 	q.broadcastStatus()
 }
 
@@ -164,9 +373,13 @@ func (h *internalHandle) release() {
 	h.q.releaseFromHandle(h)
 }
 
+// broadcastStatus tells queued items their position. Items ahead that can
+// only wait for slots reserved for their class are counted too, though
+// promote lets the others pass them, so the position is an upper bound.
+//
 // Must be called with q.mu held
 func (q *Queue) broadcastStatus() {
-	surplus := len(q.active) - q.max
+	surplus := q.surplus()
 	for i := range q.queued {
 		trySend(q.queued[i].ch, Status{Index: surplus + i, Max: surplus + len(q.queued)})
 	}
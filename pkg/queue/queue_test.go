@@ -10,18 +10,18 @@ import (
 func TestAcquireRejectsWhenQueueIsFull(t *testing.T) {
 	q := New(1, 1)
 
-	h1 := q.Acquire()
+	h1 := q.Acquire("")
 	first := <-h1.C
 	require.True(t, first.Ok)
 
-	h2 := q.Acquire()
+	h2 := q.Acquire("")
 	second := <-h2.C
 	assert.False(t, second.Ok)
 	assert.False(t, second.Full)
 	assert.Equal(t, 0, second.Index)
 	assert.Equal(t, 1, second.Max)
 
-	h3 := q.Acquire()
+	h3 := q.Acquire("")
 	third := <-h3.C
 	assert.True(t, third.Full)
 	assert.False(t, third.Ok)
@@ -30,3 +30,267 @@ func TestAcquireRejectsWhenQueueIsFull(t *testing.T) {
 	assert.True(t, (<-h2.C).Ok)
 	h2.Release()
 }
+
+// promoted reports whether h was given a slot since the last call.
+func promoted(h *Handle) bool {
+	got := false
+	for {
+		select {
+		case status, open := <-h.C:
+			if !open {
+				return got
+			}
+			got = got || status.Ok
+		default:
+			return got
+		}
+	}
+}
+
+// promotionOrder releases the active handle and then each promoted one,
+// returning the names of the handles in the order they were promoted.
+func promotionOrder(t *testing.T, active *Handle, queued map[string]*Handle) []string {
+	var order []string
+	for len(order) < len(queued) {
+		active.Release()
+		var next []string
+		for name, h := range queued {
+			if promoted(h) {
+				next = append(next, name)
+				active = h
+			}
+		}
+		require.Len(t, next, 1, "one handle promoted per release")
+		order = append(order, next[0])
+	}
+	active.Release()
+	return order
+}
+
+func TestFairQueueingRoundRobinsAcrossKeys(t *testing.T) {
+	q := New(1, 0)
+	q.SetFair(true)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+
+	queued := map[string]*Handle{}
+	for _, name := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		queued[name] = q.Acquire(name[:1])
+	}
+	assert.Equal(t, []string{"a1", "b1", "c1", "a2", "b2", "a3"}, promotionOrder(t, active, queued))
+	assert.Zero(t, q.QueuedLen())
+}
+
+func TestFairQueueingReportsPositions(t *testing.T) {
+	q := New(1, 0)
+	q.SetFair(true)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+	a1 := q.Acquire("a")
+	a2 := q.Acquire("a")
+	assert.Equal(t, Status{Index: 0, Max: 1}, <-a1.C)
+	assert.Equal(t, Status{Index: 1, Max: 2}, <-a2.C)
+
+	// b1 overtakes a2
+	b1 := q.Acquire("b")
+	assert.Equal(t, Status{Index: 1, Max: 3}, <-b1.C)
+	assert.Equal(t, Status{Index: 2, Max: 3}, <-a2.C)
+	assert.Equal(t, Status{Index: 0, Max: 3}, <-a1.C)
+
+	active.Release()
+	a1.Release()
+	assert.True(t, (<-b1.C).Ok)
+	b1.Release()
+	assert.True(t, (<-a2.C).Ok)
+	a2.Release()
+}
+
+func TestFairQueueingNewKeyWaitsAtMostOneRound(t *testing.T) {
+	q := New(1, 0)
+	q.SetFair(true)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+	var handles []*Handle
+	for range 4 {
+		handles = append(handles, q.Acquire("a"))
+	}
+
+	// Let two rounds of "a" go, then a new key shows up
+	active.Release()
+	require.True(t, promoted(handles[0]))
+	handles[0].Release()
+	require.True(t, promoted(handles[1]))
+
+	d := q.Acquire("d")
+	assert.Equal(t, Status{Index: 0, Max: 3}, <-d.C)
+	handles[1].Release()
+	assert.True(t, promoted(d))
+	assert.False(t, promoted(handles[2]))
+
+	d.Release()
+	assert.True(t, promoted(handles[2]))
+	handles[2].Release()
+	assert.True(t, promoted(handles[3]))
+	handles[3].Release()
+}
+
+func TestFairQueueingForgetsRoundsOfReleasedItems(t *testing.T) {
+	q := New(1, 0)
+	q.SetFair(true)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+	a1 := q.Acquire("a")
+	a2 := q.Acquire("a")
+	// Both leave the queue before their turn
+	a1.Release()
+	a2.Release()
+
+	queued := map[string]*Handle{}
+	for _, name := range []string{"b1", "b2", "a3"} {
+		queued[name] = q.Acquire(name[:1])
+	}
+	assert.Equal(t, []string{"b1", "a3", "b2"}, promotionOrder(t, active, queued))
+}
+
+func TestFIFOIgnoresKeys(t *testing.T) {
+	q := New(1, 0)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+
+	queued := map[string]*Handle{}
+	for _, name := range []string{"a1", "a2", "b1"} {
+		queued[name] = q.Acquire(name[:1])
+	}
+	assert.Equal(t, []string{"a1", "a2", "b1"}, promotionOrder(t, active, queued))
+}
+
+func TestSetFairKeepsQueuedOrder(t *testing.T) {
+	q := New(1, 0)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+
+	queued := map[string]*Handle{}
+	queued["a1"] = q.Acquire("a")
+	queued["a2"] = q.Acquire("a")
+	q.SetFair(true)
+	queued["b1"] = q.Acquire("b")
+	queued["a3"] = q.Acquire("a")
+	assert.Equal(t, []string{"a1", "a2", "b1", "a3"}, promotionOrder(t, active, queued))
+}
+
+func TestPriorityJumpsQueue(t *testing.T) {
+	q := New(1, 0)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+	p1 := q.Acquire("p")
+	assert.Equal(t, Status{Index: 0, Max: 1}, <-p1.C)
+
+	t1 := q.AcquireClient(Client{Key: "t", Priority: 10})
+	assert.Equal(t, Status{Index: 0, Max: 2}, <-t1.C)
+	assert.Equal(t, Status{Index: 1, Max: 2}, <-p1.C)
+
+	queued := map[string]*Handle{"p1": p1, "t1": t1}
+	queued["p2"] = q.Acquire("p")
+	queued["t2"] = q.AcquireClient(Client{Key: "t", Priority: 10})
+	assert.Equal(t, []string{"t1", "t2", "p1", "p2"}, promotionOrder(t, active, queued))
+}
+
+func TestPriorityDisplacesWhenQueueIsFull(t *testing.T) {
+	q := New(1, 2)
+
+	active := q.Acquire("x")
+	require.True(t, (<-active.C).Ok)
+	p1 := q.Acquire("p")
+	assert.Equal(t, Status{Index: 0, Max: 1}, <-p1.C)
+	p2 := q.Acquire("p")
+	assert.Equal(t, Status{Index: 1, Max: 2}, <-p2.C)
+
+	// The last queued client makes room for one of a higher priority
+	t1 := q.AcquireClient(Client{Key: "t", Priority: 10})
+	assert.Equal(t, Status{Index: 0, Max: 2}, <-t1.C)
+	assert.Equal(t, Status{Index: 1, Max: 2}, <-p1.C)
+	assert.Equal(t, Status{Full: true}, <-p2.C)
+	_, open := <-p2.C
+	assert.False(t, open)
+	p2.Release()
+	assert.Equal(t, 2, q.QueuedLen())
+
+	// But not for one of the same priority
+	p3 := q.Acquire("p")
+	assert.True(t, (<-p3.C).Full)
+	t2 := q.AcquireClient(Client{Key: "t", Priority: 10})
+	assert.Equal(t, Status{Index: 1, Max: 2}, <-t2.C)
+	assert.True(t, (<-p1.C).Full)
+	p1.Release()
+	t3 := q.AcquireClient(Client{Key: "t", Priority: 10})
+	assert.True(t, (<-t3.C).Full)
+
+	queued := map[string]*Handle{"t1": t1, "t2": t2}
+	assert.Equal(t, []string{"t1", "t2"}, promotionOrder(t, active, queued))
+}
+
+func TestReservedSlots(t *testing.T) {
+	q := New(3, 0)
+	q.SetReserved(map[string]int{"campus": 1})
+	campus := Client{Key: "m", Class: "campus"}
+
+	a := q.Acquire("a")
+	require.True(t, (<-a.C).Ok)
+	b := q.Acquire("b")
+	require.True(t, (<-b.C).Ok)
+
+	// The shared slots are taken, the public queues
+	c := q.Acquire("c")
+	assert.Equal(t, Status{Index: 0, Max: 1}, <-c.C)
+
+	// The reserved slot bypasses the queue
+	m1 := q.AcquireClient(campus)
+	require.True(t, (<-m1.C).Ok)
+
+	// Once the reserved slot is taken, the class queues as well
+	m2 := q.AcquireClient(campus)
+	assert.Equal(t, Status{Index: 1, Max: 2}, <-m2.C)
+	d := q.Acquire("d")
+	assert.Equal(t, Status{Index: 2, Max: 3}, <-d.C)
+
+	// A shared slot goes to the head of the queue
+	a.Release()
+	assert.True(t, promoted(c))
+	assert.False(t, promoted(m2))
+
+	// The reserved slot goes to the class even if others are ahead
+	m1.Release()
+	assert.True(t, promoted(m2))
+	assert.False(t, promoted(d))
+	assert.Equal(t, 1, q.QueuedLen())
+
+	b.Release()
+	assert.True(t, promoted(d))
+	for _, h := range []*Handle{c, m2, d} {
+		h.Release()
+	}
+	assert.Zero(t, q.ActiveLen())
+}
+
+func TestSetReservedPromotes(t *testing.T) {
+	q := New(2, 0)
+	q.SetReserved(map[string]int{"campus": 1})
+
+	a := q.Acquire("a")
+	require.True(t, (<-a.C).Ok)
+	b := q.Acquire("b")
+	assert.Equal(t, Status{Index: 0, Max: 1}, <-b.C)
+	assert.Equal(t, 1, q.GetReserved("campus"))
+
+	q.SetReserved(nil)
+	assert.True(t, promoted(b))
+	a.Release()
+	b.Release()
+}
@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+)
+
+const (
+	// Limits for the server-side arguments sent by clients after the module
+	// is accepted.
+	maxClientArgsSize = 64 * 1024
+	maxClientArgs     = 1024
+
+	// Size of the buffer the client's data is copied with until its
+	// arguments have been inspected, the same as io.Copy's
+	argsRelayBufferSize = 32 * 1024
+)
+
+// Directions of a transfer, as seen by the client.
+const (
+	directionPull = "pull"
+	directionPush = "push"
+)
+
+// clientArgs are the server-side arguments sent by an rsync client, e.g.
+// "--server --sender -vlogDtpre.iLsfxC . module/path".
+type clientArgs struct {
+	// Options before the "." separator, except --server
+	Options []string
+	Paths   []string
+	// Whether the upstream is the sender, i.e. the client pulls
+	Sender bool
+	// Whether the real arguments are sent in a second list (-s)
+	Protected bool
+
+	longOptions  []string
+	shortOptions []byte
+}
+
+func (a *clientArgs) direction() string {
+	if a.Sender {
+		return directionPull
+	}
+	return directionPush
+}
+
+// parseClientArgs interprets a list of server-side arguments.
+func parseClientArgs(list []string) *clientArgs {
+	a := &clientArgs{}
+	for i, arg := range list {
+		if arg == "." {
+			a.Paths = append(a.Paths, list[i+1:]...)
+			break
+		}
+		switch {
+		case arg == "--server":
+			continue
+		case arg == "--sender":
+			a.Sender = true
+		case strings.HasPrefix(arg, "--"):
+			name, _, _ := strings.Cut(arg[2:], "=")
+			a.longOptions = append(a.longOptions, name)
+			if name == "protect-args" || name == "secluded-args" {
+				a.Protected = true
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			for j := 1; j < len(arg); j++ {
+				c := arg[j]
+				// The rest after 'e' is the capability string of the client
+				if c == 'e' || c == '.' {
+					break
+				}
+				a.shortOptions = append(a.shortOptions, c)
+				if c == 's' {
+					a.Protected = true
+				}
+			}
+		}
+		a.Options = append(a.Options, arg)
+	}
+	return a
+}
+
+// merge adds the protected arguments sent after the first list.
+func (a *clientArgs) merge(protected *clientArgs) {
+	a.Options = append(a.Options, protected.Options...)
+	a.Paths = append(a.Paths, protected.Paths...)
+	a.Sender = a.Sender || protected.Sender
+	a.longOptions = append(a.longOptions, protected.longOptions...)
+	a.shortOptions = append(a.shortOptions, protected.shortOptions...)
+}
+
+// refusedOption returns the first option matching one of patterns, which
+// are either single letters of short options or (glob) names of long options.
+func (a *clientArgs) refusedOption(patterns []string) (string, bool) {
+	for _, pattern := range patterns {
+		if len(pattern) == 1 {
+			if bytes.IndexByte(a.shortOptions, pattern[0]) >= 0 {
+				return "-" + pattern, true
+			}
+			continue
+		}
+		for _, name := range a.longOptions {
+			if ok, _ := path.Match(pattern, name); ok {
+				return "--" + name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// readClientArgList reads one list of arguments terminated by an empty one.
+// Protocol 30 and newer separate arguments with NUL, older ones with newline.
+// raw receives the bytes read so that they can be forwarded.
+func readClientArgList(br *bufio.Reader, raw *bytes.Buffer) ([]string, error) {
+	var list []string
+	var sep byte
+	var current []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		raw.WriteByte(c)
+		if raw.Len() > maxClientArgsSize {
+			return nil, fmt.Errorf("arguments too long")
+		}
+		if sep == 0 && (c == 0 || c == lineFeed) {
+			sep = c
+		}
+		if c != sep {
+			current = append(current, c)
+			continue
+		}
+		if len(current) == 0 {
+			return list, nil
+		}
+		if len(list) == maxClientArgs {
+			return nil, fmt.Errorf("too many arguments")
+		}
+		list = append(list, string(current))
+		current = current[:0]
+	}
+}
+
+// readClientArgs reads the arguments of the client, including the protected
+// ones if any. raw receives the bytes read.
+func readClientArgs(br *bufio.Reader, raw *bytes.Buffer) (*clientArgs, error) {
+	list, err := readClientArgList(br, raw)
+	if err != nil {
+		return nil, err
+	}
+	args := parseClientArgs(list)
+	if args.Protected {
+		list, err := readClientArgList(br, raw)
+		if err != nil {
+			return nil, fmt.Errorf("read protected arguments: %w", err)
+		}
+		// The protected list starts with a placeholder for the program name
+		if len(list) > 0 && !strings.HasPrefix(list[0], "-") {
+			list = list[1:]
+		}
+		args.merge(parseClientArgs(list))
+	}
+	return args, nil
+}
+
+// argsPolicy restricts what clients may ask for in a module.
+type argsPolicy struct {
+	DenyPush bool
+	// Refuse pushes in rsyncd's words for read only modules
+	ReadOnlyMessage bool
+	RefuseOptions   []string
+}
+
+// restricts reports whether the policy may refuse any arguments.
+func (p argsPolicy) restricts() bool {
+	return p.DenyPush || len(p.RefuseOptions) > 0
+}
+
+// errModuleReadOnly refuses uploads to read only modules. It is sent to the
+// client in rsyncd's own words.
+var errModuleReadOnly = errors.New("module is read only")
+
+func (p argsPolicy) check(args *clientArgs) error {
+	if p.DenyPush && !args.Sender {
+		if p.ReadOnlyMessage {
+			return errModuleReadOnly
+		}
+		return errors.New("uploads are not allowed")
+	}
+	if option, ok := args.refusedOption(p.RefuseOptions); ok {
+		return fmt.Errorf("option %s is not allowed", option)
+	}
+	return nil
+}
+
+// Multiplexed message tags of the rsync protocol
+const (
+	rsyncMplexBase = 7
+	rsyncMsgError  = 3
+)
+
+// clientSetupError builds what rsyncd sends when it refuses the client's
+// arguments: it finishes the protocol setup, then sends the message through
+// the multiplexed stream so that the client prints it.
+func clientSetupError(protocol int, message string) []byte {
+	return clientSetupMessage(protocol, "rsync-proxy: "+message)
+}
+
+// clientSetupMessage is like clientSetupError, but sends msg as is.
+func clientSetupMessage(protocol int, msg string) []byte {
+	var b []byte
+	if protocol >= 30 {
+		// No compatibility flags, so that the client does not expect
+		// checksum negotiation
+		b = append(b, 0)
+	}
+	// Checksum seed
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	if protocol < 23 {
+		return b
+	}
+	msg += "\n"
+	b = binary.LittleEndian.AppendUint32(b, uint32((rsyncMplexBase+rsyncMsgError)<<24|len(msg)))
+	return append(b, msg...)
+}
+
+// clientArgsRelay forwards the client's data to the upstream and inspects the
+// client's arguments, which follow once the upstream accepted the module.
+type clientArgsRelay struct {
+	server     *Server
+	downConn   net.Conn
+	info       *ConnInfo
+	ip         string
+	moduleName string
+	policy     argsPolicy
+	// Protocol negotiated between the client and the upstream
+	protocol int
+	// Closed once the upstream accepted the module request
+	accepted <-chan struct{}
+}
+
+// argsPrefix starts the arguments of every client.
+var argsPrefix = []byte("--server")
+
+// pipelinedArgs returns the part of what the client sent before the upstream
+// accepted the module that holds its arguments, i.e. what follows the answer
+// to an auth challenge if any, or nil if the client waited for the reply.
+func pipelinedArgs(early []byte) []byte {
+	if len(early) == 0 {
+		return nil
+	}
+	if bytes.HasPrefix(early, argsPrefix) || bytes.HasPrefix(argsPrefix, early) {
+		return early
+	}
+	_, rest, _ := bytes.Cut(early, []byte{lineFeed})
+	if len(rest) == 0 {
+		return nil
+	}
+	return rest
+}
+
+// relay copies from src to up until the client's arguments have been
+// inspected, and returns the reader to copy the rest of the client's data
+// from. It returns nil if the client is done, or if its arguments have been
+// refused, in which case the client has been sent an error.
+//
+// Unless the policy restricts anything, the upstream's reply is not awaited
+// before relaying, so a client may send its arguments before the reply and
+// they are forwarded at once. They are then only recorded. Arguments that
+// cannot be read end the connection only if the policy has to check them.
+func (r *clientArgsRelay) relay(up io.Writer, src io.Reader) (io.Reader, error) {
+	s := r.server
+	buf := make([]byte, argsRelayBufferSize)
+	// What has been forwarded before the upstream accepted the module, unless
+	// too long to be arguments
+	var early []byte
+	overflow := false
+	var head []byte
+	for head == nil {
+		n, err := src.Read(buf)
+		select {
+		case <-r.accepted:
+			// The upstream only replies after it has received everything
+			// the client sent before, so data not forwarded yet is sent
+			// after the reply: the arguments.
+			head = bytes.Clone(buf[:n])
+		default:
+			if n > 0 {
+				if _, err := up.Write(buf[:n]); err != nil {
+					return nil, err
+				}
+				if len(early)+n > maxClientArgsSize {
+					early, overflow = nil, true
+				} else if !overflow {
+					early = append(early, buf[:n]...)
+				}
+			}
+		}
+		if err != nil {
+			if len(head) > 0 {
+				_, _ = up.Write(head)
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			return nil, err
+		}
+	}
+
+	if args := pipelinedArgs(early); args != nil {
+		if _, err := up.Write(head); err != nil {
+			return nil, err
+		}
+		// Everything read from now on is forwarded as it is read
+		br := bufio.NewReader(io.MultiReader(bytes.NewReader(args), bytes.NewReader(head), io.TeeReader(src, up)))
+		parsed, err := readClientArgs(br, &bytes.Buffer{})
+		if err != nil {
+			// What has been read has been forwarded already
+			r.unreadable(err)
+			return src, nil
+		}
+		r.record(parsed)
+		return src, nil
+	}
+
+	br := bufio.NewReader(io.MultiReader(bytes.NewReader(head), src))
+	var raw bytes.Buffer
+	args, err := readClientArgs(br, &raw)
+	switch {
+	case err != nil && r.policy.restricts():
+		return nil, fmt.Errorf("read arguments: %w", err)
+	case err != nil:
+		r.unreadable(err)
+	default:
+		r.record(args)
+		if err := r.policy.check(args); err != nil {
+			s.accessLog.F("client %s refused by module %s policy: %v", r.ip, r.moduleName, err)
+			reply := clientSetupError(r.protocol, err.Error())
+			if errors.Is(err, errModuleReadOnly) {
+				reply = clientSetupMessage(r.protocol, "@ERROR: "+err.Error())
+			}
+			_, _ = writeWithTimeout(r.downConn, reply, s.WriteTimeout)
+			return nil, nil
+		}
+	}
+	if _, err := up.Write(raw.Bytes()); err != nil {
+		return nil, err
+	}
+	rest, _ := br.Peek(br.Buffered())
+	return io.MultiReader(bytes.NewReader(bytes.Clone(rest)), src), nil
+}
+
+// record records the client's arguments in its ConnInfo and the access log.
+func (r *clientArgsRelay) record(args *clientArgs) {
+	r.info.SetArgs(args)
+	verb := "pulls from"
+	if !args.Sender {
+		verb = "pushes to"
+	}
+	r.server.accessLog.F("client %s %s module %s (paths: %q, options: %q)", r.ip, verb, r.moduleName, args.Paths, args.Options)
+}
+
+// unreadable logs arguments that could not be parsed, which are forwarded
+// anyway unless the policy has to check them.
+func (r *clientArgsRelay) unreadable(err error) {
+	r.server.accessLog.F("client %s sends arguments to module %s that cannot be read: %v", r.ip, r.moduleName, err)
+}
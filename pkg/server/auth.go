@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+)
+
+// authDigests are the digests the proxy can verify rsyncd auth responses
+// with. MD4 is advertised in RsyncdServerVersion for compatibility with
+// upstreams, but is not supported for proxy-side authentication.
+var authDigests = map[string]func() hash.Hash{
+	"sha512": sha512.New,
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+}
+
+// moduleAuth holds the users allowed to access a module and their passwords.
+type moduleAuth struct {
+	// user -> password
+	users map[string]string
+}
+
+func loadModuleAuth(moduleName string, m *Module) (*moduleAuth, error) {
+	if len(m.AuthUsers) == 0 && m.SecretsFile == "" {
+		return nil, nil
+	}
+	if len(m.AuthUsers) == 0 || m.SecretsFile == "" {
+		return nil, fmt.Errorf("module=%s: auth_users and secrets_file must be set together", moduleName)
+	}
+	lines, err := readSecretLines(m.SecretsFile)
+	if err != nil {
+		return nil, fmt.Errorf("module=%s: %w", moduleName, err)
+	}
+	secrets := make(map[string]string, len(lines))
+	for _, line := range lines {
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("module=%s: malformed line in secrets file %s", moduleName, m.SecretsFile)
+		}
+		if _, ok := secrets[user]; !ok {
+			// rsyncd uses the first matching line
+			secrets[user] = password
+		}
+	}
+	auth := &moduleAuth{users: make(map[string]string, len(m.AuthUsers))}
+	for _, user := range m.AuthUsers {
+		password, ok := secrets[user]
+		if !ok {
+			return nil, fmt.Errorf("module=%s: user %s has no password in secrets file %s", moduleName, user, m.SecretsFile)
+		}
+		auth.users[user] = password
+	}
+	return auth, nil
+}
+
+// authDigestForClient picks the digest to authenticate a client with from its
+// greeting. Like rsyncd, the first digest in the client's list that we support
+// is chosen, and clients that do not send a list use MD5 if they speak
+// protocol 30 or newer. The client only considers the digests of the greeting
+// we advertised to it.
+func authDigestForClient(greeting, advertised rsyncdGreeting) (string, error) {
+	if greeting.Digests == nil {
+		if greeting.Protocol < 30 {
+			return "", fmt.Errorf("md4 authentication of protocol %d clients is not supported", greeting.Protocol)
+		}
+		return "md5", nil
+	}
+	allowed := advertised.authDigests()
+	for _, name := range greeting.Digests {
+		if _, ok := authDigests[name]; ok && slices.Contains(allowed, name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no supported digest in %s", strings.Join(greeting.Digests, " "))
+}
+
+// newAuthChallenge returns a random challenge in the same format as rsyncd.
+func newAuthChallenge() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b[:]), nil
+}
+
+// authResponse computes the response to challenge expected from a client
+// that knows password.
+func authResponse(digest, password, challenge string) string {
+	h := authDigests[digest]()
+	h.Write([]byte(password))
+	h.Write([]byte(challenge))
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// verify checks the "<user> <response>" line sent by a client, and returns
+// the user name if the response is valid.
+func (a *moduleAuth) verify(digest, challenge, line string) (user string, ok bool) {
+	user, response, _ := strings.Cut(strings.TrimRight(line, "\n"), " ")
+	password, known := a.users[user]
+	if !known {
+		// Compare anyway so that unknown users take the same time
+		password = ""
+	}
+	expected := authResponse(digest, password, challenge)
+	match := subtle.ConstantTimeCompare([]byte(expected), []byte(response)) == 1
+	return user, known && match
+}
+
+// authenticateClient runs the rsyncd challenge/response exchange with a
+// client requesting moduleName. If the client fails to authenticate, it has
+// already been sent an error and ok is false.
+func (s *Server) authenticateClient(downConn *handshakeConn, auth *moduleAuth, greeting, advertised rsyncdGreeting, moduleName, ip string) (user string, ok bool, err error) {
+	writeTimeout := s.WriteTimeout
+	digest, err := authDigestForClient(greeting, advertised)
+	if err != nil {
+		s.accessLog.F("client %s cannot authenticate for module %s: %v", ip, moduleName, err)
+		_, _ = writeWithTimeout(downConn, fmt.Appendf(nil, "@ERROR: auth failed on module %s\n", moduleName), writeTimeout)
+		return "", false, nil
+	}
+	challenge, err := newAuthChallenge()
+	if err != nil {
+		return "", false, fmt.Errorf("generate challenge: %w", err)
+	}
+	if _, err := writeWithTimeout(downConn, fmt.Appendf(nil, "@RSYNCD: AUTHREQD %s\n", challenge), writeTimeout); err != nil {
+		return "", false, fmt.Errorf("send challenge: %w", err)
+	}
+	line, err := downConn.readLine(s.ReadTimeout)
+	if err != nil {
+		s.rejectHandshake(downConn, err)
+		return "", false, fmt.Errorf("read auth response: %w", err)
+	}
+	user, ok = auth.verify(digest, challenge, string(line))
+	if !ok {
+		s.accessLog.F("client %s auth failed on module %s as user %q", ip, moduleName, user)
+		_, _ = writeWithTimeout(downConn, fmt.Appendf(nil, "@ERROR: auth failed on module %s\n", moduleName), writeTimeout)
+		return user, false, nil
+	}
+	s.accessLog.F("client %s authenticated as %s for module %s (digest: %s)", ip, user, moduleName, digest)
+	return user, true, nil
+}
@@ -0,0 +1,34 @@
+package server
+
+import "net/netip"
+
+// Ways of telling clients apart, e.g. for fair queueing.
+const (
+	// By address
+	clientKeyIP = "ip"
+	// By /24 IPv4 or /64 IPv6 subnet
+	clientKeySubnet = "subnet"
+)
+
+// clientKey returns the key of the client at ip when clients are told apart
+// by mode, or "" if mode is empty.
+func clientKey(mode, ip string) string {
+	if mode == "" {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		// Not an IP address, e.g. a Unix socket
+		return ip
+	}
+	addr = addr.Unmap()
+	if mode != clientKeySubnet {
+		return addr.String()
+	}
+	bits := 64
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
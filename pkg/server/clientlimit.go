@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// connCounter counts the connections of each key.
+type connCounter[K comparable] struct {
+	mu     sync.Mutex
+	counts map[K]int
+}
+
+// add counts a connection of key and returns how many key has now.
+func (c *connCounter[K]) add(key K) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[K]int)
+	}
+	c.counts[key]++
+	return c.counts[key]
+}
+
+func (c *connCounter[K]) done(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key]--; c.counts[key] <= 0 {
+		delete(c.counts, key)
+	}
+}
+
+// moduleClientKey identifies the connections of a client to a module.
+type moduleClientKey struct {
+	module string
+	client string
+}
+
+// clientLimit is the limit of simultaneous connections of a client.
+type clientLimit struct {
+	// 0 for no limit
+	max   int
+	scope string
+}
+
+func (s *Server) getClientLimit() clientLimit {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.clientLimit
+}
+
+// countClientConn counts a connection of the client at ip towards the
+// global limit. It returns the key of the client, empty if it is not
+// limited, and how many connections it has including this one.
+func (s *Server) countClientConn(ip string, limit clientLimit) (key string, count int) {
+	if _, err := netip.ParseAddr(ip); err != nil {
+		return "", 0
+	}
+	key = clientKey(limit.scope, ip)
+	return key, s.clientConns.add(key)
+}
+
+// rejectClientOverLimit tells the client that it has too many connections.
+// The connection is uncounted first, so the client may connect again as soon
+// as it is told.
+func (s *Server) rejectClientOverLimit(conn *handshakeConn, ip, moduleName string, limit int, uncount func()) {
+	uncount()
+	s.clientLimitRejected.Add(1)
+	if moduleName == "" {
+		s.accessLog.F("client %s reaches the connection limit (%d)", ip, limit)
+	} else {
+		s.accessLog.F("client %s reaches the connection limit (%d) for module %s", ip, limit, moduleName)
+	}
+	msg := fmt.Sprintf("@ERROR: max connections per client (%d) reached -- try again later\n", limit)
+	_, _ = writeWithTimeout(conn, []byte(msg), s.WriteTimeout)
+}
@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/pelletier/go-toml"
 )
@@ -15,9 +16,90 @@ type Upstream struct {
 	UseProxyProtocol bool     `toml:"use_proxy_protocol"`
 	MaxActiveConns   int      `toml:"max_active_connections"`
 	MaxQueuedConns   int      `toml:"max_queued_connections"`
+	// How long a client may wait in the queue before being told to retry
+	// later, 0 for no limit
+	MaxQueueWait time.Duration `toml:"max_queue_wait"`
+	// Promote queued clients round-robin across client addresses ("ip") or
+	// their /24 and /64 subnets ("subnet") rather than first come, first
+	// served
+	FairQueueing string `toml:"fair_queueing"`
+	// Clients from some networks that jump the queue or have active
+	// connections reserved for them
+	PriorityClasses []PriorityClass `toml:"priority_classes"`
+	// Jump proxy to reach the upstream through, e.g. socks5://host:1080
+	Via                string `toml:"via"`
+	ViaCredentialsFile string `toml:"via_credentials_file"`
+	// Credentials to answer the upstream's auth challenge with on behalf
+	// of clients from the given networks
+	CredentialsFile     string   `toml:"credentials_file"`
+	CredentialsNetworks []string `toml:"credentials_networks"`
+	// What to do when the upstream rejects a module request with "max
+	// connections": "retry" on another upstream serving the module, or
+	// "requeue" into the proxy's queue for the upstream
+	OnMaxConnections         string        `toml:"on_max_connections"`
+	MaxConnectionsRetryDelay time.Duration `toml:"max_connections_retry_delay"`
+	MaxConnectionsRetries    int           `toml:"max_connections_retries"`
+}
+
+// PriorityClass holds queueing settings of the clients of an upstream from
+// some networks.
+type PriorityClass struct {
+	Name     string   `toml:"name"`
+	Networks []string `toml:"networks"`
+	// Queued clients with a higher priority are served first, other clients
+	// have priority 0
+	Priority int `toml:"priority"`
+	// Connections out of max_active_connections that only the class may use
+	ReservedConns int `toml:"reserved_connections"`
+}
+
+// HostsACL holds rsyncd-style "hosts allow" and "hosts deny" lists of
+// networks (CIDRs or addresses), given inline or in files with one network
+// per line.
+type HostsACL struct {
+	HostsAllow     []string `toml:"hosts_allow"`
+	HostsDeny      []string `toml:"hosts_deny"`
+	HostsAllowFile string   `toml:"hosts_allow_file"`
+	HostsDenyFile  string   `toml:"hosts_deny_file"`
+}
+
+// Module holds settings of a module enforced by the proxy itself.
+type Module struct {
+	// Clients allowed to access the module
+	HostsACL
+	// Users allowed to access the module, authenticated with passwords
+	// from SecretsFile like rsyncd does
+	AuthUsers   []string `toml:"auth_users"`
+	SecretsFile string   `toml:"secrets_file"`
+	// Credentials to authenticate to the upstream with on behalf of clients
+	// from the given networks, overriding those of the upstream
+	UpstreamCredentialsFile     string   `toml:"upstream_credentials_file"`
+	UpstreamCredentialsNetworks []string `toml:"upstream_credentials_networks"`
+	// Like DenyPush, but refuse with "@ERROR: module is read only" like
+	// rsyncd does
+	ReadOnly bool `toml:"read_only"`
+	// Refuse uploads, i.e. transfers where the client is not the receiver
+	DenyPush bool `toml:"deny_push"`
+	// Options refused for clients: single letters of short options, or
+	// names of long options (without "--") which may contain wildcards
+	RefuseOptions []string `toml:"refuse_options"`
+	// Simultaneous connections to the module allowed from one client, 0 for
+	// no limit
+	MaxConnectionsPerClient int `toml:"max_connections_per_client"`
+	// Simultaneous connections to the module, queued like those to an
+	// upstream and before them, 0 for no limit
+	MaxActiveConns int `toml:"max_active_connections"`
+	MaxQueuedConns int `toml:"max_queued_connections"`
+	// How long a client may wait in the module's queue, 0 for no limit
+	MaxQueueWait time.Duration `toml:"max_queue_wait"`
 }
 
 type ProxySettings struct {
+	// Clients allowed to connect, and those allowed to connect to each
+	// listener, named after its listen option
+	HostsACL
+	Listeners map[string]HostsACL `toml:"listeners"`
+
 	Listen      string `toml:"listen"`
 	ListenTLS   string `toml:"listen_tls"`
 	ListenHTTP  string `toml:"listen_http"`
@@ -26,11 +108,53 @@ type ProxySettings struct {
 	ErrorLog    string `toml:"error_log"`
 	TLSCertFile string `toml:"tls_cert_file"`
 	TLSKeyFile  string `toml:"tls_key_file"`
+
+	TLSMinVersion               string        `toml:"tls_min_version"`
+	TLSCipherSuites             []string      `toml:"tls_cipher_suites"`
+	TLSCurvePreferences         []string      `toml:"tls_curve_preferences"`
+	TLSSessionTicketKeyRotation time.Duration `toml:"tls_session_ticket_key_rotation"`
+	TLSWatchInterval            time.Duration `toml:"tls_watch_interval"`
+	TLSExpiryWarning            time.Duration `toml:"tls_expiry_warning"`
+
+	ListenHTTPConnect       string   `toml:"listen_http_connect"`
+	HTTPConnectAllowedHosts []string `toml:"http_connect_allowed_hosts"`
+
+	// How the protocol version advertised to clients is chosen: "fixed"
+	// (default) or "min"
+	ProtocolNegotiation string `toml:"protocol_negotiation"`
+
+	// Simultaneous connections allowed from one client, 0 for no limit
+	MaxConnectionsPerClient int `toml:"max_connections_per_client"`
+	// Whether clients are counted by address ("ip", default) or by /24 and
+	// /64 subnet ("subnet")
+	ClientLimitScope string `toml:"client_limit_scope"`
+
+	// Simultaneous client connections, and those in the handshake phase;
+	// 0 for no limit
+	MaxConnections            int `toml:"max_connections"`
+	MaxHandshakingConnections int `toml:"max_handshaking_connections"`
+	// Time allowed for the handshake phase, from accepting a connection
+	// until the module request is accepted; 0 for no limit
+	HandshakeTimeout time.Duration `toml:"handshake_timeout"`
+
+	// New connections allowed at once from one client address, regained
+	// over connection_rate_period; 0 for no limit
+	ConnectionRateLimit  int           `toml:"connection_rate_limit"`
+	ConnectionRatePeriod time.Duration `toml:"connection_rate_period"`
+	// Requests for unknown modules allowed at once from one client address,
+	// regained over unknown_module_rate_period; 0 for no limit
+	UnknownModuleRateLimit  int           `toml:"unknown_module_rate_limit"`
+	UnknownModuleRatePeriod time.Duration `toml:"unknown_module_rate_period"`
+	// How long clients exceeding a rate limit are banned, 0 for no ban
+	BanDuration time.Duration `toml:"ban_duration"`
+	// File keeping the bans across restarts
+	BanFile string `toml:"ban_file"`
 }
 
 type Config struct {
 	Proxy     ProxySettings        `toml:"proxy"`
 	Upstreams map[string]*Upstream `toml:"upstreams"`
+	Modules   map[string]*Module   `toml:"modules"`
 }
 
 func (s *Server) ReadConfig(r io.Reader, openLog bool) error {
@@ -1,6 +1,11 @@
 package server
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -9,6 +14,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/ustclug/rsync-proxy/test/fake/rsync"
+	"github.com/ustclug/rsync-proxy/test/fake/tunnel"
 )
 
 func TestReadConfig(t *testing.T) {
@@ -200,8 +206,712 @@ max_queued_connections = 4
 	require.True(t, ok)
 	assert.Equal(t, 3, q.GetMax())
 
-	h := q.Acquire()
+	h := q.Acquire("")
 	status := <-h.C
 	assert.True(t, status.Ok)
 	h.Release()
 }
+
+func TestReadConfigLoadsMaxQueueWait(t *testing.T) {
+	s := New()
+	configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+max_queue_wait = "10m"
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+
+	targets, ok := s.getTargetsForModule("foo")
+	require.True(t, ok)
+	assert.Equal(t, 10*time.Minute, targets[0].MaxQueueWait)
+
+	s = New()
+	err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+max_queue_wait = "-1m"
+`), true)
+	assert.ErrorContains(t, err, "max_queue_wait must not be negative")
+}
+
+func TestReadConfigLoadsFairQueueing(t *testing.T) {
+	s := New()
+	configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+fair_queueing = "subnet"
+
+[upstreams.u2]
+address = "127.0.0.1:1235"
+modules = ["bar"]
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+
+	q, ok := s.getQueueForUpstream("u1")
+	require.True(t, ok)
+	assert.True(t, q.IsFair())
+	q, ok = s.getQueueForUpstream("u2")
+	require.True(t, ok)
+	assert.False(t, q.IsFair())
+
+	err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+fair_queueing = "host"
+`), false)
+	assert.ErrorContains(t, err, `invalid fair_queueing "host"`)
+}
+
+func TestLoadTLSHardeningConfig(t *testing.T) {
+	tlsFiles := writeTestTLSCert(t, t.TempDir(), "server", "rsync-proxy-test")
+
+	s := New()
+	configContent := `
+[proxy]
+listen_tls = "127.0.0.1:8731"
+tls_cert_file = "` + tlsFiles.certPath + `"
+tls_key_file = "` + tlsFiles.keyPath + `"
+tls_min_version = "1.2"
+tls_cipher_suites = ["TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"]
+tls_curve_preferences = ["X25519", "P256"]
+tls_session_ticket_key_rotation = "12h"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo1"]
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+	require.NotNil(t, s.tlsConfig)
+	assert.Equal(t, uint16(tls.VersionTLS12), s.tlsConfig.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}, s.tlsConfig.CipherSuites)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, s.tlsConfig.CurvePreferences)
+	assert.Equal(t, 12*time.Hour, s.tlsSettings.SessionTicketKeyRotate)
+}
+
+func TestLoadTLSConfigRejectsUnknownOptions(t *testing.T) {
+	tlsFiles := writeTestTLSCert(t, t.TempDir(), "server", "rsync-proxy-test")
+
+	for option, message := range map[string]string{
+		`tls_min_version = "1.4"`:                   "unknown tls version",
+		`tls_cipher_suites = ["TLS_NO_SUCH_SUITE"]`: "unknown tls cipher suite",
+		`tls_curve_preferences = ["P128"]`:          "unknown tls curve",
+	} {
+		s := New()
+		configContent := `
+[proxy]
+listen_tls = "127.0.0.1:8731"
+tls_cert_file = "` + tlsFiles.certPath + `"
+tls_key_file = "` + tlsFiles.keyPath + `"
+` + option + `
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo1"]
+`
+		err := s.ReadConfig(strings.NewReader(configContent), true)
+		require.Error(t, err, option)
+		assert.Contains(t, err.Error(), message)
+	}
+}
+
+func TestLoadHTTPConnectConfig(t *testing.T) {
+	s := New()
+	configContent := `
+[proxy]
+listen_http_connect = "127.0.0.1:8080"
+http_connect_allowed_hosts = ["Mirrors.Example.org", "mirrors.example.org:8873", "[2001:db8::1]"]
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo1"]
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, "127.0.0.1:8080", s.HTTPConnectListenAddr)
+	assert.Equal(t, []string{"mirrors.example.org:873", "mirrors.example.org:8873", "[2001:db8::1]:873"}, s.httpConnectAllowedHosts)
+}
+
+func TestLoadHTTPConnectConfigWithoutAllowedHosts(t *testing.T) {
+	s := New()
+	configContent := `
+[proxy]
+listen_http_connect = "127.0.0.1:8080"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo1"]
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.Error(t, err, "load config")
+	assert.Contains(t, err.Error(), "listen_http_connect requires http_connect_allowed_hosts")
+}
+
+func TestReadConfigDiscoversModulesThroughUpstreamProxy(t *testing.T) {
+	upstream := rsync.NewModuleListServer([]string{"bar", "foo"})
+	upstream.Start()
+	defer upstream.Close()
+
+	jump := tunnel.NewHTTPConnectServer("user", "secret")
+	jump.Start()
+	defer jump.Close()
+
+	credentialsPath := filepath.Join(t.TempDir(), "jump.secret")
+	require.NoError(t, os.WriteFile(credentialsPath, []byte("# jump host\nuser:secret\n"), 0600))
+
+	s := New()
+	s.ReadTimeout = time.Second
+	s.WriteTimeout = time.Second
+	configContent := `
+[upstreams.u1]
+address = "` + upstream.Listener.Addr().String() + `"
+discover_modules = true
+via = "http://` + jump.Listener.Addr().String() + `"
+via_credentials_file = "` + credentialsPath + `"
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+	via := &upstreamProxy{Scheme: upstreamProxyHTTP, Addr: jump.Listener.Addr().String(), Username: "user", Password: "secret"}
+	assert.Equal(t, map[string][]Target{
+		"bar": {{Upstream: "u1", Addr: upstream.Listener.Addr().String(), Via: via}},
+		"foo": {{Upstream: "u1", Addr: upstream.Listener.Addr().String(), Via: via}},
+	}, s.modules)
+	assert.Equal(t, []string{upstream.Listener.Addr().String()}, jump.Targets())
+}
+
+func TestReadConfigRejectsInvalidUpstreamProxy(t *testing.T) {
+	dir := t.TempDir()
+	openCredentials := filepath.Join(dir, "open.secret")
+	require.NoError(t, os.WriteFile(openCredentials, []byte("user:secret\n"), 0600))
+	require.NoError(t, os.Chmod(openCredentials, 0644))
+
+	for option, message := range map[string]string{
+		`via = "ftp://127.0.0.1:21"`:          "unsupported proxy scheme",
+		`via = "socks5://127.0.0.1"`:          "missing port",
+		`via = "socks5://u:p@127.0.0.1:1080"`: "via_credentials_file",
+		`via = "socks5://127.0.0.1:1080"` + "\n" + `via_credentials_file = "` + openCredentials + `"`: "must not be other-accessible",
+	} {
+		s := New()
+		configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+` + option + "\n"
+		err := s.ReadConfig(strings.NewReader(configContent), true)
+		require.Error(t, err, option)
+		assert.Contains(t, err.Error(), message)
+	}
+}
+
+func TestLoadModuleAuthConfig(t *testing.T) {
+	secretsPath := filepath.Join(t.TempDir(), "rsyncd.secrets")
+	require.NoError(t, os.WriteFile(secretsPath, []byte("# mirror users\nalice:wonderland\nbob:builder\nalice:ignored\n"), 0600))
+
+	s := New()
+	configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["public", "private"]
+
+[modules.private]
+auth_users = ["alice"]
+secrets_file = "` + secretsPath + `"
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+	assert.Nil(t, s.getModuleSettings("public").auth)
+	auth := s.getModuleSettings("private").auth
+	require.NotNil(t, auth)
+	assert.Equal(t, map[string]string{"alice": "wonderland"}, auth.users)
+}
+
+func TestLoadModuleAuthConfigRejectsInvalidSettings(t *testing.T) {
+	dir := t.TempDir()
+	secretsPath := filepath.Join(dir, "rsyncd.secrets")
+	require.NoError(t, os.WriteFile(secretsPath, []byte("alice:wonderland\n"), 0600))
+	openSecretsPath := filepath.Join(dir, "open.secrets")
+	require.NoError(t, os.WriteFile(openSecretsPath, []byte("alice:wonderland\n"), 0600))
+	require.NoError(t, os.Chmod(openSecretsPath, 0644))
+
+	for options, message := range map[string]string{
+		`auth_users = ["alice"]`: "must be set together",
+		`auth_users = ["bob"]` + "\n" + `secrets_file = "` + secretsPath + `"`:       "user bob has no password",
+		`auth_users = ["alice"]` + "\n" + `secrets_file = "` + openSecretsPath + `"`: "must not be other-accessible",
+	} {
+		s := New()
+		configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["private"]
+
+[modules.private]
+` + options + "\n"
+		err := s.ReadConfig(strings.NewReader(configContent), true)
+		require.Error(t, err, options)
+		assert.Contains(t, err.Error(), message)
+	}
+}
+
+func TestLoadUpstreamCredentialsConfig(t *testing.T) {
+	dir := t.TempDir()
+	upstreamCredentials := filepath.Join(dir, "u1.secret")
+	require.NoError(t, os.WriteFile(upstreamCredentials, []byte("mirror:secret\n"), 0600))
+	moduleCredentials := filepath.Join(dir, "private.secret")
+	require.NoError(t, os.WriteFile(moduleCredentials, []byte("private:hidden\n"), 0600))
+
+	s := New()
+	configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo", "private"]
+credentials_file = "` + upstreamCredentials + `"
+credentials_networks = ["10.0.0.1/8", "2001:db8::/32"]
+
+[modules.private]
+upstream_credentials_file = "` + moduleCredentials + `"
+upstream_credentials_networks = ["192.168.0.0/16"]
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+
+	creds := s.modules["foo"][0].Credentials
+	require.NotNil(t, creds)
+	assert.Equal(t, "mirror", creds.Username)
+	assert.Equal(t, "secret", creds.Password)
+	assert.True(t, creds.allows("10.1.2.3"))
+	assert.True(t, creds.allows("::ffff:10.1.2.3"))
+	assert.True(t, creds.allows("2001:db8::1"))
+	assert.False(t, creds.allows("192.168.1.1"))
+
+	moduleCreds := s.getModuleSettings("private").credentials
+	require.NotNil(t, moduleCreds)
+	assert.Equal(t, "private", moduleCreds.Username)
+	assert.True(t, moduleCreds.allows("192.168.1.1"))
+
+	s = New()
+	err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+credentials_file = "`+upstreamCredentials+`"
+`), true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "must be set together")
+}
+
+func TestLoadMaxConnectionsPolicyConfig(t *testing.T) {
+	s := New()
+	configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+on_max_connections = "requeue"
+max_connections_retry_delay = "30s"
+
+[upstreams.u2]
+address = "127.0.0.1:1235"
+modules = ["foo"]
+on_max_connections = "retry"
+max_connections_retries = 5
+
+[upstreams.u3]
+address = "127.0.0.1:1236"
+modules = ["bar"]
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, maxConnectionsPolicy{Action: maxConnectionsRequeue, RetryDelay: 30 * time.Second, Retries: defaultMaxConnectionsRetries}, s.modules["foo"][0].MaxConnections)
+	assert.Equal(t, maxConnectionsPolicy{Action: maxConnectionsRetry, RetryDelay: defaultMaxConnectionsRetryDelay, Retries: 5}, s.modules["foo"][1].MaxConnections)
+	assert.Equal(t, maxConnectionsPolicy{}, s.modules["bar"][0].MaxConnections)
+
+	s = New()
+	err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+on_max_connections = "wait"
+`), true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid on_max_connections")
+}
+
+func TestLoadModuleArgsPolicyConfig(t *testing.T) {
+	s := New()
+	configContent := `
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo", "bar", "baz"]
+
+[modules.foo]
+deny_push = true
+refuse_options = ["delete*", "z"]
+
+[modules.bar]
+read_only = true
+`
+	err := s.ReadConfig(strings.NewReader(configContent), true)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, argsPolicy{DenyPush: true, RefuseOptions: []string{"delete*", "z"}}, s.getModuleSettings("foo").args)
+	assert.Equal(t, argsPolicy{DenyPush: true, ReadOnlyMessage: true}, s.getModuleSettings("bar").args)
+	assert.Equal(t, argsPolicy{}, s.getModuleSettings("baz").args)
+
+	s = New()
+	err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+
+[modules.foo]
+refuse_options = ["delete["]
+`), true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid refuse_options pattern")
+}
+
+func TestLoadProtocolNegotiationConfig(t *testing.T) {
+	s := New()
+	err := s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, protocolNegotiationFixed, s.protocolNegotiation)
+
+	err = s.ReadConfig(strings.NewReader(`
+[proxy]
+protocol_negotiation = "min"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, protocolNegotiationMin, s.protocolNegotiation)
+
+	err = s.ReadConfig(strings.NewReader(`
+[proxy]
+protocol_negotiation = "upstream"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid protocol_negotiation")
+}
+
+func TestLoadPriorityClassesConfig(t *testing.T) {
+	s := New()
+	err := s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+max_active_connections = 10
+
+[[upstreams.u1.priority_classes]]
+name = "mirrors"
+networks = ["192.0.2.0/24", "2001:db8::/32"]
+priority = 10
+reserved_connections = 3
+
+[[upstreams.u1.priority_classes]]
+name = "campus"
+networks = ["198.51.100.0/24"]
+priority = 5
+`), true)
+	require.NoError(t, err, "load config")
+
+	q, ok := s.getQueueForUpstream("u1")
+	require.True(t, ok)
+	assert.Equal(t, 3, q.GetReserved("mirrors"))
+	assert.Zero(t, q.GetReserved("campus"))
+
+	targets, ok := s.getTargetsForModule("foo")
+	require.True(t, ok)
+	require.Len(t, targets[0].PriorityClasses, 2)
+	assert.Equal(t, "campus", targets[0].PriorityClasses[1].Name)
+
+	for name, classes := range map[string]string{
+		"priority class without name": `
+[[upstreams.u1.priority_classes]]
+networks = ["192.0.2.0/24"]
+`,
+		"duplicated priority class a": `
+[[upstreams.u1.priority_classes]]
+name = "a"
+networks = ["192.0.2.0/24"]
+[[upstreams.u1.priority_classes]]
+name = "a"
+networks = ["198.51.100.0/24"]
+`,
+		`invalid network "192.0.2.0"`: `
+[[upstreams.u1.priority_classes]]
+name = "a"
+networks = ["192.0.2.0"]
+`,
+		"exceed max_active_connections": `
+[[upstreams.u1.priority_classes]]
+name = "a"
+networks = ["192.0.2.0/24"]
+reserved_connections = 11
+`,
+	} {
+		err := s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+max_active_connections = 10
+`+classes), false)
+		assert.ErrorContains(t, err, name)
+	}
+}
+
+func TestLoadClientLimitConfig(t *testing.T) {
+	s := New()
+	err := s.ReadConfig(strings.NewReader(`
+[proxy]
+max_connections_per_client = 8
+client_limit_scope = "subnet"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+
+[modules.foo]
+max_connections_per_client = 2
+`), false)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, clientLimit{max: 8, scope: clientKeySubnet}, s.getClientLimit())
+	assert.Equal(t, 2, s.getModuleSettings("foo").maxConnsPerClient)
+
+	err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, clientLimit{scope: clientKeyIP}, s.getClientLimit())
+
+	err = s.ReadConfig(strings.NewReader(`
+[proxy]
+client_limit_scope = "host"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+	assert.ErrorContains(t, err, `invalid client_limit_scope "host"`)
+}
+
+func TestLoadRateLimitConfig(t *testing.T) {
+	s := New()
+	err := s.ReadConfig(strings.NewReader(`
+[proxy]
+connection_rate_limit = 15
+connection_rate_period = "1m"
+unknown_module_rate_limit = 10
+unknown_module_rate_period = "1h"
+ban_duration = "24h"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, rateLimits{
+		conn:          rateLimit{burst: 15, period: time.Minute},
+		unknownModule: rateLimit{burst: 10, period: time.Hour},
+		banDuration:   24 * time.Hour,
+	}, s.getRateLimits())
+
+	for config, msg := range map[string]string{
+		`connection_rate_limit = 15`:                                          "connection_rate_limit requires connection_rate_period",
+		`connection_rate_limit = -1`:                                          "connection_rate_limit must not be negative",
+		`unknown_module_rate_period = "-1m"`:                                  "unknown_module_rate_period must not be negative",
+		`ban_duration = "-1h"`:                                                "ban_duration must not be negative",
+		"unknown_module_rate_limit = 10\nunknown_module_rate_period = \"1h\"": "unknown_module_rate_limit requires ban_duration",
+	} {
+		err = s.ReadConfig(strings.NewReader(`
+[proxy]
+`+config+`
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+		assert.ErrorContains(t, err, msg, config)
+	}
+
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	require.NoError(t, os.WriteFile(banFile, []byte(`[{"ip": "not an ip"}]`), 0o600))
+	err = s.ReadConfig(strings.NewReader(fmt.Sprintf(`
+[proxy]
+ban_file = %q
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`, banFile)), false)
+	assert.ErrorContains(t, err, "load ban_file")
+}
+
+func TestLoadHostsConfig(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("192.0.2.0/24\n"), 0o644))
+
+	s := New()
+	err := s.ReadConfig(strings.NewReader(fmt.Sprintf(`
+[proxy]
+hosts_deny_file = %q
+
+[proxy.listeners.listen_tls]
+hosts_allow = ["10.0.0.0/8"]
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+
+[modules.foo]
+hosts_allow = ["2001:db8::/32"]
+hosts_deny = ["::/0"]
+`, blocklist)), false)
+	require.NoError(t, err, "load config")
+	require.NotNil(t, s.hostsRules)
+	assert.False(t, s.hostsRules.allows(netip.MustParseAddr("192.0.2.1")))
+	assert.Contains(t, s.listenerHostsRules, listenerTLS)
+	assert.NotContains(t, s.listenerHostsRules, listenerPlain)
+	hosts := s.getModuleSettings("foo").hosts
+	assert.True(t, hosts.allows(netip.MustParseAddr("2001:db8::1")))
+	assert.False(t, hosts.allows(netip.MustParseAddr("2001:db9::1")))
+
+	// Blocklist files are reloaded with the config
+	require.NoError(t, os.WriteFile(blocklist, []byte("198.51.100.0/24\n"), 0o644))
+	err = s.ReadConfig(strings.NewReader(fmt.Sprintf(`
+[proxy]
+hosts_deny_file = %q
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`, blocklist)), false)
+	require.NoError(t, err, "load config")
+	assert.True(t, s.hostsRules.allows(netip.MustParseAddr("192.0.2.1")))
+	assert.False(t, s.hostsRules.allows(netip.MustParseAddr("198.51.100.1")))
+	assert.Empty(t, s.listenerHostsRules)
+	assert.Nil(t, s.getModuleSettings("foo").hosts)
+
+	for config, msg := range map[string]string{
+		"[proxy.listeners.listen_udp]\nhosts_allow = [\"10.0.0.0/8\"]": `unknown listener "listen_udp"`,
+		"[proxy]\nhosts_allow = [\"10.0.0.0/33\"]":                     `hosts_allow: invalid network "10.0.0.0/33"`,
+		"[proxy]\nhosts_deny_file = \"/nonexistent\"":                  "hosts_deny: open /nonexistent",
+		"[modules.foo]\nhosts_deny = [\"example.com\"]":                `module=foo: hosts_deny: invalid network "example.com"`,
+	} {
+		err = s.ReadConfig(strings.NewReader(config+`
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+		assert.ErrorContains(t, err, msg, config)
+	}
+}
+
+func TestLoadConnLimitsConfig(t *testing.T) {
+	s := New()
+	err := s.ReadConfig(strings.NewReader(`
+[proxy]
+max_connections = 1000
+max_handshaking_connections = 200
+handshake_timeout = "30s"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+	require.NoError(t, err, "load config")
+	assert.Equal(t, connLimits{maxConns: 1000, maxHandshaking: 200, handshakeTimeout: 30 * time.Second}, s.getConnLimits())
+
+	for config, msg := range map[string]string{
+		`max_connections = -1`:             "max_connections must not be negative",
+		`max_handshaking_connections = -1`: "max_handshaking_connections must not be negative",
+		`handshake_timeout = "-1s"`:        "handshake_timeout must not be negative",
+	} {
+		err = s.ReadConfig(strings.NewReader(`
+[proxy]
+`+config+`
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`), false)
+		assert.ErrorContains(t, err, msg, config)
+	}
+}
+
+func TestLoadModuleQueueConfig(t *testing.T) {
+	s := New()
+	err := s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo", "bar"]
+max_active_connections = 60
+
+[modules.foo]
+max_active_connections = 30
+max_queued_connections = 10
+max_queue_wait = "10m"
+
+[modules.bar]
+read_only = true
+`), false)
+	require.NoError(t, err, "load config")
+	settings := s.getModuleSettings("foo")
+	assert.Equal(t, 30, settings.maxActiveConns)
+	assert.Equal(t, 10, settings.maxQueuedConns)
+	assert.Equal(t, 10*time.Minute, settings.maxQueueWait)
+	q, ok := s.getQueueForModule("foo")
+	require.True(t, ok)
+	assert.Equal(t, 30, q.GetMax())
+	assert.Equal(t, 10, q.GetMaxQueued())
+	_, ok = s.getQueueForModule("bar")
+	assert.False(t, ok, "modules without max_active_connections have no queue")
+
+	// Reloading keeps the queue and its clients
+	err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo", "bar"]
+
+[modules.foo]
+max_active_connections = 20
+`), false)
+	require.NoError(t, err, "reload config")
+	reloaded, ok := s.getQueueForModule("foo")
+	require.True(t, ok)
+	assert.Same(t, q, reloaded)
+	assert.Equal(t, 20, q.GetMax())
+	assert.Equal(t, 0, q.GetMaxQueued())
+
+	for config, msg := range map[string]string{
+		`max_active_connections = -1`: "module=foo: max_active_connections must not be negative",
+		`max_queued_connections = -1`: "module=foo: max_queued_connections must not be negative",
+		`max_queue_wait = "-1s"`:      "module=foo: max_queue_wait must not be negative",
+	} {
+		err = s.ReadConfig(strings.NewReader(`
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+
+[modules.foo]
+`+config+`
+`), false)
+		assert.ErrorContains(t, err, msg, config)
+	}
+}
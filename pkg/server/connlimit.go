@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connLimits holds the limits of client connections of the whole proxy.
+type connLimits struct {
+	// Simultaneous connections, 0 for no limit
+	maxConns int
+	// Simultaneous connections in the handshake phase, 0 for no limit
+	maxHandshaking int
+	// Time allowed for the whole handshake phase, 0 for no limit
+	handshakeTimeout time.Duration
+}
+
+func (s *Server) getConnLimits() connLimits {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.connLimits
+}
+
+// acceptConn counts a connection that admitConn let in, or returns false if it
+// exceeds max_connections or max_handshaking_connections. A connection that
+// is counted must be handed to handleConn, which uncounts it.
+func (s *Server) acceptConn(limits connLimits) bool {
+	if n := s.activeConnCount.Add(1); limits.maxConns > 0 && n > int64(limits.maxConns) {
+		s.activeConnCount.Add(-1)
+		s.maxConnsRejected.Add(1)
+		return false
+	}
+	if n := s.handshakingConnCount.Add(1); limits.maxHandshaking > 0 && n > int64(limits.maxHandshaking) {
+		s.handshakingConnCount.Add(-1)
+		s.activeConnCount.Add(-1)
+		s.maxHandshakingRejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// handshakeGuard accompanies a connection in the handshake phase: it counts
+// towards max_handshaking_connections, and is closed if the phase lasts
+// longer than handshake_timeout.
+type handshakeGuard struct {
+	counter  *atomic.Int64
+	mu       sync.Mutex
+	done     bool
+	timedOut bool
+	timer    *time.Timer
+}
+
+// guardHandshake starts guarding conn, which acceptConn counted.
+func (s *Server) guardHandshake(conn net.Conn, timeout time.Duration) *handshakeGuard {
+	g := &handshakeGuard{counter: &s.handshakingConnCount}
+	if timeout > 0 {
+		g.timer = time.AfterFunc(timeout, func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.done {
+				return
+			}
+			g.timedOut = true
+			s.handshakeTimeouts.Add(1)
+			_ = conn.Close()
+		})
+	}
+	return g
+}
+
+// finish marks the end of the handshake phase. It may be called more than
+// once, and on a nil guard.
+func (g *handshakeGuard) finish() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.done {
+		return
+	}
+	g.done = true
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	g.counter.Add(-1)
+}
+
+// expired reports whether the connection was closed for taking too long to
+// handshake.
+func (g *handshakeGuard) expired() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.timedOut
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// authDigestPreference is the order in which the proxy offers digests when
+// authenticating to an upstream.
+var authDigestPreference = []string{"sha512", "sha256", "sha1", "md5"}
+
+// upstreamCredentials are used to answer an upstream's auth challenge on
+// behalf of clients from Networks.
+type upstreamCredentials struct {
+	Username string
+	Password string
+	Networks []netip.Prefix
+}
+
+func loadUpstreamCredentials(credentialsFile string, networks []string) (*upstreamCredentials, error) {
+	if credentialsFile == "" && len(networks) == 0 {
+		return nil, nil
+	}
+	if credentialsFile == "" || len(networks) == 0 {
+		return nil, fmt.Errorf("credentials file and networks must be set together")
+	}
+	c := &upstreamCredentials{}
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		c.Networks = append(c.Networks, prefix.Masked())
+	}
+	var err error
+	c.Username, c.Password, err = readCredentialsFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// allows reports whether the credentials may be used for a client from ip.
+func (c *upstreamCredentials) allows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(c.Networks, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// greetingForCredentials rewrites the client's greeting so that the upstream
+// picks a digest the proxy supports. Clients older than protocol 30 only
+// support MD4 and cannot be authenticated on behalf of, so ok is false.
+func greetingForCredentials(clientGreeting []byte) (_ []byte, ok bool) {
+	fields := strings.Fields(string(bytes.TrimPrefix(clientGreeting, RsyncdVersionPrefix)))
+	if len(fields) == 0 {
+		return nil, false
+	}
+	major, _, _ := strings.Cut(fields[0], ".")
+	protocol, err := strconv.Atoi(major)
+	if err != nil || protocol < 30 {
+		return nil, false
+	}
+	return fmt.Appendf(nil, "%s %s %s\n", RsyncdVersionPrefix, fields[0], strings.Join(authDigestPreference, " ")), true
+}
+
+// authDigestForUpstream returns the digest the upstream will pick for our
+// rewritten greeting, which is the first in our preference that it supports.
+func authDigestForUpstream(upstreamGreeting []byte) (string, error) {
+	fields := strings.Fields(string(bytes.TrimPrefix(upstreamGreeting, RsyncdVersionPrefix)))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("missing protocol version")
+	}
+	if len(fields) == 1 {
+		major, _, _ := strings.Cut(fields[0], ".")
+		if protocol, err := strconv.Atoi(major); err != nil || protocol < 30 {
+			return "", fmt.Errorf("md4 authentication of protocol %s upstreams is not supported", fields[0])
+		}
+		return "md5", nil
+	}
+	for _, name := range authDigestPreference {
+		if slices.Contains(fields[1:], name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no supported digest in %s", strings.Join(fields[1:], " "))
+}
+
+// answerUpstreamChallenge answers the upstream's auth challenge with creds.
+func (s *Server) answerUpstreamChallenge(upConn net.Conn, creds *upstreamCredentials, upstreamGreeting []byte, challenge string) error {
+	digest, err := authDigestForUpstream(upstreamGreeting)
+	if err != nil {
+		return err
+	}
+	response := authResponse(digest, creds.Password, challenge)
+	if _, err := writeWithTimeout(upConn, []byte(creds.Username+" "+response+"\n"), s.WriteTimeout); err != nil {
+		return fmt.Errorf("send auth response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	upstreamProxySOCKS5 = "socks5"
+	upstreamProxyHTTP   = "http"
+)
+
+// upstreamResolveTimeout bounds the lookup of an upstream reached through a
+// jump proxy, which is not needed to relay the connection.
+const upstreamResolveTimeout = 5 * time.Second
+
+// upstreamProxy is a jump proxy that upstream connections are dialed
+// through, configured with the "via" option of an upstream.
+type upstreamProxy struct {
+	Scheme   string
+	Addr     string
+	Username string
+	Password string
+}
+
+func (p *upstreamProxy) String() string {
+	return p.Scheme + "://" + p.Addr
+}
+
+func parseUpstreamProxy(via, credentialsFile string) (*upstreamProxy, error) {
+	u, err := url.Parse(via)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case upstreamProxySOCKS5, "socks5h":
+		u.Scheme = upstreamProxySOCKS5
+	case upstreamProxyHTTP:
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expecting socks5 or http", u.Scheme)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("credentials must be put into via_credentials_file instead of the url")
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("missing port in %q", via)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("unexpected path or query in %q", via)
+	}
+	p := &upstreamProxy{Scheme: u.Scheme, Addr: u.Host}
+	if credentialsFile != "" {
+		p.Username, p.Password, err = readCredentialsFile(credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// dialUpstream connects to the target, going through its jump proxy if one
+// is configured.
+func (s *Server) dialUpstream(ctx context.Context, target Target) (net.Conn, error) {
+	addr := addDefaultTCPPort(target.Addr, defaultRsyncPortString)
+	if target.Via == nil {
+		return dialContextTCPOrUnix(ctx, s.dialer, addr)
+	}
+
+	via := target.Via
+	conn, err := s.dialer.DialContext(ctx, "tcp", via.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %s: %w", via, err)
+	}
+	deadline, ok := ctx.Deadline()
+	if s.ReadTimeout > 0 && (!ok || time.Until(deadline) > s.ReadTimeout) {
+		deadline = time.Now().Add(s.ReadTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+
+	switch via.Scheme {
+	case upstreamProxySOCKS5:
+		err = socks5Connect(conn, addr, via.Username, via.Password)
+	case upstreamProxyHTTP:
+		conn, err = httpProxyConnect(conn, addr, via.Username, via.Password)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", via.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("connect to %s via %s: %w", addr, via, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// resolveUpstreamAddr resolves the address of a target reached through a jump
+// proxy, whose connections only tell the proxy's address.
+func (s *Server) resolveUpstreamAddr(ctx context.Context, target Target) (net.Addr, error) {
+	host, port, err := net.SplitHostPort(addDefaultTCPPort(target.Addr, defaultRsyncPortString))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, upstreamResolveTimeout)
+	defer cancel()
+	resolver := s.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	portNum, err := resolver.LookupPort(ctx, "tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ips[0].Unmap(), uint16(portNum))), nil
+}
+
+// socks5Connect performs a SOCKS5 CONNECT handshake (RFC 1928), with
+// username/password authentication (RFC 1929) if username is set.
+func socks5Connect(conn net.Conn, addr, username, password string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{0x00}
+	if username != "" {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("read method selection: %w", err)
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("unexpected socks version %d", reply[0])
+	}
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if username == "" {
+			return fmt.Errorf("proxy requires authentication")
+		}
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("username or password too long")
+		}
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return fmt.Errorf("read authentication reply: %w", err)
+		}
+		if reply[0] != 0x01 {
+			return fmt.Errorf("unexpected authentication version %d", reply[0])
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("authentication failed")
+		}
+	default:
+		return fmt.Errorf("no acceptable authentication method")
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return fmt.Errorf("read connect reply: %w", err)
+	}
+	if header[0] != 0x05 {
+		return fmt.Errorf("unexpected reply version %d", header[0])
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("connect failed with reply code %d", header[1])
+	}
+	var skip int
+	switch header[3] {
+	case 0x01:
+		skip = net.IPv4len + 2
+	case 0x04:
+		skip = net.IPv6len + 2
+	case 0x03:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return fmt.Errorf("read connect reply: %w", err)
+		}
+		skip = int(l[0]) + 2
+	default:
+		return fmt.Errorf("unknown address type %d in connect reply", header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip)); err != nil {
+		return fmt.Errorf("read connect reply: %w", err)
+	}
+	return nil
+}
+
+// httpProxyConnect opens a tunnel with an HTTP CONNECT request. The returned
+// connection must be used instead of conn since the proxy may have sent data
+// right after its response headers.
+func httpProxyConnect(conn net.Conn, addr, username, password string) (net.Conn, error) {
+	var req strings.Builder
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if username != "" {
+		token := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		fmt.Fprintf(&req, "Proxy-Authorization: Basic %s\r\n", token)
+	}
+	req.WriteString("\r\n")
+	if _, err := io.WriteString(conn, req.String()); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(conn, maxHTTPConnectLineSize)
+	status, err := readHTTPConnectLine(br)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/") {
+		return nil, fmt.Errorf("malformed response: %q", status)
+	}
+	if fields[1] != "200" {
+		return nil, fmt.Errorf("proxy responded %q", status)
+	}
+	for i := 0; ; i++ {
+		if i == maxHTTPConnectHeaderLines {
+			return nil, fmt.Errorf("too many response headers")
+		}
+		header, err := readHTTPConnectLine(br)
+		if err != nil {
+			return nil, fmt.Errorf("read response headers: %w", err)
+		}
+		if header == "" {
+			break
+		}
+	}
+	return withBufferedData(conn, br), nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// earlyInputPrefix starts the line sent before the module name by rsync 3.2+
+// clients using --early-input, which is followed by the announced number of
+// bytes of payload.
+var earlyInputPrefix = []byte("#early_input=")
+
+// maxEarlyInputSize is the limit of rsyncd (BIGPATHBUFLEN).
+const maxEarlyInputSize = 5120
+
+var errInvalidEarlyInput = errors.New("invalid early_input length")
+
+// earlyInputSize returns the size of the payload announced by an
+// "#early_input=N" line.
+func earlyInputSize(line []byte) (int, error) {
+	size, err := strconv.Atoi(string(bytes.TrimSpace(line[len(earlyInputPrefix):])))
+	if err != nil || size <= 0 || size > maxEarlyInputSize {
+		return 0, errInvalidEarlyInput
+	}
+	return size, nil
+}
+
+// readEarlyInput reads the payload announced by the "#early_input=N" line.
+func readEarlyInput(conn *handshakeConn, line []byte, timeout time.Duration) ([]byte, error) {
+	size, err := earlyInputSize(line)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, size)
+	if err := conn.readFull(payload, timeout); err != nil {
+		return nil, fmt.Errorf("read payload: %w", err)
+	}
+	return payload, nil
+}
+
+// earlyInputMessage builds what the client sent for its early input, to be
+// replayed to the upstream.
+func earlyInputMessage(payload []byte) []byte {
+	b := fmt.Appendf(nil, "%s%d\n", earlyInputPrefix, len(payload))
+	return append(b, payload...)
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Modes of negotiating the protocol version with clients, set by
+// protocol_negotiation.
+const (
+	// Always advertise RsyncdServerVersion
+	protocolNegotiationFixed = "fixed"
+	// Advertise the minimum of RsyncdServerVersion and the greetings of the
+	// upstreams, so that clients never speak a newer protocol than the
+	// upstream serving them
+	protocolNegotiationMin = "min"
+)
+
+// rsyncdGreeting is a parsed "@RSYNCD: <version> [digests]" line.
+type rsyncdGreeting struct {
+	Raw      []byte
+	Version  string
+	Protocol int
+	// Digests for daemon authentication, nil if the greeting has no list
+	Digests []string
+}
+
+func parseRsyncdGreeting(line []byte) (rsyncdGreeting, error) {
+	if !bytes.HasPrefix(line, RsyncdVersionPrefix) {
+		return rsyncdGreeting{}, fmt.Errorf("not a greeting: %q", line)
+	}
+	fields := strings.Fields(string(line[len(RsyncdVersionPrefix):]))
+	if len(fields) == 0 {
+		return rsyncdGreeting{}, fmt.Errorf("missing protocol version")
+	}
+	major, _, _ := strings.Cut(fields[0], ".")
+	protocol, err := strconv.Atoi(major)
+	if err != nil {
+		return rsyncdGreeting{}, fmt.Errorf("invalid protocol version %q", fields[0])
+	}
+	g := rsyncdGreeting{
+		Raw:      bytes.Clone(line),
+		Version:  fields[0],
+		Protocol: protocol,
+	}
+	if len(fields) > 1 {
+		g.Digests = fields[1:]
+	}
+	return g, nil
+}
+
+// authDigests returns the digests the greeting allows for daemon
+// authentication. Without a list, rsync uses MD5 since protocol 30 and MD4
+// before.
+func (g rsyncdGreeting) authDigests() []string {
+	switch {
+	case g.Digests != nil:
+		return g.Digests
+	case g.Protocol >= 30:
+		return []string{"md5"}
+	default:
+		return []string{"md4"}
+	}
+}
+
+func formatRsyncdGreeting(version string, digests []string) []byte {
+	b := fmt.Appendf(nil, "%s %s", RsyncdVersionPrefix, version)
+	for _, digest := range digests {
+		b = append(b, ' ')
+		b = append(b, digest...)
+	}
+	return append(b, lineFeed)
+}
+
+// greetingForUpstream returns the greeting to send to upstreams on behalf of a
+// client that was advertised the given greeting: the client's, with the
+// protocol version lowered to the advertised one if needed.
+func greetingForUpstream(client, advertised rsyncdGreeting) []byte {
+	if client.Protocol <= advertised.Protocol {
+		return client.Raw
+	}
+	return formatRsyncdGreeting(advertised.Version, client.Digests)
+}
+
+// minGreeting returns the greeting to advertise to clients so that they agree
+// with every upstream in upstreams: the oldest protocol version, and the
+// digests supported by all of them. If every upstream sent the same greeting
+// that is not newer than ours, it is returned verbatim.
+func minGreeting(ours rsyncdGreeting, upstreams []rsyncdGreeting) []byte {
+	if len(upstreams) == 0 {
+		return ours.Raw
+	}
+	same := slices.IndexFunc(upstreams, func(g rsyncdGreeting) bool {
+		return !bytes.Equal(g.Raw, upstreams[0].Raw)
+	}) < 0
+	if same && upstreams[0].Protocol <= ours.Protocol {
+		return upstreams[0].Raw
+	}
+
+	oldest := ours
+	digests := ours.authDigests()
+	for _, g := range upstreams {
+		if g.Protocol < oldest.Protocol {
+			oldest = g
+		}
+		supported := g.authDigests()
+		digests = slices.DeleteFunc(slices.Clone(digests), func(name string) bool {
+			return !slices.Contains(supported, name)
+		})
+	}
+	if len(digests) == 0 {
+		// Without a list, clients fall back to MD5 or MD4
+		digests = nil
+	}
+	return formatRsyncdGreeting(oldest.Version, digests)
+}
+
+// recordUpstreamGreeting remembers the greeting of an upstream for
+// negotiating the protocol version with later clients.
+func (s *Server) recordUpstreamGreeting(upstream string, greeting rsyncdGreeting) {
+	s.upstreamGreetings.Store(upstream, greeting)
+}
+
+func (s *Server) getProtocolNegotiation() string {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.protocolNegotiation
+}
+
+// advertisedGreeting returns the greeting sent to clients before they tell
+// which module they want.
+func (s *Server) advertisedGreeting() []byte {
+	s.reloadLock.RLock()
+	mode := s.protocolNegotiation
+	upstreams := s.upstreams
+	s.reloadLock.RUnlock()
+	if mode != protocolNegotiationMin {
+		return RsyncdServerVersion
+	}
+	ours, _ := parseRsyncdGreeting(RsyncdServerVersion)
+	var known []rsyncdGreeting
+	for _, upstream := range upstreams {
+		if v, ok := s.upstreamGreetings.Load(upstream.Name); ok {
+			known = append(known, v.(rsyncdGreeting))
+		}
+	}
+	return minGreeting(ours, known)
+}
+
+// probeUpstreamGreetings learns the greetings of upstreams not contacted yet,
+// so that the first clients are not advertised a newer protocol than theirs.
+func (s *Server) probeUpstreamGreetings(ctx context.Context, upstreams []upstreamConfig) {
+	for _, upstream := range upstreams {
+		if ctx.Err() != nil {
+			return
+		}
+		if _, ok := s.upstreamGreetings.Load(upstream.Name); ok {
+			continue
+		}
+		if err := s.probeUpstreamGreeting(ctx, upstream.Target); err != nil {
+			s.errorLog.F("[WARN] probe greeting of upstream %s (%s): %v", upstream.Name, upstream.Target.Addr, err)
+		}
+	}
+}
+
+func (s *Server) probeUpstreamGreeting(ctx context.Context, target Target) error {
+	if s.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ReadTimeout)
+		defer cancel()
+	}
+	conn, err := s.dialUpstream(ctx, target)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	// Give up waiting for the upstream once the probe is cancelled
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if target.UseProxyProtocol {
+		err := writeProxyProtocolHeader(conn, conn.LocalAddr(), conn.RemoteAddr(), s.WriteTimeout)
+		if err != nil {
+			return fmt.Errorf("send proxy protocol header: %w", err)
+		}
+	}
+	if _, err := writeWithTimeout(conn, RsyncdServerVersion, s.WriteTimeout); err != nil {
+		return fmt.Errorf("send version: %w", err)
+	}
+	line, err := newHandshakeConn(conn).readLine(s.ReadTimeout)
+	if err != nil {
+		return fmt.Errorf("read version: %w", err)
+	}
+	greeting, err := parseRsyncdGreeting(line)
+	if err != nil {
+		return err
+	}
+	s.recordUpstreamGreeting(target.Upstream, greeting)
+	return nil
+}
+
+// maxClientProtocolLabel bounds the protocol versions exported as metric
+// labels, since clients may send any number.
+const maxClientProtocolLabel = 99
+
+func clientProtocolLabel(protocol int) string {
+	if protocol < 0 || protocol > maxClientProtocolLabel {
+		return "other"
+	}
+	return strconv.Itoa(protocol)
+}
+
+// getClientProtocolCounter returns the counter of connections from clients
+// speaking the given protocol version, creating it lazily.
+func (s *Server) getClientProtocolCounter(protocol int) *atomic.Uint64 {
+	key := clientProtocolLabel(protocol)
+	if v, ok := s.clientProtocolCounters.Load(key); ok {
+		return v.(*atomic.Uint64)
+	}
+	v, _ := s.clientProtocolCounters.LoadOrStore(key, &atomic.Uint64{})
+	return v.(*atomic.Uint64)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// maxHandshakeLineSize limits the lines of the rsync handshake: greetings,
+// module names and auth responses. Longer lines are a protocol error rather
+// than being cut.
+const maxHandshakeLineSize = 4096
+
+var errHandshakeLineTooLong = errors.New("handshake line too long")
+
+// handshakeConn reads the lines of the rsync handshake from a connection.
+// Data read ahead is kept, so the connection can be read from after the
+// handshake without losing any bytes.
+type handshakeConn struct {
+	bufferedConn
+	br *bufio.Reader
+}
+
+func newHandshakeConn(conn net.Conn) *handshakeConn {
+	br := bufio.NewReaderSize(conn, maxHandshakeLineSize)
+	return &handshakeConn{
+		bufferedConn: bufferedConn{Conn: conn, reader: br},
+		br:           br,
+	}
+}
+
+// readLine reads a line including the trailing newline. A line cut by EOF is
+// returned together with the error. The line is only valid until the next
+// read.
+func (c *handshakeConn) readLine(timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	line, err := c.br.ReadSlice(lineFeed)
+	if err == bufio.ErrBufferFull {
+		return nil, errHandshakeLineTooLong
+	}
+	return line, err
+}
+
+// readFull reads exactly len(p) bytes.
+func (c *handshakeConn) readFull(p []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+	}
+	_, err := io.ReadFull(c.br, p)
+	return err
+}
+
+// watchClose watches for the client closing the connection while nothing is
+// expected from it, without consuming any data. closed is closed if the
+// connection fails. Data sent meanwhile is kept for later reads, but a
+// client that fills the buffer with maxHandshakeLineSize bytes while it
+// waits breaks the protocol and is reported closed too. stop ends the watch
+// and must be called before reading from the connection.
+func (c *handshakeConn) watchClose() (closed <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	var stopping atomic.Bool
+	_ = c.SetReadDeadline(time.Time{})
+	go func() {
+		defer close(done)
+		for n := c.br.Buffered() + 1; n <= c.br.Size(); n = c.br.Buffered() + 1 {
+			if _, err := c.br.Peek(n); err != nil {
+				break
+			}
+		}
+		if !stopping.Load() {
+			close(ch)
+		}
+	}()
+	return ch, func() {
+		stopping.Store(true)
+		// Wake up Peek, the connection stays usable after a timeout
+		_ = c.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = c.SetReadDeadline(time.Time{})
+	}
+}
+
+// rejectHandshake tells the client about a handshake line that is too long,
+// with the error rsyncd sends for malformed handshakes.
+func (s *Server) rejectHandshake(conn net.Conn, err error) {
+	if errors.Is(err, errHandshakeLineTooLong) {
+		_, _ = writeWithTimeout(conn, []byte("@ERROR: protocol startup error\n"), s.WriteTimeout)
+	}
+}
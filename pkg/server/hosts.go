@@ -0,0 +1,195 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ustclug/rsync-proxy/pkg/prefixset"
+)
+
+// listenerNames maps the names of [proxy.listeners.<name>] tables, after
+// the listen options, to the listeners.
+var listenerNames = map[string]listenerKind{
+	"listen":              listenerPlain,
+	"listen_tls":          listenerTLS,
+	"listen_http_connect": listenerHTTPConnect,
+}
+
+// hostsScope tells which hosts rules denied a client.
+type hostsScope int
+
+const (
+	hostsScopeGlobal hostsScope = iota
+	hostsScopeListener
+	hostsScopeModule
+
+	numHostsScopes
+)
+
+var hostsScopeNames = [numHostsScopes]string{
+	hostsScopeGlobal:   "global",
+	hostsScopeListener: "listener",
+	hostsScopeModule:   "module",
+}
+
+// hostsRules decides which clients may connect like rsyncd does with
+// "hosts allow" and "hosts deny": clients matching hosts allow are allowed,
+// otherwise those matching hosts deny are denied, and the rest are denied
+// only if hosts allow is set without hosts deny.
+type hostsRules struct {
+	// nil if not set
+	allow, deny *prefixset.Set
+}
+
+// loadHostsRules returns the rules of acl, or nil if it has none.
+func loadHostsRules(acl HostsACL) (*hostsRules, error) {
+	allow, err := loadHostsList(acl.HostsAllow, acl.HostsAllowFile)
+	if err != nil {
+		return nil, fmt.Errorf("hosts_allow: %w", err)
+	}
+	deny, err := loadHostsList(acl.HostsDeny, acl.HostsDenyFile)
+	if err != nil {
+		return nil, fmt.Errorf("hosts_deny: %w", err)
+	}
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+	return &hostsRules{allow: allow, deny: deny}, nil
+}
+
+// loadHostsList returns the set of the given networks and those listed in
+// file, or nil if there is none, which rsyncd treats as not set.
+func loadHostsList(networks []string, file string) (*prefixset.Set, error) {
+	var set prefixset.Set
+	n := 0
+	for _, network := range networks {
+		prefix, err := parseHostsNetwork(network)
+		if err != nil {
+			return nil, err
+		}
+		set.Add(prefix)
+		n++
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			prefix, err := parseHostsNetwork(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+			}
+			set.Add(prefix)
+			n++
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("read %s: %w", file, err)
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return &set, nil
+}
+
+// parseHostsNetwork parses a network in CIDR notation, or a single address.
+func parseHostsNetwork(network string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(network); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q", network)
+	}
+	return prefix, nil
+}
+
+// allows reports whether the client at addr may connect. nil rules allow
+// every client.
+func (r *hostsRules) allows(addr netip.Addr) bool {
+	if r == nil {
+		return true
+	}
+	if r.allow != nil {
+		if r.allow.Contains(addr) {
+			return true
+		}
+		if r.deny == nil {
+			return false
+		}
+	}
+	return r.deny == nil || !r.deny.Contains(addr)
+}
+
+// loadListenerHostsRules returns the rules of the [proxy.listeners.<name>]
+// tables by listener.
+func loadListenerHostsRules(listeners map[string]HostsACL) (map[listenerKind]*hostsRules, error) {
+	names := make([]string, 0, len(listeners))
+	for name := range listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rules := make(map[listenerKind]*hostsRules, len(listeners))
+	for _, name := range names {
+		kind, ok := listenerNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown listener %q in proxy.listeners, expecting listen, listen_tls or listen_http_connect", name)
+		}
+		r, err := loadHostsRules(listeners[name])
+		if err != nil {
+			return nil, fmt.Errorf("listener=%s: %w", name, err)
+		}
+		rules[kind] = r
+	}
+	return rules, nil
+}
+
+// checkHostsAccess tells whether the hosts rules let the client at ip, which
+// connected to the listener of kind, request moduleName, or list the modules
+// if it is empty. Otherwise it rejects the client.
+func (s *Server) checkHostsAccess(conn net.Conn, ip string, kind listenerKind, moduleName string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		// Not an IP address, e.g. a Unix socket
+		return true
+	}
+	s.reloadLock.RLock()
+	global, listener := s.hostsRules, s.listenerHostsRules[kind]
+	s.reloadLock.RUnlock()
+
+	var scope hostsScope
+	switch {
+	case !global.allows(addr):
+		scope = hostsScopeGlobal
+	case !listener.allows(addr):
+		scope = hostsScopeListener
+	case moduleName != "" && !s.getModuleSettings(moduleName).hosts.allows(addr):
+		scope = hostsScopeModule
+	default:
+		return true
+	}
+	s.hostsDenied[scope].Add(1)
+	var msg string
+	if moduleName == "" {
+		s.accessLog.F("client %s is denied listing modules by %s hosts rules", ip, hostsScopeNames[scope])
+		msg = fmt.Sprintf("@ERROR: access denied from %s\n", ip)
+	} else {
+		s.accessLog.F("client %s is denied access to module %s by %s hosts rules", ip, moduleName, hostsScopeNames[scope])
+		msg = fmt.Sprintf("@ERROR: access denied to %s from %s\n", moduleName, ip)
+	}
+	_, _ = writeWithTimeout(conn, []byte(msg), s.WriteTimeout)
+	return false
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// Limits for the HTTP CONNECT preamble sent by rsync clients using
+	// RSYNC_PROXY. rsync only sends the request line and an optional
+	// Proxy-Authorization header.
+	maxHTTPConnectLineSize    = 4096
+	maxHTTPConnectHeaderLines = 32
+)
+
+var (
+	httpConnectEstablished = []byte("HTTP/1.0 200 Connection established\r\n\r\n")
+	httpConnectBadRequest  = []byte("HTTP/1.0 400 Bad Request\r\n\r\n")
+	httpConnectForbidden   = []byte("HTTP/1.0 403 Forbidden\r\n\r\n")
+	httpConnectNotAllowed  = []byte("HTTP/1.0 405 Method Not Allowed\r\n\r\n")
+)
+
+// bufferedConn is a net.Conn whose reads are served from reader, which holds
+// bytes already consumed from the underlying connection followed by the
+// connection itself.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseRead() error {
+	if closeReader, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return closeReader.CloseRead()
+	}
+	return nil
+}
+
+// withBufferedData returns conn with the data left in br put back in front of
+// it, so that no bytes read ahead by br are lost.
+func withBufferedData(conn net.Conn, br *bufio.Reader) net.Conn {
+	n := br.Buffered()
+	if n == 0 {
+		return conn
+	}
+	buffered, _ := br.Peek(n)
+	return &bufferedConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(bytes.Clone(buffered)), conn),
+	}
+}
+
+// normalizeHTTPConnectTarget converts an allowed host entry or a CONNECT
+// target to lower-case host:port, using the rsync port if it is missing.
+func normalizeHTTPConnectTarget(target string) (string, error) {
+	if strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]") {
+		// Bracketed IPv6 address without port
+		target = net.JoinHostPort(target[1:len(target)-1], defaultRsyncPortString)
+	}
+	host, port, err := net.SplitHostPort(addDefaultTCPPort(target, defaultRsyncPortString))
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		return "", fmt.Errorf("missing host in %q", target)
+	}
+	return net.JoinHostPort(strings.ToLower(host), port), nil
+}
+
+func readHTTPConnectLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadSlice(lineFeed)
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return "", fmt.Errorf("line too long")
+		}
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// acceptHTTPConnect reads an HTTP CONNECT request from conn and answers it.
+// If the requested target is allowed, it returns the connection to continue
+// the rsync handshake on and ok is true. Otherwise the client has already
+// been sent an error response.
+func (s *Server) acceptHTTPConnect(conn net.Conn, ip string) (_ net.Conn, ok bool, err error) {
+	s.reloadLock.RLock()
+	allowedHosts := s.httpConnectAllowedHosts
+	s.reloadLock.RUnlock()
+
+	if s.ReadTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
+	br := bufio.NewReaderSize(conn, maxHTTPConnectLineSize)
+	requestLine, err := readHTTPConnectLine(br)
+	if err != nil {
+		return nil, false, fmt.Errorf("read http connect request: %w", err)
+	}
+	for i := 0; ; i++ {
+		if i == maxHTTPConnectHeaderLines {
+			_, _ = writeWithTimeout(conn, httpConnectBadRequest, s.WriteTimeout)
+			return nil, false, fmt.Errorf("too many http connect headers")
+		}
+		header, err := readHTTPConnectLine(br)
+		if err != nil {
+			return nil, false, fmt.Errorf("read http connect headers: %w", err)
+		}
+		if header == "" {
+			break
+		}
+	}
+
+	fields := strings.Fields(requestLine)
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/1.") {
+		_, _ = writeWithTimeout(conn, httpConnectBadRequest, s.WriteTimeout)
+		return nil, false, fmt.Errorf("malformed http connect request: %q", requestLine)
+	}
+	if fields[0] != "CONNECT" {
+		_, _ = writeWithTimeout(conn, httpConnectNotAllowed, s.WriteTimeout)
+		return nil, false, fmt.Errorf("unexpected http method: %q", fields[0])
+	}
+	target, err := normalizeHTTPConnectTarget(fields[1])
+	if err != nil {
+		_, _ = writeWithTimeout(conn, httpConnectBadRequest, s.WriteTimeout)
+		return nil, false, fmt.Errorf("malformed http connect target %q: %w", fields[1], err)
+	}
+	if !slices.Contains(allowedHosts, target) {
+		s.accessLog.F("client %s HTTP CONNECT to disallowed target %s", ip, target)
+		_, _ = writeWithTimeout(conn, httpConnectForbidden, s.WriteTimeout)
+		return nil, false, nil
+	}
+
+	if _, err := writeWithTimeout(conn, httpConnectEstablished, s.WriteTimeout); err != nil {
+		return nil, false, fmt.Errorf("send http connect response: %w", err)
+	}
+	s.accessLog.F("client %s HTTP CONNECT to %s", ip, target)
+	return withBufferedData(conn, br), true, nil
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ustclug/rsync-proxy/pkg/queue"
@@ -48,7 +49,16 @@ func (s *Server) writePrometheusMetrics(w io.Writer, now time.Time) {
 	for k, v := range s.upstreamQueues {
 		queues[k] = v
 	}
+	moduleQueues := make(map[string]*queue.Queue, len(s.moduleQueues))
+	for k, v := range s.moduleQueues {
+		moduleQueues[k] = v
+	}
 	s.reloadLock.RUnlock()
+	moduleQueueNames := make([]string, 0, len(moduleQueues))
+	for name := range moduleQueues {
+		moduleQueueNames = append(moduleQueueNames, name)
+	}
+	sort.Strings(moduleQueueNames)
 
 	sort.Slice(upstreams, func(i, j int) bool {
 		return upstreams[i].Name < upstreams[j].Name
@@ -89,6 +99,14 @@ func (s *Server) writePrometheusMetrics(w io.Writer, now time.Time) {
 			prometheusEscapeLabelValue(u.Name), c.queueFull.Load())
 	}
 
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_queue_wait_timeouts_total Total connections removed from the queue after max_queue_wait per upstream.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_queue_wait_timeouts_total counter")
+	for _, u := range upstreams {
+		c := s.getUpstreamCounters(u.Name)
+		_, _ = fmt.Fprintf(w, "rsync_proxy_queue_wait_timeouts_total{upstream=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(u.Name), c.queueTimeout.Load())
+	}
+
 	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_upstream_dial_errors_total Total upstream dial failures per upstream.")
 	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_upstream_dial_errors_total counter")
 	for _, u := range upstreams {
@@ -97,14 +115,208 @@ func (s *Server) writePrometheusMetrics(w io.Writer, now time.Time) {
 			prometheusEscapeLabelValue(u.Name), c.dialError.Load())
 	}
 
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_module_active_connections Current connections holding a slot of the module queue per module.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_module_active_connections gauge")
+	for _, name := range moduleQueueNames {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_module_active_connections{module=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(name), moduleQueues[name].ActiveLen())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_module_queued_connections Current queued rsync proxy connections per module.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_module_queued_connections gauge")
+	for _, name := range moduleQueueNames {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_module_queued_connections{module=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(name), moduleQueues[name].QueuedLen())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_module_queue_active_max Configured max active connections per module.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_module_queue_active_max gauge")
+	for _, name := range moduleQueueNames {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_module_queue_active_max{module=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(name), moduleQueues[name].GetMax())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_module_queue_queued_max Configured max queued connections per module.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_module_queue_queued_max gauge")
+	for _, name := range moduleQueueNames {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_module_queue_queued_max{module=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(name), moduleQueues[name].GetMaxQueued())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_module_queue_full_rejected_total Total connections rejected due to queue full per module.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_module_queue_full_rejected_total counter")
+	for _, name := range moduleQueueNames {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_module_queue_full_rejected_total{module=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(name), s.getModuleQueueCounters(name).queueFull.Load())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_module_queue_wait_timeouts_total Total connections removed from the queue after max_queue_wait per module.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_module_queue_wait_timeouts_total counter")
+	for _, name := range moduleQueueNames {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_module_queue_wait_timeouts_total{module=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(name), s.getModuleQueueCounters(name).queueTimeout.Load())
+	}
+
+	type moduleResponseStat struct {
+		key   moduleResponseKey
+		count uint64
+	}
+	var moduleResponseStats []moduleResponseStat
+	s.moduleResponseCounters.Range(func(k, v any) bool {
+		moduleResponseStats = append(moduleResponseStats, moduleResponseStat{key: k.(moduleResponseKey), count: v.(*atomic.Uint64).Load()})
+		return true
+	})
+	sort.Slice(moduleResponseStats, func(i, j int) bool {
+		if moduleResponseStats[i].key.upstream != moduleResponseStats[j].key.upstream {
+			return moduleResponseStats[i].key.upstream < moduleResponseStats[j].key.upstream
+		}
+		return moduleResponseStats[i].key.reason < moduleResponseStats[j].key.reason
+	})
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_upstream_module_responses_total Total replies of upstreams to module requests by outcome.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_upstream_module_responses_total counter")
+	for _, r := range moduleResponseStats {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_upstream_module_responses_total{upstream=\"%s\",reason=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(r.key.upstream),
+			prometheusEscapeLabelValue(r.key.reason),
+			r.count)
+	}
+
+	type clientProtocolStat struct {
+		protocol string
+		count    uint64
+	}
+	var clientProtocolStats []clientProtocolStat
+	s.clientProtocolCounters.Range(func(k, v any) bool {
+		clientProtocolStats = append(clientProtocolStats, clientProtocolStat{protocol: k.(string), count: v.(*atomic.Uint64).Load()})
+		return true
+	})
+	sort.Slice(clientProtocolStats, func(i, j int) bool {
+		return clientProtocolStats[i].protocol < clientProtocolStats[j].protocol
+	})
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_client_protocol_connections_total Total connections by protocol version of the client.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_client_protocol_connections_total counter")
+	for _, c := range clientProtocolStats {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_client_protocol_connections_total{protocol=\"%s\"} %d\n", c.protocol, c.count)
+	}
+
 	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_unknown_module_requests_total Total requests for unknown modules.")
 	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_unknown_module_requests_total counter")
 	_, _ = fmt.Fprintf(w, "rsync_proxy_unknown_module_requests_total %d\n", s.unknownModuleCount.Load())
 
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_client_connection_limit_rejected_total Total connections rejected for exceeding max_connections_per_client.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_client_connection_limit_rejected_total counter")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_client_connection_limit_rejected_total %d\n", s.clientLimitRejected.Load())
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_accept_errors_total Total temporary errors accepting connections, e.g. running out of file descriptors.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_accept_errors_total counter")
+	listeners := make([]string, 0, len(listenerNames))
+	for name := range listenerNames {
+		listeners = append(listeners, name)
+	}
+	sort.Strings(listeners)
+	for _, name := range listeners {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_accept_errors_total{listener=\"%s\"} %d\n", name, s.acceptErrors[listenerNames[name]].Load())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_handshaking_connections Number of connections in the handshake phase.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_handshaking_connections gauge")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_handshaking_connections %d\n", s.handshakingConnCount.Load())
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_connection_limit_rejected_total Total connections closed on accept for exceeding a limit of the proxy.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_connection_limit_rejected_total counter")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_connection_limit_rejected_total{limit=\"max_connections\"} %d\n", s.maxConnsRejected.Load())
+	_, _ = fmt.Fprintf(w, "rsync_proxy_connection_limit_rejected_total{limit=\"max_handshaking_connections\"} %d\n", s.maxHandshakingRejected.Load())
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_handshake_timeouts_total Total connections closed for exceeding handshake_timeout.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_handshake_timeouts_total counter")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_handshake_timeouts_total %d\n", s.handshakeTimeouts.Load())
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_hosts_denied_total Total requests denied by hosts_allow and hosts_deny, by where they are set.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_hosts_denied_total counter")
+	for scope, name := range hostsScopeNames {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_hosts_denied_total{scope=\"%s\"} %d\n", name, s.hostsDenied[scope].Load())
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_rate_limited_total Total events of clients exceeding a rate limit.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_rate_limited_total counter")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_rate_limited_total{limit=\"connection\"} %d\n", s.connRateLimited.Load())
+	_, _ = fmt.Fprintf(w, "rsync_proxy_rate_limited_total{limit=\"unknown_module\"} %d\n", s.unknownModuleRateLimited.Load())
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_client_bans_total Total clients banned for exceeding a rate limit.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_client_bans_total counter")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_client_bans_total %d\n", s.clientBans.Load())
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_banned_clients Number of client addresses banned now.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_banned_clients gauge")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_banned_clients %d\n", len(s.bans.list(now)))
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_banned_connections_total Total connections from banned clients closed on accept.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_banned_connections_total counter")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_banned_connections_total %d\n", s.bannedConns.Load())
+
+	type tlsStat struct {
+		key   tlsCounterKey
+		count uint64
+	}
+	var tlsStats []tlsStat
+	s.tlsHandshakeCounters.Range(func(k, v any) bool {
+		tlsStats = append(tlsStats, tlsStat{key: k.(tlsCounterKey), count: v.(*atomic.Uint64).Load()})
+		return true
+	})
+	sort.Slice(tlsStats, func(i, j int) bool {
+		if tlsStats[i].key.version != tlsStats[j].key.version {
+			return tlsStats[i].key.version < tlsStats[j].key.version
+		}
+		return tlsStats[i].key.cipher < tlsStats[j].key.cipher
+	})
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_tls_handshakes_total Total successful TLS handshakes by negotiated version and cipher suite.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_tls_handshakes_total counter")
+	for _, t := range tlsStats {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_tls_handshakes_total{version=\"%s\",cipher=\"%s\"} %d\n",
+			prometheusEscapeLabelValue(t.key.version),
+			prometheusEscapeLabelValue(t.key.cipher),
+			t.count)
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_tls_handshake_errors_total Total failed TLS handshakes.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_tls_handshake_errors_total counter")
+	_, _ = fmt.Fprintf(w, "rsync_proxy_tls_handshake_errors_total %d\n", s.tlsHandshakeErrors.Load())
+
+	if expiry, ok := s.tlsCertificateExpiry(); ok {
+		_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_tls_certificate_expiry_timestamp_seconds Unix timestamp when the current TLS certificate expires.")
+		_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_tls_certificate_expiry_timestamp_seconds gauge")
+		_, _ = fmt.Fprintf(w, "rsync_proxy_tls_certificate_expiry_timestamp_seconds %d\n", expiry.Unix())
+	}
+
 	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_active_connections Current active rsync proxy connections.")
 	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_active_connections gauge")
 	_, _ = fmt.Fprintf(w, "rsync_proxy_active_connections %d\n", s.GetActiveConnectionCount())
 
+	var stateCounts [numConnStates]int
+	for _, conn := range connections {
+		if state := conn.snapshot().State; state >= 0 && state < numConnStates {
+			stateCounts[state]++
+		}
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_connections_by_state Current rsync proxy connections by lifecycle state.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_connections_by_state gauge")
+	for state := range numConnStates {
+		_, _ = fmt.Fprintf(w, "rsync_proxy_connections_by_state{state=\"%s\"} %d\n", state, stateCounts[state])
+	}
+
+	_, _ = fmt.Fprintln(w, "# HELP rsync_proxy_connection_state_duration_seconds Time spent by connections in each lifecycle state.")
+	_, _ = fmt.Fprintln(w, "# TYPE rsync_proxy_connection_state_duration_seconds summary")
+	for state := range numConnStates {
+		c := &s.connStateCounters[state]
+		seconds := time.Duration(c.nanoseconds.Load()).Seconds()
+		_, _ = fmt.Fprintf(w, "rsync_proxy_connection_state_duration_seconds_sum{state=\"%s\"} %.3f\n", state, seconds)
+		_, _ = fmt.Fprintf(w, "rsync_proxy_connection_state_duration_seconds_count{state=\"%s\"} %d\n", state, c.count.Load())
+	}
+
 	connectionCounts := make(map[prometheusConnectionGroup]int)
 	for _, conn := range connections {
 		snapshot := conn.snapshot()
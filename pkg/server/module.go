@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/ustclug/rsync-proxy/pkg/queue"
+)
+
+// moduleSettings holds what the proxy enforces for a module, configured in
+// the [modules.<name>] table.
+type moduleSettings struct {
+	// Users allowed to access the module, nil if it is public
+	auth *moduleAuth
+	// Credentials to answer the upstream's auth challenge with, overriding
+	// those of the upstream
+	credentials *upstreamCredentials
+	// What clients may ask for in their arguments
+	args argsPolicy
+	// Simultaneous connections allowed from one client, 0 for no limit
+	maxConnsPerClient int
+	// Clients allowed to access the module, nil for all
+	hosts *hostsRules
+	// Limits of the module's own queue, no queue if maxActiveConns is 0
+	maxActiveConns int
+	maxQueuedConns int
+	maxQueueWait   time.Duration
+}
+
+// noModuleSettings is used for modules without a [modules.<name>] table.
+var noModuleSettings = &moduleSettings{}
+
+func loadModuleSettings(moduleName string, m *Module) (*moduleSettings, error) {
+	auth, err := loadModuleAuth(moduleName, m)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := loadUpstreamCredentials(m.UpstreamCredentialsFile, m.UpstreamCredentialsNetworks)
+	if err != nil {
+		return nil, fmt.Errorf("module=%s: %w", moduleName, err)
+	}
+	for _, pattern := range m.RefuseOptions {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("module=%s: invalid refuse_options pattern %q", moduleName, pattern)
+		}
+	}
+	if m.MaxConnectionsPerClient < 0 {
+		return nil, fmt.Errorf("module=%s: max_connections_per_client must not be negative", moduleName)
+	}
+	switch {
+	case m.MaxActiveConns < 0:
+		return nil, fmt.Errorf("module=%s: max_active_connections must not be negative", moduleName)
+	case m.MaxQueuedConns < 0:
+		return nil, fmt.Errorf("module=%s: max_queued_connections must not be negative", moduleName)
+	case m.MaxQueueWait < 0:
+		return nil, fmt.Errorf("module=%s: max_queue_wait must not be negative", moduleName)
+	}
+	hosts, err := loadHostsRules(m.HostsACL)
+	if err != nil {
+		return nil, fmt.Errorf("module=%s: %w", moduleName, err)
+	}
+	return &moduleSettings{
+		auth:        auth,
+		credentials: credentials,
+		args: argsPolicy{
+			DenyPush:        m.DenyPush || m.ReadOnly,
+			ReadOnlyMessage: m.ReadOnly,
+			RefuseOptions:   m.RefuseOptions,
+		},
+		maxConnsPerClient: m.MaxConnectionsPerClient,
+		hosts:             hosts,
+		maxActiveConns:    m.MaxActiveConns,
+		maxQueuedConns:    m.MaxQueuedConns,
+		maxQueueWait:      m.MaxQueueWait,
+	}, nil
+}
+
+func (s *Server) getModuleSettings(moduleName string) *moduleSettings {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	if settings, ok := s.moduleSettings[moduleName]; ok {
+		return settings
+	}
+	return noModuleSettings
+}
+
+// updateModuleQueuesLocked returns the queues of the modules limiting their
+// connections, keeping those of the current ones so that reloads do not lose
+// track of their clients.
+//
+// Must be called with s.reloadLock held
+func (s *Server) updateModuleQueuesLocked(settings map[string]*moduleSettings) map[string]*queue.Queue {
+	queues := make(map[string]*queue.Queue)
+	for moduleName, m := range settings {
+		if m.maxActiveConns == 0 {
+			continue
+		}
+		q, ok := s.moduleQueues[moduleName]
+		if !ok {
+			q = queue.New(m.maxActiveConns, m.maxQueuedConns)
+		} else {
+			q.SetMax(m.maxActiveConns, m.maxQueuedConns)
+		}
+		queues[moduleName] = q
+	}
+	return queues
+}
+
+// getQueueForModule returns the queue of the module, or ok is false if the
+// module does not limit its connections.
+func (s *Server) getQueueForModule(moduleName string) (*queue.Queue, bool) {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	q, ok := s.moduleQueues[moduleName]
+	return q, ok
+}
+
+// getModuleQueueCounters returns the counters of the module's queue, creating
+// them lazily on first reference. Safe for concurrent use.
+func (s *Server) getModuleQueueCounters(moduleName string) *queueCounters {
+	if v, ok := s.moduleQueueCounters.Load(moduleName); ok {
+		return v.(*queueCounters)
+	}
+	v, _ := s.moduleQueueCounters.LoadOrStore(moduleName, &queueCounters{})
+	return v.(*queueCounters)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Outcomes of a module request, as told by the upstream's reply.
+const (
+	moduleResponseOK             = "ok"
+	moduleResponseAuthRequired   = "auth_required"
+	moduleResponseAuthFailed     = "auth_failed"
+	moduleResponseMaxConnections = "max_connections"
+	moduleResponseAccessDenied   = "access_denied"
+	moduleResponseUnknownModule  = "unknown_module"
+	moduleResponseError          = "error"
+	moduleResponseUnexpected     = "unexpected"
+)
+
+// maxModuleResponseLineSize limits the lines inspected while waiting for the
+// upstream's reply. Longer lines (e.g. in a MOTD) are forwarded in pieces.
+const maxModuleResponseLineSize = 4096
+
+// moduleResponseKey identifies an (upstream, outcome) pair.
+type moduleResponseKey struct {
+	upstream string
+	reason   string
+}
+
+// getModuleResponseCounter returns the counter of module requests to the
+// given upstream with the given outcome, creating it lazily.
+func (s *Server) getModuleResponseCounter(upstream, reason string) *atomic.Uint64 {
+	key := moduleResponseKey{upstream: upstream, reason: reason}
+	if v, ok := s.moduleResponseCounters.Load(key); ok {
+		return v.(*atomic.Uint64)
+	}
+	v, _ := s.moduleResponseCounters.LoadOrStore(key, &atomic.Uint64{})
+	return v.(*atomic.Uint64)
+}
+
+// classifyModuleResponse tells the outcome of a line sent by the upstream
+// after the module request. Lines of the MOTD have no outcome.
+func classifyModuleResponse(line string) (reason string, final bool) {
+	switch {
+	case strings.HasPrefix(line, "@RSYNCD: OK"):
+		return moduleResponseOK, true
+	case strings.HasPrefix(line, "@RSYNCD: AUTHREQD "):
+		return moduleResponseAuthRequired, false
+	case strings.HasPrefix(line, "@ERROR"):
+		lower := strings.ToLower(line)
+		switch {
+		case strings.Contains(lower, "max connections"):
+			return moduleResponseMaxConnections, true
+		case strings.Contains(lower, "auth failed"):
+			return moduleResponseAuthFailed, true
+		case strings.Contains(lower, "access denied"):
+			return moduleResponseAccessDenied, true
+		case strings.Contains(lower, "unknown module"):
+			return moduleResponseUnknownModule, true
+		}
+		return moduleResponseError, true
+	case strings.HasPrefix(line, string(RsyncdVersionPrefix)):
+		return moduleResponseUnexpected, true
+	}
+	return "", false
+}
+
+// recordModuleResponse records the outcome of a module request told by the
+// upstream.
+func (s *Server) recordModuleResponse(info *ConnInfo, ip, reason, message string) {
+	snapshot := info.snapshot()
+	info.SetUpstreamResponse(reason)
+	s.getModuleResponseCounter(snapshot.Upstream, reason).Add(1)
+	if reason != moduleResponseOK {
+		s.accessLog.F("client %s rejected by upstream %s for module %s (%s): %s", ip, snapshot.Upstream, snapshot.Module, reason, message)
+	}
+}
+
+// moduleResponseSniffer passes data from the upstream through while looking
+// for its reply to the module request. onResponse is called once the reply
+// is seen, after which data is no longer inspected.
+type moduleResponseSniffer struct {
+	reader     io.Reader
+	onResponse func(reason, message string)
+
+	line []byte
+	// The current line is too long to be a reply
+	skipping bool
+	done     bool
+}
+
+func (r *moduleResponseSniffer) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if !r.done {
+		r.inspect(p[:n])
+	}
+	return n, err
+}
+
+func (r *moduleResponseSniffer) inspect(data []byte) {
+	for len(data) > 0 && !r.done {
+		chunk := data
+		i := bytes.IndexByte(data, lineFeed)
+		if i >= 0 {
+			chunk = data[:i+1]
+		}
+		data = data[len(chunk):]
+		if !r.skipping {
+			if len(r.line)+len(chunk) > maxModuleResponseLineSize {
+				r.skipping = true
+				r.line = r.line[:0]
+			} else {
+				r.line = append(r.line, chunk...)
+			}
+		}
+		if i < 0 {
+			return
+		}
+		if !r.skipping {
+			if reason, final := classifyModuleResponse(string(r.line)); final {
+				r.done = true
+				r.onResponse(reason, string(bytes.TrimRight(r.line, "\r\n")))
+			}
+		}
+		r.line = r.line[:0]
+		r.skipping = false
+	}
+}
+
+// relayModuleResponse reads the upstream's reply to the module request until
+// its outcome is known, answering the upstream's auth challenge with
+// credentials if set. Further challenges are relayed between the client and
+// the upstream. Other output of the upstream is held in u if u.held, or
+// forwarded to the client otherwise. Since data after the reply may have been
+// read ahead, u.conn is replaced with a connection that keeps it.
+func (s *Server) relayModuleResponse(u *upstreamSession, downConn *handshakeConn, info *ConnInfo, ip string, credentials *upstreamCredentials, upstreamGreeting []byte) error {
+	upConn := u.conn
+	br := bufio.NewReaderSize(upConn, maxModuleResponseLineSize)
+	atLineStart := true
+	for {
+		if s.ReadTimeout > 0 {
+			_ = upConn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+		}
+		line, err := br.ReadSlice(lineFeed)
+		if err != nil && err != bufio.ErrBufferFull {
+			return fmt.Errorf("read module response: %w", err)
+		}
+		complete := err == nil
+		var reason string
+		var final bool
+		if atLineStart && complete {
+			reason, final = classifyModuleResponse(string(line))
+		}
+		atLineStart = complete
+
+		if reason == moduleResponseAuthRequired && credentials != nil {
+			challenge := strings.TrimSpace(strings.TrimPrefix(string(line), "@RSYNCD: AUTHREQD "))
+			if err := s.answerUpstreamChallenge(upConn, credentials, upstreamGreeting, challenge); err != nil {
+				return err
+			}
+			snapshot := info.snapshot()
+			s.accessLog.F("client %s authenticated to upstream %s as %s for module %s", ip, snapshot.Upstream, credentials.Username, snapshot.Module)
+			credentials = nil
+			continue
+		}
+
+		info.SentBytes.Add(int64(len(line)))
+		if reason == moduleResponseAuthRequired && u.held {
+			// The client has to see the challenge to answer it
+			u.pending = append(u.pending, line...)
+			u.held = false
+			if err := u.flush(downConn, s.WriteTimeout); err != nil {
+				return fmt.Errorf("send auth challenge: %w", err)
+			}
+		} else if u.held {
+			u.pending = append(u.pending, line...)
+		} else if _, err := writeWithTimeout(downConn, line, s.WriteTimeout); err != nil {
+			return fmt.Errorf("send module response: %w", err)
+		}
+		if reason == moduleResponseAuthRequired {
+			response, err := downConn.readLine(s.ReadTimeout)
+			if err != nil {
+				s.rejectHandshake(downConn, err)
+				return fmt.Errorf("read auth response from client: %w", err)
+			}
+			info.ReceivedBytes.Add(int64(len(response)))
+			if _, err := writeWithTimeout(upConn, response, s.WriteTimeout); err != nil {
+				return fmt.Errorf("send auth response: %w", err)
+			}
+			continue
+		}
+		if final {
+			u.reason = reason
+			u.message = string(bytes.TrimRight(line, "\r\n"))
+			u.conn = withBufferedData(upConn, br)
+			return nil
+		}
+	}
+}
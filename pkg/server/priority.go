@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/ustclug/rsync-proxy/pkg/queue"
+)
+
+// priorityClass gives the clients of an upstream from some networks a
+// priority in its queue, and possibly active slots of their own.
+type priorityClass struct {
+	Name     string
+	Networks []netip.Prefix
+	Priority int
+	Reserved int
+}
+
+func parsePriorityClasses(u *Upstream) ([]priorityClass, error) {
+	var classes []priorityClass
+	reserved := 0
+	for _, c := range u.PriorityClasses {
+		if c.Name == "" {
+			return nil, fmt.Errorf("priority class without name")
+		}
+		if slices.ContainsFunc(classes, func(other priorityClass) bool { return other.Name == c.Name }) {
+			return nil, fmt.Errorf("duplicated priority class %s", c.Name)
+		}
+		if len(c.Networks) == 0 {
+			return nil, fmt.Errorf("priority class %s: no networks", c.Name)
+		}
+		if c.ReservedConns < 0 {
+			return nil, fmt.Errorf("priority class %s: reserved_connections must not be negative", c.Name)
+		}
+		class := priorityClass{Name: c.Name, Priority: c.Priority, Reserved: c.ReservedConns}
+		for _, network := range c.Networks {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("priority class %s: invalid network %q: %w", c.Name, network, err)
+			}
+			class.Networks = append(class.Networks, prefix.Masked())
+		}
+		reserved += c.ReservedConns
+		classes = append(classes, class)
+	}
+	if reserved > 0 && (u.MaxActiveConns == 0 || reserved > u.MaxActiveConns) {
+		return nil, fmt.Errorf("reserved_connections of priority classes exceed max_active_connections")
+	}
+	return classes, nil
+}
+
+// priorityClassOf returns the first class of target the client at ip
+// belongs to, or nil.
+func (t *Target) priorityClassOf(ip string) *priorityClass {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for i, c := range t.PriorityClasses {
+		if slices.ContainsFunc(c.Networks, func(prefix netip.Prefix) bool { return prefix.Contains(addr) }) {
+			return &t.PriorityClasses[i]
+		}
+	}
+	return nil
+}
+
+// queueClient describes the client at ip to the queue of target.
+func queueClient(target Target, ip string) queue.Client {
+	c := queue.Client{Key: clientKey(target.FairQueueing, ip)}
+	if class := target.priorityClassOf(ip); class != nil {
+		c.Priority = class.Priority
+		c.Class = class.Name
+	}
+	return c
+}
+
+// reservedSlots returns the active slots reserved for each class.
+func reservedSlots(classes []priorityClass) map[string]int {
+	var reserved map[string]int
+	for _, c := range classes {
+		if c.Reserved > 0 {
+			if reserved == nil {
+				reserved = make(map[string]int)
+			}
+			reserved[c.Name] = c.Reserved
+		}
+	}
+	return reserved
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ustclug/rsync-proxy/pkg/queue"
+)
+
+// relayDurationSamples is the number of latest relays of an upstream used to
+// estimate how long its queued clients wait.
+const relayDurationSamples = 32
+
+// relayDurations keeps the durations of the latest relays of an upstream.
+type relayDurations struct {
+	mu     sync.Mutex
+	recent [relayDurationSamples]time.Duration
+	count  int
+	next   int
+}
+
+func (r *relayDurations) add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recent[r.next] = d
+	r.next = (r.next + 1) % len(r.recent)
+	r.count = min(r.count+1, len(r.recent))
+}
+
+// mean returns the average duration of the latest relays, or ok is false if
+// there was none yet.
+func (r *relayDurations) mean() (_ time.Duration, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.count == 0 {
+		return 0, false
+	}
+	var total time.Duration
+	for _, d := range r.recent[:r.count] {
+		total += d
+	}
+	return total / time.Duration(r.count), true
+}
+
+// estimateQueueWait roughly estimates the wait of the client at the 1-based
+// position of a queue with the given number of active slots: each round of
+// slots takes a typical relay.
+func estimateQueueWait(typical time.Duration, position, slots int) time.Duration {
+	if slots <= 0 {
+		slots = 1
+	}
+	rounds := (position + slots - 1) / slots
+	return typical * time.Duration(rounds)
+}
+
+// Kinds of queues that clients wait for.
+const (
+	queueKindUpstream = "upstream"
+	queueKindModule   = "module"
+)
+
+// queueCounters count what happens to the clients of a queue.
+type queueCounters struct {
+	queueFull    atomic.Uint64
+	queueTimeout atomic.Uint64
+	// Durations of the latest relays, to estimate queue waits
+	relayDurations relayDurations
+}
+
+// waitingQueue is the queue of an upstream or of a module that a client
+// waits for.
+type waitingQueue struct {
+	queue *queue.Queue
+	// queueKindUpstream or queueKindModule
+	kind string
+	name string
+	// 0 for no limit
+	maxWait  time.Duration
+	counters *queueCounters
+	// When the client waited for the queue before, nil if it waits only once
+	deadlines queueDeadlines
+}
+
+func (s *Server) upstreamWaitingQueue(target Target, upstreamQueue *queue.Queue, deadlines queueDeadlines) waitingQueue {
+	return waitingQueue{
+		queue:     upstreamQueue,
+		kind:      queueKindUpstream,
+		name:      target.Upstream,
+		maxWait:   target.MaxQueueWait,
+		counters:  &s.getUpstreamCounters(target.Upstream).queueCounters,
+		deadlines: deadlines,
+	}
+}
+
+// queueDeadlines remembers until when a client may wait for each queue, so
+// that being requeued after "max connections" does not restart the clock of
+// max_queue_wait.
+type queueDeadlines map[string]time.Time
+
+// deadline returns until when the client may wait for w, counting from now
+// if it has not waited for w before.
+func (d queueDeadlines) deadline(w waitingQueue, now time.Time) time.Time {
+	if d == nil {
+		return now.Add(w.maxWait)
+	}
+	key := w.kind + " " + w.name
+	if _, ok := d[key]; !ok {
+		d[key] = now.Add(w.maxWait)
+	}
+	return d[key]
+}
+
+// title returns e.g. "Upstream u1" to start the notices with.
+func (w waitingQueue) title() string {
+	return strings.ToUpper(w.kind[:1]) + w.kind[1:] + " " + w.name
+}
+
+// queuePositionNotice tells a queued client its position, and how long it
+// may have to wait if the upstream or module served any client recently.
+func (s *Server) queuePositionNotice(w waitingQueue, status queue.Status) string {
+	msg := fmt.Sprintf("Your position: %d, Total queued: %d", status.Index+1, status.Max)
+	if typical, ok := w.counters.relayDurations.mean(); ok {
+		eta := estimateQueueWait(typical, status.Index+1, w.queue.GetMax())
+		msg += fmt.Sprintf(", Estimated wait: %s", max(eta.Round(time.Second), time.Second))
+	}
+	return msg + "\n"
+}
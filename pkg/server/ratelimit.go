@@ -0,0 +1,437 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// minRateLimiterSweep is the number of buckets below which a rate limiter
+// does not look for idle ones.
+const minRateLimiterSweep = 1024
+
+// banSaveInterval is how often the bans made while serving clients are saved,
+// so that no client waits for the ban file to be written.
+const banSaveInterval = time.Second
+
+// rateLimit allows a client up to burst events at once, regaining all of
+// them over period.
+type rateLimit struct {
+	// 0 for no limit
+	burst  int
+	period time.Duration
+}
+
+func parseRateLimit(name string, burst int, period time.Duration) (rateLimit, error) {
+	switch {
+	case burst < 0:
+		return rateLimit{}, fmt.Errorf("%s_rate_limit must not be negative", name)
+	case period < 0:
+		return rateLimit{}, fmt.Errorf("%s_rate_period must not be negative", name)
+	case burst > 0 && period == 0:
+		return rateLimit{}, fmt.Errorf("%s_rate_limit requires %s_rate_period", name, name)
+	}
+	return rateLimit{burst: burst, period: period}, nil
+}
+
+// rateLimits holds the settings of the rate limits of clients.
+type rateLimits struct {
+	conn          rateLimit
+	unknownModule rateLimit
+	// How long clients exceeding a limit are banned, 0 for no ban
+	banDuration time.Duration
+}
+
+func (s *Server) getRateLimits() rateLimits {
+	s.reloadLock.RLock()
+	defer s.reloadLock.RUnlock()
+	return s.rateLimits
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens regained since the last update.
+func (b *tokenBucket) refill(limit rateLimit, now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens += float64(limit.burst) * elapsed.Seconds() / limit.period.Seconds()
+		b.tokens = min(b.tokens, float64(limit.burst))
+		b.updated = now
+	}
+}
+
+// rateLimiter keeps a token bucket for each client key.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// Number of buckets at which full ones are dropped
+	sweepAt int
+}
+
+// allow takes a token from the bucket of key, or returns false if it is
+// empty.
+func (l *rateLimiter) allow(key string, limit rateLimit, now time.Time) bool {
+	if limit.burst <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if ok {
+		b.refill(limit, now)
+	} else {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*tokenBucket)
+		}
+		if len(l.buckets) >= max(l.sweepAt, minRateLimiterSweep) {
+			l.sweep(limit, now)
+			l.sweepAt = 2 * len(l.buckets)
+		}
+		b = &tokenBucket{tokens: float64(limit.burst), updated: now}
+		l.buckets[key] = b
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// reset forgets the bucket of key, e.g. once the client is banned.
+func (l *rateLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, key)
+}
+
+// sweep drops the buckets that are full again, as new ones start full.
+//
+// Must be called with l.mu held
+func (l *rateLimiter) sweep(limit rateLimit, now time.Time) {
+	for key, b := range l.buckets {
+		b.refill(limit, now)
+		if b.tokens >= float64(limit.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Ban is a client address refused until a given time.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// banList holds the banned client addresses, and saves them to a file if
+// set.
+type banList struct {
+	mu   sync.Mutex
+	bans map[string]Ban
+	file string
+	// Whether the bans changed since they were last saved
+	dirty bool
+
+	// Serializes writes of the file
+	saveMu sync.Mutex
+}
+
+// banKey returns the normalized address of ip, or ok is false if it is not
+// an IP address.
+func banKey(ip string) (_ string, ok bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
+
+func (l *banList) banned(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[ip]
+	if ok && !now.Before(b.Until) {
+		delete(l.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// add bans b.IP until b.Until, or later if it is already banned for longer.
+// It returns the ban in effect. The change is only saved by save or flush.
+func (l *banList) add(b Ban) Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.addLocked(b)
+}
+
+// Must be called with l.mu held
+func (l *banList) addLocked(b Ban) Ban {
+	if l.bans == nil {
+		l.bans = make(map[string]Ban)
+	}
+	if old, ok := l.bans[b.IP]; ok && !old.Until.Before(b.Until) {
+		return old
+	}
+	l.bans[b.IP] = b
+	l.dirty = true
+	return b
+}
+
+// remove lifts the ban of ip, or returns false if it is not banned. The
+// change is only saved by save or flush.
+func (l *banList) remove(ip string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.bans[ip]
+	if !ok {
+		return false
+	}
+	delete(l.bans, ip)
+	l.dirty = true
+	return now.Before(b.Until)
+}
+
+// list returns the bans in effect at now, ordered by address.
+func (l *banList) list(now time.Time) []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bans := make([]Ban, 0, len(l.bans))
+	for ip, b := range l.bans {
+		if !now.Before(b.Until) {
+			delete(l.bans, ip)
+			continue
+		}
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+	return bans
+}
+
+// setFile makes l saved to file, adding the bans read from it.
+func (l *banList) setFile(file string, bans []Ban) error {
+	l.mu.Lock()
+	l.file = file
+	for _, b := range bans {
+		l.addLocked(b)
+	}
+	l.mu.Unlock()
+	return l.save()
+}
+
+// flush saves the bans if they changed since they were last saved.
+func (l *banList) flush() error {
+	l.mu.Lock()
+	dirty := l.dirty
+	l.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return l.save()
+}
+
+func (l *banList) getFile() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file
+}
+
+// save writes the bans in effect to the file, replacing it at once. The bans
+// are saved again by the next flush if it fails.
+func (l *banList) save() error {
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	file := l.file
+	l.dirty = false
+	l.mu.Unlock()
+	if file == "" {
+		return nil
+	}
+	if err := writeBanFile(file, l.list(time.Now())); err != nil {
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeBanFile(file string, bans []Ban) error {
+	data, err := json.Marshal(bans)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("save bans: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save bans: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save bans: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("save bans: %w", err)
+	}
+	return nil
+}
+
+// readBanFile returns the bans saved in file that are still in effect at
+// now. A missing file has no bans.
+func readBanFile(file string, now time.Time) ([]Ban, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []Ban
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", file, err)
+	}
+	bans := saved[:0]
+	for _, b := range saved {
+		ip, ok := banKey(b.IP)
+		if !ok {
+			return nil, fmt.Errorf("parse %s: invalid address %q", file, b.IP)
+		}
+		if now.Before(b.Until) {
+			b.IP = ip
+			bans = append(bans, b)
+		}
+	}
+	return bans, nil
+}
+
+// admitConn tells whether a new connection from the client at ip may go on:
+// the client must not be banned, and must be within the rate of new
+// connections.
+func (s *Server) admitConn(ip string) bool {
+	key, ok := banKey(ip)
+	if !ok {
+		// Not an IP address, e.g. a Unix socket
+		return true
+	}
+	now := time.Now()
+	if s.bans.banned(key, now) {
+		s.bannedConns.Add(1)
+		return false
+	}
+	limits := s.getRateLimits()
+	if s.connRateLimiter.allow(key, limits.conn, now) {
+		return true
+	}
+	s.connRateLimited.Add(1)
+	if !s.banClient(key, limits.banDuration, "too many connections", now) {
+		s.accessLog.F("client %s exceeds the connection rate limit", ip)
+	}
+	return false
+}
+
+// countUnknownModule counts a request of the client at ip for an unknown
+// module, and bans the client if it made too many.
+func (s *Server) countUnknownModule(ip string) {
+	key, ok := banKey(ip)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	limits := s.getRateLimits()
+	if s.unknownModuleRateLimiter.allow(key, limits.unknownModule, now) {
+		return
+	}
+	s.unknownModuleRateLimited.Add(1)
+	s.banClient(key, limits.banDuration, "too many requests for unknown modules", now)
+}
+
+// banClient bans the client at ip for duration, or returns false if
+// duration is 0.
+func (s *Server) banClient(ip string, duration time.Duration, reason string, now time.Time) bool {
+	if duration <= 0 {
+		return false
+	}
+	s.clientBans.Add(1)
+	s.connRateLimiter.reset(ip)
+	s.unknownModuleRateLimiter.reset(ip)
+	s.accessLog.F("client %s is banned for %s: %s", ip, duration, reason)
+	// Saved by saveBansPeriodically
+	s.bans.add(Ban{IP: ip, Until: now.Add(duration), Reason: reason})
+	return true
+}
+
+// saveBansPeriodically saves the bans that changed every banSaveInterval
+// until ctx is done.
+func (s *Server) saveBansPeriodically(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(banSaveInterval):
+		}
+		s.flushBans()
+	}
+}
+
+// flushBans saves the bans if they changed since they were last saved.
+func (s *Server) flushBans() {
+	if err := s.bans.flush(); err != nil {
+		log.Printf("[WARN] %v", err)
+		s.errorLog.F("[WARN] %v", err)
+	}
+}
+
+// ListBans returns the client addresses banned now.
+func (s *Server) ListBans() []Ban {
+	return s.bans.list(time.Now())
+}
+
+// BanClient bans ip for duration, or for ban_duration if it is 0.
+func (s *Server) BanClient(ip string, duration time.Duration, reason string) (Ban, error) {
+	key, ok := banKey(ip)
+	if !ok {
+		return Ban{}, fmt.Errorf("invalid address %q", ip)
+	}
+	if duration == 0 {
+		duration = s.getRateLimits().banDuration
+	}
+	if duration <= 0 {
+		return Ban{}, fmt.Errorf("missing ban duration")
+	}
+	if reason == "" {
+		reason = "banned manually"
+	}
+	s.accessLog.F("client %s is banned for %s: %s", key, duration, reason)
+	ban := s.bans.add(Ban{IP: key, Until: time.Now().Add(duration), Reason: reason})
+	return ban, s.bans.save()
+}
+
+// UnbanClient lifts the ban of ip, or returns false if it is not banned.
+func (s *Server) UnbanClient(ip string) (bool, error) {
+	key, ok := banKey(ip)
+	if !ok {
+		return false, fmt.Errorf("invalid address %q", ip)
+	}
+	if !s.bans.remove(key, time.Now()) {
+		return false, nil
+	}
+	s.accessLog.F("client %s is unbanned", key)
+	return true, s.bans.save()
+}
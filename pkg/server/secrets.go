@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readSecretLines returns the non-empty, non-comment lines of a secrets
+// file. Like rsyncd's "strict modes", files accessible by other users are
+// refused.
+func readSecretLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode().Perm()&0o007 != 0 {
+		return nil, fmt.Errorf("secrets file %s must not be other-accessible (mode %04o)", path, fi.Mode().Perm())
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read secrets file %s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// readCredentialsFile reads a single "user:password" entry.
+func readCredentialsFile(path string) (username, password string, err error) {
+	lines, err := readSecretLines(path)
+	if err != nil {
+		return "", "", err
+	}
+	if len(lines) != 1 {
+		return "", "", fmt.Errorf("credentials file %s must contain exactly one user:password line", path)
+	}
+	username, password, ok := strings.Cut(lines[0], ":")
+	if !ok || username == "" {
+		return "", "", fmt.Errorf("credentials file %s must contain exactly one user:password line", path)
+	}
+	return username, password, nil
+}
@@ -13,6 +13,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"slices"
 	"sort"
@@ -30,6 +31,10 @@ import (
 )
 
 const (
+	// ReadBufferSize was the size of the buffer handshake lines were read
+	// into.
+	//
+	// Deprecated: handshake lines are now limited by maxHandshakeLineSize.
 	ReadBufferSize = 256
 
 	defaultRsyncPortString = "873"
@@ -41,38 +46,84 @@ var (
 	// See https://github.com/RsyncProject/rsync/blob/a6312e60c95e5ebb5764eaf18eb07be23420ebc6/clientserver.c#L203
 	RsyncdServerVersion = []byte("@RSYNCD: 32.0 sha512 sha256 sha1 md5 md4\n")
 	RsyncdExit          = []byte("@RSYNCD: EXIT\n")
-
-	bufPool = &sync.Pool{
-		New: func() any {
-			buf := make([]byte, ReadBufferSize)
-			return &buf
-		},
-	} // pool of (*[]byte)
 )
 
 const lineFeed = '\n'
 
+// listenerKind tells which listener a client connection was accepted on.
+type listenerKind int
+
+const (
+	listenerPlain listenerKind = iota
+	listenerTLS
+	// Clients send an HTTP CONNECT request before the rsync handshake.
+	listenerHTTPConnect
+
+	numListenerKinds
+)
+
+const (
+	// Delays before accepting again after a temporary error, doubled on
+	// each consecutive error like net/http does
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
+)
+
 type ConnInfo struct {
-	mu            sync.RWMutex
-	Index         uint32
-	LocalAddr     string
-	RemoteAddr    string
-	ConnectedAt   time.Time
-	Module        string
-	Upstream      string
+	mu          sync.RWMutex
+	Index       uint32
+	LocalAddr   string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	Module      string
+	Upstream    string
+	User        string
+	// Outcome of the module request told by the upstream
+	UpstreamResponse string
+	// Transfer requested by the client, see clientArgs
+	Direction string
+	Paths     []string
+	Options   []string
+	// Protocol version and auth digests from the greeting of the client
+	ClientProtocol int
+	ClientDigests  []string
+	// Lifecycle of the connection, see connState
+	State         connState
+	StateSince    time.Time
+	Transitions   []connStateTransition
+	QueuePosition int
+	QueueLength   int
+	TLSVersion    string
+	TLSCipher     string
+	TLSServerName string
 	SentBytes     atomic.Int64
 	ReceivedBytes atomic.Int64
 }
 
 type connInfoSnapshot struct {
-	Index         uint32    `json:"index"`
-	LocalAddr     string    `json:"local"`
-	RemoteAddr    string    `json:"remote"`
-	ConnectedAt   time.Time `json:"connected"`
-	Module        string    `json:"module"`
-	Upstream      string    `json:"upstream"`
-	SentBytes     int64     `json:"sentBytes"`
-	ReceivedBytes int64     `json:"receivedBytes"`
+	Index            uint32                `json:"index"`
+	LocalAddr        string                `json:"local"`
+	RemoteAddr       string                `json:"remote"`
+	ConnectedAt      time.Time             `json:"connected"`
+	Module           string                `json:"module"`
+	Upstream         string                `json:"upstream"`
+	User             string                `json:"user,omitempty"`
+	UpstreamResponse string                `json:"upstreamResponse,omitempty"`
+	Direction        string                `json:"direction,omitempty"`
+	Paths            []string              `json:"paths,omitempty"`
+	Options          []string              `json:"options,omitempty"`
+	ClientProtocol   int                   `json:"clientProtocol,omitempty"`
+	ClientDigests    []string              `json:"clientDigests,omitempty"`
+	State            connState             `json:"state"`
+	StateSince       time.Time             `json:"stateSince"`
+	Transitions      []connStateTransition `json:"transitions"`
+	QueuePosition    int                   `json:"queuePosition,omitempty"`
+	QueueLength      int                   `json:"queueLength,omitempty"`
+	TLSVersion       string                `json:"tlsVersion,omitempty"`
+	TLSCipher        string                `json:"tlsCipher,omitempty"`
+	TLSServerName    string                `json:"tlsServerName,omitempty"`
+	SentBytes        int64                 `json:"sentBytes"`
+	ReceivedBytes    int64                 `json:"receivedBytes"`
 }
 
 func (c *ConnInfo) SetModule(module string) {
@@ -87,18 +138,68 @@ func (c *ConnInfo) SetUpstream(upstream string) {
 	c.Upstream = upstream
 }
 
+func (c *ConnInfo) SetUser(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.User = user
+}
+
+func (c *ConnInfo) SetUpstreamResponse(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.UpstreamResponse = reason
+}
+
+func (c *ConnInfo) SetArgs(args *clientArgs) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Direction = args.direction()
+	c.Paths = args.Paths
+	c.Options = args.Options
+}
+
+func (c *ConnInfo) SetClientGreeting(greeting rsyncdGreeting) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ClientProtocol = greeting.Protocol
+	c.ClientDigests = greeting.Digests
+}
+
+func (c *ConnInfo) SetTLSState(state tls.ConnectionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TLSVersion = tls.VersionName(state.Version)
+	c.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	c.TLSServerName = state.ServerName
+}
+
 func (c *ConnInfo) snapshot() connInfoSnapshot {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	return connInfoSnapshot{
-		Index:         c.Index,
-		LocalAddr:     c.LocalAddr,
-		RemoteAddr:    c.RemoteAddr,
-		ConnectedAt:   c.ConnectedAt,
-		Module:        c.Module,
-		Upstream:      c.Upstream,
-		SentBytes:     c.SentBytes.Load(),
-		ReceivedBytes: c.ReceivedBytes.Load(),
+		Index:            c.Index,
+		LocalAddr:        c.LocalAddr,
+		RemoteAddr:       c.RemoteAddr,
+		ConnectedAt:      c.ConnectedAt,
+		Module:           c.Module,
+		Upstream:         c.Upstream,
+		User:             c.User,
+		UpstreamResponse: c.UpstreamResponse,
+		Direction:        c.Direction,
+		Paths:            c.Paths,
+		Options:          c.Options,
+		ClientProtocol:   c.ClientProtocol,
+		ClientDigests:    c.ClientDigests,
+		State:            c.State,
+		StateSince:       c.StateSince,
+		Transitions:      slices.Clone(c.Transitions),
+		QueuePosition:    c.QueuePosition,
+		QueueLength:      c.QueueLength,
+		TLSVersion:       c.TLSVersion,
+		TLSCipher:        c.TLSCipher,
+		TLSServerName:    c.TLSServerName,
+		SentBytes:        c.SentBytes.Load(),
+		ReceivedBytes:    c.ReceivedBytes.Load(),
 	}
 }
 
@@ -110,6 +211,18 @@ type Target struct {
 	Upstream         string
 	Addr             string
 	UseProxyProtocol bool
+	// Via is the jump proxy to dial Addr through, nil for direct connections
+	Via *upstreamProxy
+	// Credentials to answer the upstream's auth challenge with, if any
+	Credentials *upstreamCredentials
+	// What to do when the upstream rejects with "max connections"
+	MaxConnections maxConnectionsPolicy
+	// How long a client may wait in the proxy's queue, 0 for no limit
+	MaxQueueWait time.Duration
+	// How clients are told apart for fair queueing, empty for FIFO
+	FairQueueing string
+	// Classes of clients in the queue, the first matching one applies
+	PriorityClasses []priorityClass
 }
 
 type upstreamConfig struct {
@@ -123,7 +236,7 @@ type upstreamConfig struct {
 
 // upstreamCounters holds per-upstream failure counters.
 type upstreamCounters struct {
-	queueFull atomic.Uint64
+	queueCounters
 	dialError atomic.Uint64
 }
 
@@ -145,10 +258,11 @@ type moduleCounters struct {
 type Server struct {
 	// --- Options section
 	// Listen Address
-	ListenAddr     string
-	TLSListenAddr  string
-	HTTPListenAddr string
-	ConfigPath     string
+	ListenAddr            string
+	TLSListenAddr         string
+	HTTPConnectListenAddr string
+	HTTPListenAddr        string
+	ConfigPath            string
 
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
@@ -156,20 +270,51 @@ type Server struct {
 	Motd string
 	// --- End of options section
 
+	// Either protocolNegotiationFixed or protocolNegotiationMin
+	protocolNegotiation string
+	// Limit of simultaneous connections of a client over all modules
+	clientLimit clientLimit
+	rateLimits  rateLimits
+	connLimits  connLimits
+	// Clients allowed to connect, and to connect to each listener
+	hostsRules         *hostsRules
+	listenerHostsRules map[listenerKind]*hostsRules
+
 	accessLog, errorLog *logging.FileLogger
 
 	reloadLock sync.RWMutex
 	dialer     net.Dialer
 	// name -> upstream targets
-	modules        map[string][]Target
-	upstreams      []upstreamConfig
+	modules   map[string][]Target
+	upstreams []upstreamConfig
+	// name -> settings of modules configured in [modules.<name>]
+	moduleSettings map[string]*moduleSettings
 	tlsCertificate *tls.Certificate
+	tlsConfig      *tls.Config
+	tlsSettings    tlsSettings
+	tlsTicketKeys  sessionTicketKeys
+	// State of the certificate files when they were last loaded
+	tlsFileStamp    tlsFileStamp
+	tlsExpiryWarned atomic.Bool
+
+	// Normalized host:port targets accepted on the HTTP CONNECT listener
+	httpConnectAllowedHosts []string
 
 	upstreamQueues map[string]*queue.Queue
+	// Queues of the modules limiting their connections
+	moduleQueues map[string]*queue.Queue
 
 	activeConnCount atomic.Int64
-	connIndex       atomic.Uint32
-	connInfo        sync.Map
+	// Connections accepted whose module request is not accepted yet
+	handshakingConnCount   atomic.Int64
+	maxConnsRejected       atomic.Uint64
+	maxHandshakingRejected atomic.Uint64
+	handshakeTimeouts      atomic.Uint64
+	connIndex              atomic.Uint32
+	connInfo               sync.Map
+
+	// Temporary errors accepting connections, indexed by listenerKind
+	acceptErrors [numListenerKinds]atomic.Uint64
 
 	acceptedConnCount  atomic.Uint64
 	completedConnCount atomic.Uint64
@@ -180,15 +325,60 @@ type Server struct {
 	// map key is upstream name. Value is *upstreamCounters.
 	upstreamCounters   sync.Map
 	unknownModuleCount atomic.Uint64
+	// Counters of the module queues, by module name. Value is
+	// *queueCounters.
+	moduleQueueCounters sync.Map
+
+	// Connections of each client key, and of each client key per module
+	clientConns         connCounter[string]
+	moduleClientConns   connCounter[moduleClientKey]
+	clientLimitRejected atomic.Uint64
+
+	// Token buckets of client addresses for new connections and for
+	// requests of unknown modules, and the clients banned for exceeding them
+	connRateLimiter          rateLimiter
+	unknownModuleRateLimiter rateLimiter
+	connRateLimited          atomic.Uint64
+	unknownModuleRateLimited atomic.Uint64
+	bans                     banList
+	clientBans               atomic.Uint64
+	bannedConns              atomic.Uint64
+
+	// Clients denied by hosts rules, indexed by hostsScope
+	hostsDenied [numHostsScopes]atomic.Uint64
 
 	// Per-(module, upstream) counters tracked when a relay finishes
 	// successfully. Lazy-initialized via getModuleCounters.
 	// map key is moduleUpstreamKey. Value is *moduleCounters.
 	moduleCounters sync.Map
 
-	TCPListener  net.Listener
-	TLSListener  net.Listener
-	HTTPListener net.Listener
+	// Successful TLS handshakes by negotiated version and cipher suite.
+	// map key is tlsCounterKey. Value is *atomic.Uint64.
+	tlsHandshakeCounters sync.Map
+	tlsHandshakeErrors   atomic.Uint64
+
+	// Module requests by upstream and outcome told by the upstream.
+	// map key is moduleResponseKey. Value is *atomic.Uint64.
+	moduleResponseCounters sync.Map
+
+	// Connections by protocol version of the client greeting.
+	// map key is the label from clientProtocolLabel. Value is *atomic.Uint64.
+	clientProtocolCounters sync.Map
+
+	// Time spent by connections in each state, indexed by connState
+	connStateCounters [numConnStates]connStateCounters
+
+	// Greetings last received from upstreams.
+	// map key is upstream name. Value is rsyncdGreeting.
+	upstreamGreetings sync.Map
+	// Stops probing the greetings of the upstreams of the previous config,
+	// guarded by reloadLock
+	cancelGreetingProbe context.CancelFunc
+
+	TCPListener         net.Listener
+	TLSListener         net.Listener
+	HTTPConnectListener net.Listener
+	HTTPListener        net.Listener
 }
 
 type countingReader struct {
@@ -217,8 +407,13 @@ func New() *Server {
 }
 
 func (s *Server) loadConfig(c *Config, openLog bool) error {
-	var tlsCertificate *tls.Certificate
-	serverStarted := s.TCPListener != nil || s.HTTPListener != nil || s.TLSListener != nil
+	var (
+		tlsCertificate *tls.Certificate
+		tlsConfig      *tls.Config
+		tlsSettings    tlsSettings
+		tlsFileStamp   tlsFileStamp
+	)
+	serverStarted := s.TCPListener != nil || s.HTTPListener != nil || s.TLSListener != nil || s.HTTPConnectListener != nil
 
 	if len(c.Upstreams) == 0 {
 		return fmt.Errorf("no upstream found")
@@ -229,6 +424,10 @@ func (s *Server) loadConfig(c *Config, openLog bool) error {
 			return fmt.Errorf("listen_tls cannot be enabled on reload; restart required")
 		case s.TLSListener != nil && c.Proxy.ListenTLS == "":
 			return fmt.Errorf("listen_tls cannot be disabled on reload; restart required")
+		case s.HTTPConnectListener == nil && c.Proxy.ListenHTTPConnect != "":
+			return fmt.Errorf("listen_http_connect cannot be enabled on reload; restart required")
+		case s.HTTPConnectListener != nil && c.Proxy.ListenHTTPConnect == "":
+			return fmt.Errorf("listen_http_connect cannot be disabled on reload; restart required")
 		}
 	}
 	if c.Proxy.ListenTLS == "" {
@@ -239,11 +438,114 @@ func (s *Server) loadConfig(c *Config, openLog bool) error {
 		if c.Proxy.TLSCertFile == "" || c.Proxy.TLSKeyFile == "" {
 			return fmt.Errorf("listen_tls requires tls_cert_file and tls_key_file")
 		}
+		// Stat before loading so that a change in between is picked up
+		// by the watcher instead of being missed.
+		var err error
+		tlsFileStamp, err = statTLSFiles(c.Proxy.TLSCertFile, c.Proxy.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("load tls certificate: %w", err)
+		}
 		cert, err := tls.LoadX509KeyPair(c.Proxy.TLSCertFile, c.Proxy.TLSKeyFile)
 		if err != nil {
 			return fmt.Errorf("load tls certificate: %w", err)
 		}
 		tlsCertificate = &cert
+		tlsSettings, err = parseTLSSettings(&c.Proxy)
+		if err != nil {
+			return err
+		}
+		tlsConfig = s.newTLSConfig(tlsSettings)
+	}
+
+	protocolNegotiation := c.Proxy.ProtocolNegotiation
+	switch protocolNegotiation {
+	case "":
+		protocolNegotiation = protocolNegotiationFixed
+	case protocolNegotiationFixed, protocolNegotiationMin:
+	default:
+		return fmt.Errorf("invalid protocol_negotiation %q, expecting %s or %s", protocolNegotiation, protocolNegotiationFixed, protocolNegotiationMin)
+	}
+
+	limit := clientLimit{max: c.Proxy.MaxConnectionsPerClient, scope: c.Proxy.ClientLimitScope}
+	switch limit.scope {
+	case "":
+		limit.scope = clientKeyIP
+	case clientKeyIP, clientKeySubnet:
+	default:
+		return fmt.Errorf("invalid client_limit_scope %q, expecting %s or %s", limit.scope, clientKeyIP, clientKeySubnet)
+	}
+	if limit.max < 0 {
+		return fmt.Errorf("max_connections_per_client must not be negative")
+	}
+
+	proxyLimits := connLimits{
+		maxConns:         c.Proxy.MaxConnections,
+		maxHandshaking:   c.Proxy.MaxHandshakingConnections,
+		handshakeTimeout: c.Proxy.HandshakeTimeout,
+	}
+	switch {
+	case proxyLimits.maxConns < 0:
+		return fmt.Errorf("max_connections must not be negative")
+	case proxyLimits.maxHandshaking < 0:
+		return fmt.Errorf("max_handshaking_connections must not be negative")
+	case proxyLimits.handshakeTimeout < 0:
+		return fmt.Errorf("handshake_timeout must not be negative")
+	}
+
+	var rateLimits rateLimits
+	var err error
+	rateLimits.conn, err = parseRateLimit("connection", c.Proxy.ConnectionRateLimit, c.Proxy.ConnectionRatePeriod)
+	if err != nil {
+		return err
+	}
+	rateLimits.unknownModule, err = parseRateLimit("unknown_module", c.Proxy.UnknownModuleRateLimit, c.Proxy.UnknownModuleRatePeriod)
+	if err != nil {
+		return err
+	}
+	rateLimits.banDuration = c.Proxy.BanDuration
+	if rateLimits.banDuration < 0 {
+		return fmt.Errorf("ban_duration must not be negative")
+	}
+	if rateLimits.unknownModule.burst > 0 && rateLimits.banDuration == 0 {
+		return fmt.Errorf("unknown_module_rate_limit requires ban_duration")
+	}
+	banFileChanged := c.Proxy.BanFile != s.bans.getFile()
+	var savedBans []Ban
+	if banFileChanged && c.Proxy.BanFile != "" {
+		savedBans, err = readBanFile(c.Proxy.BanFile, time.Now())
+		if err != nil {
+			return fmt.Errorf("load ban_file: %w", err)
+		}
+	}
+
+	globalHosts, err := loadHostsRules(c.Proxy.HostsACL)
+	if err != nil {
+		return err
+	}
+	listenerHosts, err := loadListenerHostsRules(c.Proxy.Listeners)
+	if err != nil {
+		return err
+	}
+
+	var httpConnectAllowedHosts []string
+	if c.Proxy.ListenHTTPConnect != "" && len(c.Proxy.HTTPConnectAllowedHosts) == 0 {
+		return fmt.Errorf("listen_http_connect requires http_connect_allowed_hosts")
+	}
+	for _, host := range c.Proxy.HTTPConnectAllowedHosts {
+		target, err := normalizeHTTPConnectTarget(host)
+		if err != nil {
+			return fmt.Errorf("invalid http_connect_allowed_hosts entry %q: %w", host, err)
+		}
+		httpConnectAllowedHosts = append(httpConnectAllowedHosts, target)
+	}
+
+	moduleSettings := make(map[string]*moduleSettings, len(c.Modules))
+	for moduleName, m := range c.Modules {
+		settings, err := loadModuleSettings(moduleName, m)
+		if err != nil {
+			return err
+		}
+		moduleSettings[moduleName] = settings
 	}
 
 	upstreams := make([]upstreamConfig, 0, len(c.Upstreams))
@@ -258,12 +560,43 @@ func (s *Server) loadConfig(c *Config, openLog bool) error {
 			return fmt.Errorf("upstream=%s must set modules or discover_modules", upstreamName)
 		}
 		addr := v.Address
-		if err := validateTCPOrUnixAddr(addr); err != nil {
+		var via *upstreamProxy
+		if v.Via != "" {
+			if strings.HasPrefix(addr, "/") {
+				return fmt.Errorf("upstream=%s: via cannot be used with a unix socket address", upstreamName)
+			}
+			var err error
+			via, err = parseUpstreamProxy(v.Via, v.ViaCredentialsFile)
+			if err != nil {
+				return fmt.Errorf("upstream=%s: invalid via: %w", upstreamName, err)
+			}
+		} else if err := validateTCPOrUnixAddr(addr); err != nil {
+			// Only the jump proxy may be able to resolve the address
 			return fmt.Errorf("resolve address: %w, upstream=%s, address=%s", err, upstreamName, addr)
 		}
+		credentials, err := loadUpstreamCredentials(v.CredentialsFile, v.CredentialsNetworks)
+		if err != nil {
+			return fmt.Errorf("upstream=%s: %w", upstreamName, err)
+		}
+		maxConnections, err := parseMaxConnectionsPolicy(v)
+		if err != nil {
+			return fmt.Errorf("upstream=%s: %w", upstreamName, err)
+		}
+		if v.MaxQueueWait < 0 {
+			return fmt.Errorf("upstream=%s: max_queue_wait must not be negative", upstreamName)
+		}
+		switch v.FairQueueing {
+		case "", clientKeyIP, clientKeySubnet:
+		default:
+			return fmt.Errorf("upstream=%s: invalid fair_queueing %q, expecting %s or %s", upstreamName, v.FairQueueing, clientKeyIP, clientKeySubnet)
+		}
+		priorityClasses, err := parsePriorityClasses(v)
+		if err != nil {
+			return fmt.Errorf("upstream=%s: %w", upstreamName, err)
+		}
 		upstreams = append(upstreams, upstreamConfig{
 			Name:            upstreamName,
-			Target:          Target{Upstream: upstreamName, Addr: addr, UseProxyProtocol: v.UseProxyProtocol},
+			Target:          Target{Upstream: upstreamName, Addr: addr, UseProxyProtocol: v.UseProxyProtocol, Via: via, Credentials: credentials, MaxConnections: maxConnections, MaxQueueWait: v.MaxQueueWait, FairQueueing: v.FairQueueing, PriorityClasses: priorityClasses},
 			Modules:         slices.Clone(v.Modules),
 			DiscoverModules: v.DiscoverModules,
 			MaxActiveConns:  v.MaxActiveConns,
@@ -290,6 +623,9 @@ func (s *Server) loadConfig(c *Config, openLog bool) error {
 	if s.TLSListenAddr == "" {
 		s.TLSListenAddr = c.Proxy.ListenTLS
 	}
+	if s.HTTPConnectListenAddr == "" {
+		s.HTTPConnectListenAddr = c.Proxy.ListenHTTPConnect
+	}
 	if s.HTTPListenAddr == "" {
 		s.HTTPListenAddr = c.Proxy.ListenHTTP
 	}
@@ -302,10 +638,39 @@ func (s *Server) loadConfig(c *Config, openLog bool) error {
 		}
 	}
 	s.Motd = c.Proxy.Motd
+	s.protocolNegotiation = protocolNegotiation
+	s.clientLimit = limit
+	s.rateLimits = rateLimits
+	s.connLimits = proxyLimits
+	s.hostsRules = globalHosts
+	s.listenerHostsRules = listenerHosts
 	s.modules = modules
 	s.upstreams = resolvedUpstreams
+	s.moduleSettings = moduleSettings
 	s.upstreamQueues = s.updateUpstreamQueuesLocked(resolvedUpstreams)
+	s.moduleQueues = s.updateModuleQueuesLocked(moduleSettings)
 	s.tlsCertificate = tlsCertificate
+	s.tlsConfig = tlsConfig
+	s.tlsSettings = tlsSettings
+	s.tlsFileStamp = tlsFileStamp
+	s.httpConnectAllowedHosts = httpConnectAllowedHosts
+	s.tlsExpiryWarned.Store(false)
+	s.checkTLSCertificateExpiry(tlsCertificate, tlsSettings.ExpiryWarning, time.Now())
+	if banFileChanged {
+		if err := s.bans.setFile(c.Proxy.BanFile, savedBans); err != nil {
+			log.Printf("[WARN] %v", err)
+			s.errorLog.F("[WARN] %v", err)
+		}
+	}
+	if s.cancelGreetingProbe != nil {
+		s.cancelGreetingProbe()
+		s.cancelGreetingProbe = nil
+	}
+	if openLog && protocolNegotiation == protocolNegotiationMin {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancelGreetingProbe = cancel
+		go s.probeUpstreamGreetings(ctx, resolvedUpstreams)
+	}
 	return nil
 }
 
@@ -337,6 +702,8 @@ func (s *Server) updateUpstreamQueuesLocked(upstreams []upstreamConfig) map[stri
 		} else {
 			q.SetMax(upstream.MaxActiveConns, upstream.MaxQueuedConns)
 		}
+		q.SetFair(upstream.Target.FairQueueing != "")
+		q.SetReserved(reservedSlots(upstream.Target.PriorityClasses))
 		queues[upstream.Name] = q
 	}
 	return queues
@@ -451,9 +818,7 @@ func (s *Server) discoverConfiguredModules(ctx context.Context, upstreams []upst
 }
 
 func (s *Server) discoverModulesFromUpstream(ctx context.Context, upstream upstreamConfig) ([]string, error) {
-	addr := upstream.Target.Addr
-	addr = addDefaultTCPPort(addr, defaultRsyncPortString)
-	conn, err := dialContextTCPOrUnix(ctx, s.dialer, addr)
+	conn, err := s.dialUpstream(ctx, upstream.Target)
 	if err != nil {
 		return nil, fmt.Errorf("dial: %w", err)
 	}
@@ -465,7 +830,7 @@ func (s *Server) discoverModulesFromUpstream(ctx context.Context, upstream upstr
 		}
 	}
 
-	reader := bufio.NewReaderSize(conn, ReadBufferSize)
+	reader := bufio.NewReader(conn)
 	if _, err := writeWithTimeout(conn, RsyncdServerVersion, s.WriteTimeout); err != nil {
 		return nil, fmt.Errorf("send version: %w", err)
 	}
@@ -477,9 +842,11 @@ func (s *Server) discoverModulesFromUpstream(ctx context.Context, upstream upstr
 	if err != nil {
 		return nil, fmt.Errorf("read version: %w", err)
 	}
-	if !bytes.HasPrefix([]byte(line), RsyncdVersionPrefix) {
+	greeting, err := parseRsyncdGreeting([]byte(line))
+	if err != nil {
 		return nil, fmt.Errorf("unexpected version response: %q", line)
 	}
+	s.recordUpstreamGreeting(upstream.Name, greeting)
 
 	if _, err := writeWithTimeout(conn, []byte{'\n'}, s.WriteTimeout); err != nil {
 		return nil, fmt.Errorf("request module list: %w", err)
@@ -547,12 +914,33 @@ func (s *Server) getTLSCertificate(*tls.ClientHelloInfo) (*tls.Certificate, erro
 	return s.tlsCertificate, nil
 }
 
-func (s *Server) listAllModules(downConn net.Conn) error {
+func (s *Server) tlsHandshake(ctx context.Context, conn *tls.Conn, info *ConnInfo) error {
+	if s.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ReadTimeout)
+		defer cancel()
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		s.tlsHandshakeErrors.Add(1)
+		return err
+	}
+	state := conn.ConnectionState()
+	info.SetTLSState(state)
+	s.getTLSHandshakeCounter(tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite)).Add(1)
+	return nil
+}
+
+// listAllModules sends the client at ip the modules that it may access.
+func (s *Server) listAllModules(downConn net.Conn, ip string) error {
 	var buf bytes.Buffer
 	modules := make([]string, 0, len(s.modules))
+	addr, addrErr := netip.ParseAddr(ip)
 
 	s.reloadLock.RLock()
 	for name := range s.modules {
+		if settings, ok := s.moduleSettings[name]; ok && addrErr == nil && !settings.hosts.allows(addr) {
+			continue
+		}
 		modules = append(modules, name)
 	}
 	timeout := s.WriteTimeout
@@ -568,7 +956,7 @@ func (s *Server) listAllModules(downConn net.Conn) error {
 	return err
 }
 
-func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn) error {
+func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn, kind listenerKind, handshake *handshakeGuard) error {
 	defer downConn.Close()
 
 	info := ConnInfo{
@@ -577,42 +965,99 @@ func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn) err
 		RemoteAddr:  downConn.RemoteAddr().String(),
 		ConnectedAt: time.Now().Truncate(time.Second),
 	}
+	s.setConnState(&info, connStateHandshake)
 	s.connInfo.Store(index, &info)
 	defer s.connInfo.Delete(index)
-
-	bufPtr := bufPool.Get().(*[]byte)
-	defer bufPool.Put(bufPtr)
-	buf := *bufPtr
+	defer s.finishConnState(&info)
 
 	addr := downConn.RemoteAddr().String()
 	ip := netAddrToString(downConn.RemoteAddr())
 
+	limit := s.getClientLimit()
+	limitKey, clientConns := s.countClientConn(ip, limit)
+	uncountClient := sync.OnceFunc(func() {
+		if limitKey != "" {
+			s.clientConns.done(limitKey)
+		}
+	})
+	defer uncountClient()
+
 	writeTimeout := s.WriteTimeout
 	readTimeout := s.ReadTimeout
 
-	n, err := readLine(downConn, buf, readTimeout)
+	if tlsConn, ok := downConn.(*tls.Conn); ok {
+		if err := s.tlsHandshake(ctx, tlsConn, &info); err != nil {
+			return fmt.Errorf("tls handshake with client %s: %w", addr, err)
+		}
+		snapshot := info.snapshot()
+		s.accessLog.F("client %s negotiated %s (cipher: %s, sni: %q)", ip, snapshot.TLSVersion, snapshot.TLSCipher, snapshot.TLSServerName)
+	}
+
+	if kind == listenerHTTPConnect {
+		conn, ok, err := s.acceptHTTPConnect(downConn, ip)
+		if err != nil {
+			return fmt.Errorf("http connect from client %s: %w", addr, err)
+		}
+		if !ok {
+			return nil
+		}
+		downConn = conn
+	}
+
+	// All reads from the client go through hc, so that nothing read ahead
+	// during the handshake is lost
+	hc := newHandshakeConn(downConn)
+	downConn = hc
+	line, err := hc.readLine(readTimeout)
 	if err != nil {
+		s.rejectHandshake(downConn, err)
 		return fmt.Errorf("read version from client %s: %w", addr, err)
 	}
-	rsyncdClientVersion := make([]byte, n)
-	copy(rsyncdClientVersion, buf[:n])
-	if !bytes.HasPrefix(rsyncdClientVersion, RsyncdVersionPrefix) {
-		return fmt.Errorf("unknown version from client %s: %q", addr, rsyncdClientVersion)
+	clientGreeting, err := parseRsyncdGreeting(line)
+	if err != nil {
+		return fmt.Errorf("unknown version from client %s: %q", addr, line)
 	}
+	info.SetClientGreeting(clientGreeting)
+	s.getClientProtocolCounter(clientGreeting.Protocol).Add(1)
 
-	_, err = writeWithTimeout(downConn, RsyncdServerVersion, writeTimeout)
+	serverGreeting := s.advertisedGreeting()
+	advertised, _ := parseRsyncdGreeting(serverGreeting)
+	_, err = writeWithTimeout(downConn, serverGreeting, writeTimeout)
 	if err != nil {
 		return fmt.Errorf("send version to client %s: %w", addr, err)
 	}
 
-	n, err = readLine(downConn, buf, readTimeout)
+	line, err = hc.readLine(readTimeout)
 	if err != nil {
+		s.rejectHandshake(downConn, err)
 		return fmt.Errorf("read module from client %s: %w", addr, err)
 	}
-	if n == 0 {
-		return fmt.Errorf("empty request from client %s", addr)
+	var earlyInput []byte
+	if bytes.HasPrefix(line, earlyInputPrefix) {
+		earlyInput, err = readEarlyInput(hc, line, readTimeout)
+		if errors.Is(err, errInvalidEarlyInput) {
+			s.accessLog.F("client %s sends invalid early input", ip)
+			_, _ = writeWithTimeout(downConn, []byte("@ERROR: invalid early_input length\n"), writeTimeout)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read early input from client %s: %w", addr, err)
+		}
+		line, err = hc.readLine(readTimeout)
+		if err != nil {
+			s.rejectHandshake(downConn, err)
+			return fmt.Errorf("read module from client %s: %w", addr, err)
+		}
+	}
+	data := bytes.Clone(line)
+	moduleName := string(data[:len(data)-1]) // trim trailing \n, empty for listing
+	if !s.checkHostsAccess(hc, ip, kind, moduleName) {
+		return nil
+	}
+	if limit.max > 0 && clientConns > limit.max {
+		s.rejectClientOverLimit(hc, ip, "", limit.max, uncountClient)
+		return nil
 	}
-	data := buf[:n]
 	if s.Motd != "" {
 		_, err = writeWithTimeout(downConn, []byte(s.Motd+"\n"), writeTimeout)
 		if err != nil {
@@ -621,11 +1066,12 @@ func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn) err
 	}
 
 	if len(data) == 1 { // single '\n'
-		s.accessLog.F("client %s requests listing all modules", addr)
-		return s.listAllModules(downConn)
+		s.accessLog.F("client %s requests listing all modules (protocol: %d, digests: %q)", addr, clientGreeting.Protocol, clientGreeting.Digests)
+		handshake.finish()
+		s.setConnState(&info, connStateListing)
+		return s.listAllModules(downConn, ip)
 	}
 
-	moduleName := string(buf[:n-1]) // trim trailing \n
 	info.SetModule(moduleName)
 
 	targets, ok := s.getTargetsForModule(moduleName)
@@ -640,100 +1086,62 @@ func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn) err
 		s.unknownModuleCount.Add(1)
 		_, _ = writeWithTimeout(downConn, fmt.Appendf(nil, "@ERROR: Unknown module '%s'\n", moduleName), writeTimeout)
 		s.accessLog.F("client %s requests non-existing module %s", ip, moduleName)
+		s.countUnknownModule(ip)
 		return nil
 	}
 
-	target := targets[chooseTargetByClientIP(net.ParseIP(ip), len(targets))]
-	upstreamAddr := target.Addr
-	useProxyProtocol := target.UseProxyProtocol
-	info.SetUpstream(target.Upstream)
-
-	upstreamQueue, ok := s.getQueueForUpstream(target.Upstream)
-	if !ok {
-		return fmt.Errorf("no queue configured for upstream %s", target.Upstream)
-	}
-
-	handle := upstreamQueue.Acquire()
-	defer handle.Release()
-	status := <-handle.C
-	if status.Full {
-		s.getUpstreamCounters(target.Upstream).queueFull.Add(1)
-		s.accessLog.F("client %s queue full for module %s", ip, moduleName)
-		_, _ = writeWithTimeout(downConn, []byte("Server queue is full for this upstream. Please retry later.\n"), writeTimeout)
-		_, _ = writeWithTimeout(downConn, RsyncdExit, writeTimeout)
-		return nil
+	settings := s.getModuleSettings(moduleName)
+	if settings.maxConnsPerClient > 0 && limitKey != "" {
+		key := moduleClientKey{module: moduleName, client: limitKey}
+		n := s.moduleClientConns.add(key)
+		uncountModuleClient := sync.OnceFunc(func() { s.moduleClientConns.done(key) })
+		defer uncountModuleClient()
+		if n > settings.maxConnsPerClient {
+			s.rejectClientOverLimit(hc, ip, moduleName, settings.maxConnsPerClient, uncountModuleClient)
+			return nil
+		}
 	}
-	if !status.Ok {
-		s.accessLog.F("client %s starts queueing for module %s", ip, moduleName)
-		// Queueing is isolated per upstream.
-		msg := fmt.Sprintf("Upstream %s has reached the maximum number of %d connections. Your request is being queued.\n", target.Upstream, upstreamQueue.GetMax())
-		msg += fmt.Sprintf("Your position: %d, Total queued: %d\n", status.Index+1, status.Max)
-		_, err = writeWithTimeout(downConn, []byte(msg), writeTimeout)
+	if settings.auth != nil {
+		user, ok, err := s.authenticateClient(hc, settings.auth, clientGreeting, advertised, moduleName, ip)
 		if err != nil {
-			return fmt.Errorf("send queue notice to client %s: %w", addr, err)
+			return fmt.Errorf("authenticate client %s: %w", addr, err)
 		}
-
-	queuing:
-		for !status.Ok {
-			select {
-			case status = <-handle.C:
-				if status.Ok {
-					break queuing
-				}
-			case <-time.After(1 * time.Minute):
-			}
-
-			msg := fmt.Sprintf("Your position: %d, Total queued: %d\n", status.Index+1, status.Max)
-			_, err = writeWithTimeout(downConn, []byte(msg), writeTimeout)
-			if err != nil {
-				return fmt.Errorf("send queue notice to client %s: %w", addr, err)
-			}
+		if !ok {
+			return nil
 		}
+		info.SetUser(user)
 	}
+	// The module request is accepted, waiting for the upstream is not part
+	// of the handshake
+	handshake.finish()
 
-	upConn, err := dialContextTCPOrUnix(ctx, s.dialer, upstreamAddr)
-	if err != nil {
-		s.getUpstreamCounters(target.Upstream).dialError.Add(1)
-		return fmt.Errorf("dial to upstream: %s: %w", upstreamAddr, err)
+	// Upstreams must speak the protocol version the client agreed on with us
+	upstreamGreeting := greetingForUpstream(clientGreeting, advertised)
+	first := chooseTargetByClientIP(net.ParseIP(ip), len(targets))
+	// Held across the retries on other upstreams, and released after the
+	// upstream slot
+	moduleSlot, ok, err := s.acquireModuleSlot(hc, &info, moduleName, ip, settings)
+	if err != nil || !ok {
+		return err
 	}
-	defer upConn.Close()
-	upAddr := netAddrToString(upConn.RemoteAddr())
-	if useProxyProtocol {
-		err := writeProxyProtocolHeader(upConn, downConn.RemoteAddr(), upConn.RemoteAddr(), s.WriteTimeout)
-		if err != nil {
-			return fmt.Errorf("send proxy protocol header to upstream %s: %w", upAddr, err)
-		}
+	if moduleSlot != nil {
+		defer moduleSlot.Release()
 	}
-
-	_, err = writeWithTimeout(upConn, rsyncdClientVersion, writeTimeout)
+	session, err := s.openUpstreamSessionWithRetries(ctx, hc, &info, ip, targets, first, moduleName, upstreamGreeting, earlyInput, settings)
 	if err != nil {
-		return fmt.Errorf("send version to upstream %s: %w", upAddr, err)
+		return err
 	}
-
-	n, err = readLine(upConn, buf, readTimeout)
-	if err != nil {
-		return fmt.Errorf("read version from upstream %s: %w", upAddr, err)
-	}
-	data = buf[:n]
-	if !bytes.HasPrefix(data, RsyncdVersionPrefix) {
-		return fmt.Errorf("unknown version from upstream %s: %s", upAddr, data)
-	}
-
-	// send back the motd
-	idx := bytes.IndexByte(data, lineFeed)
-	if idx+1 < n {
-		_, err = writeWithTimeout(downConn, data[idx+1:], writeTimeout)
-		if err != nil {
-			return fmt.Errorf("send motd to client %s: %w", ip, err)
-		}
+	if session == nil {
+		return nil
 	}
-
-	_, err = writeWithTimeout(upConn, []byte(moduleName+"\n"), writeTimeout)
-	if err != nil {
-		return fmt.Errorf("send module to upstream %s: %w", upAddr, err)
+	defer session.close()
+	if err := session.flush(downConn, writeTimeout); err != nil {
+		return fmt.Errorf("send module response to client %s: %w", addr, err)
 	}
-
-	s.accessLog.F("client %s starts requesting module %s", ip, moduleName)
+	target := session.target
+	upConn := session.conn
+	s.setConnState(&info, connStateRelaying)
+	relayStart := time.Now()
 
 	// reset read and write deadline for upConn and downConn
 	zeroTime := time.Time{}
@@ -743,13 +1151,27 @@ func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn) err
 	// Use countingReader to track bytes in real-time
 	// <sent> and <received> are relative to the client, not upstream
 	downReader := &countingReader{reader: downConn, counter: &info.ReceivedBytes}
-	upReader := &countingReader{reader: upConn, counter: &info.SentBytes}
+	upReader := &countingReader{reader: session.reader, counter: &info.SentBytes}
 
 	sentClosed := make(chan struct{})
 	receivedClosed := make(chan struct{})
 
+	argsRelay := &clientArgsRelay{
+		server:     s,
+		downConn:   downConn,
+		info:       &info,
+		ip:         ip,
+		moduleName: moduleName,
+		policy:     settings.args,
+		protocol:   session.protocol,
+		accepted:   session.accepted,
+	}
 	go func() {
-		_, err := io.Copy(upConn, downReader)
+		// The client's arguments are inspected before the rest is copied
+		rest, err := argsRelay.relay(upConn, downReader)
+		if rest != nil {
+			_, err = io.Copy(upConn, rest)
+		}
 		if err != nil {
 			s.errorLog.F("copy from downstream to upstream: %v", err)
 		}
@@ -764,11 +1186,13 @@ func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn) err
 	}()
 	select {
 	case <-receivedClosed:
+		s.setConnState(&info, connStateClosing)
 		if err := closeRead(upConn, true); err != nil {
 			s.errorLog.F("close upstream read: %v", err)
 		}
 		downConn.Close()
 	case <-sentClosed:
+		s.setConnState(&info, connStateClosing)
 		if err := closeRead(downConn, false); err != nil {
 			s.errorLog.F("close downstream read: %v", err)
 		}
@@ -784,6 +1208,12 @@ func (s *Server) relay(ctx context.Context, index uint32, downConn net.Conn) err
 	s.sentBytesTotal.Add(uint64(sentBytes))
 	s.recvBytesTotal.Add(uint64(receivedBytes))
 
+	relayDuration := time.Since(relayStart)
+	s.getUpstreamCounters(target.Upstream).relayDurations.add(relayDuration)
+	if moduleSlot != nil {
+		s.getModuleQueueCounters(moduleName).relayDurations.add(relayDuration)
+	}
+
 	mc := s.getModuleCounters(moduleName, target.Upstream)
 	mc.completed.Add(1)
 	mc.sentBytes.Add(uint64(sentBytes))
@@ -901,6 +1331,62 @@ func (s *Server) runHTTPServer() error {
 		_ = json.NewEncoder(w).Encode(&status)
 	})
 
+	mux.HandleFunc("/bans", func(w http.ResponseWriter, r *http.Request) {
+		writeError := func(statusCode int, message string) {
+			w.WriteHeader(statusCode)
+			_ = json.NewEncoder(w).Encode(struct {
+				Message string `json:"message"`
+			}{Message: message})
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			var result struct {
+				Count int   `json:"count"`
+				Bans  []Ban `json:"bans"`
+			}
+			result.Bans = s.ListBans()
+			result.Count = len(result.Bans)
+			_ = json.NewEncoder(w).Encode(&result)
+		case http.MethodPost:
+			var duration time.Duration
+			if v := r.FormValue("duration"); v != "" {
+				d, err := time.ParseDuration(v)
+				if err != nil || d <= 0 {
+					writeError(http.StatusBadRequest, "invalid duration value")
+					return
+				}
+				duration = d
+			}
+			ban, err := s.BanClient(r.FormValue("ip"), duration, r.FormValue("reason"))
+			if err != nil {
+				statusCode := http.StatusInternalServerError
+				if ban.IP == "" {
+					statusCode = http.StatusBadRequest
+				}
+				writeError(statusCode, err.Error())
+				return
+			}
+			_ = json.NewEncoder(w).Encode(&ban)
+		case http.MethodDelete:
+			removed, err := s.UnbanClient(r.FormValue("ip"))
+			switch {
+			case err != nil && !removed:
+				writeError(http.StatusBadRequest, err.Error())
+			case err != nil:
+				writeError(http.StatusInternalServerError, err.Error())
+			case !removed:
+				writeError(http.StatusNotFound, "client is not banned")
+			default:
+				_ = json.NewEncoder(w).Encode(struct {
+					Message string `json:"message"`
+				}{Message: "Successfully unbanned"})
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
 	mux.HandleFunc("/telegraf", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			w.WriteHeader(http.StatusMethodNotAllowed)
@@ -948,7 +1434,24 @@ func (s *Server) Listen() error {
 		}
 		s.TLSListenAddr = lTLS.Addr().String()
 		log.Printf("[INFO] Rsync TLS proxy listening on %s", s.TLSListenAddr)
-		lTLS = tls.NewListener(lTLS, &tls.Config{GetCertificate: s.getTLSCertificate})
+		lTLS = tls.NewListener(lTLS, &tls.Config{
+			GetCertificate:     s.getTLSCertificate,
+			GetConfigForClient: s.getTLSConfigForClient,
+		})
+	}
+
+	var lConnect net.Listener
+	if s.HTTPConnectListenAddr != "" {
+		lConnect, err = listenTCPOrUnix(s.HTTPConnectListenAddr)
+		if err != nil {
+			_ = l1.Close()
+			if lTLS != nil {
+				_ = lTLS.Close()
+			}
+			return fmt.Errorf("create http connect listener: %w", err)
+		}
+		s.HTTPConnectListenAddr = lConnect.Addr().String()
+		log.Printf("[INFO] Rsync HTTP CONNECT proxy listening on %s", s.HTTPConnectListenAddr)
 	}
 
 	l2, err := listenTCPOrUnix(s.HTTPListenAddr)
@@ -957,6 +1460,9 @@ func (s *Server) Listen() error {
 		if lTLS != nil {
 			_ = lTLS.Close()
 		}
+		if lConnect != nil {
+			_ = lConnect.Close()
+		}
 		return fmt.Errorf("create http listener: %w", err)
 	}
 	s.HTTPListenAddr = l2.Addr().String()
@@ -964,25 +1470,38 @@ func (s *Server) Listen() error {
 
 	s.TCPListener = l1
 	s.TLSListener = lTLS
+	s.HTTPConnectListener = lConnect
 	s.HTTPListener = l2
 	return nil
 }
 
 func (s *Server) Close() {
+	s.reloadLock.Lock()
+	if s.cancelGreetingProbe != nil {
+		s.cancelGreetingProbe()
+		s.cancelGreetingProbe = nil
+	}
+	s.reloadLock.Unlock()
 	if s.TCPListener != nil {
 		_ = s.TCPListener.Close()
 	}
 	if s.TLSListener != nil {
 		_ = s.TLSListener.Close()
 	}
+	if s.HTTPConnectListener != nil {
+		_ = s.HTTPConnectListener.Close()
+	}
 	if s.HTTPListener != nil {
 		_ = s.HTTPListener.Close()
 	}
+	s.flushBans()
 }
 
-func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
-	s.activeConnCount.Add(1)
+// handleConn serves a connection that acceptConn counted.
+func (s *Server) handleConn(ctx context.Context, conn net.Conn, kind listenerKind, limits connLimits) {
 	defer s.activeConnCount.Add(-1)
+	handshake := s.guardHandshake(conn, limits.handshakeTimeout)
+	defer handshake.finish()
 	s.acceptedConnCount.Add(1)
 	connIndex := s.connIndex.Add(1)
 
@@ -993,22 +1512,59 @@ func (s *Server) handleConn(ctx context.Context, conn net.Conn) {
 		}
 	}()
 
-	err := s.relay(ctx, connIndex, conn)
+	err := s.relay(ctx, connIndex, conn, kind, handshake)
 	if err != nil {
+		if handshake.expired() {
+			s.errorLog.F("handleConn: handshake with client %s timed out after %s", conn.RemoteAddr(), limits.handshakeTimeout)
+			return
+		}
 		s.errorLog.F("handleConn: %s", err)
 	}
 }
 
-func (s *Server) runRsyncServer(ctx context.Context, listener net.Listener, acceptErr string) error {
+// isTemporaryAcceptError reports whether accepting may succeed again after
+// err, e.g. once file descriptors are released after EMFILE.
+func isTemporaryAcceptError(err error) bool {
+	var ne net.Error
+	//nolint:staticcheck // Temporary is deprecated, but still how net/http tells accept errors to retry
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
+func (s *Server) runRsyncServer(ctx context.Context, listener net.Listener, kind listenerKind, acceptErr string) error {
+	var retryDelay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
 				return nil
 			}
-			return fmt.Errorf("%s: %w", acceptErr, err)
+			if !isTemporaryAcceptError(err) {
+				return fmt.Errorf("%s: %w", acceptErr, err)
+			}
+			s.acceptErrors[kind].Add(1)
+			retryDelay = min(max(2*retryDelay, minAcceptRetryDelay), maxAcceptRetryDelay)
+			log.Printf("[WARN] %s: %v; retrying in %s", acceptErr, err, retryDelay)
+			s.errorLog.F("[WARN] %s: %v; retrying in %s", acceptErr, err, retryDelay)
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return nil
+			}
+			continue
+		}
+		retryDelay = 0
+		// Banned and rate-limited clients are turned away before they are
+		// counted towards the limits
+		if !s.admitConn(netAddrToString(conn.RemoteAddr())) {
+			_ = conn.Close()
+			continue
+		}
+		limits := s.getConnLimits()
+		if !s.acceptConn(limits) {
+			_ = conn.Close()
+			continue
 		}
-		go s.handleConn(ctx, conn)
+		go s.handleConn(ctx, conn, kind, limits)
 	}
 }
 
@@ -1026,15 +1582,25 @@ func (s *Server) Run() error {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	go s.saveBansPeriodically(ctx)
 	go func() {
-		err := s.runRsyncServer(ctx, s.TCPListener, "accept rsync connection")
+		err := s.runRsyncServer(ctx, s.TCPListener, listenerPlain, "accept rsync connection")
 		if err != nil {
 			errC <- err
 		}
 	}()
 	if s.TLSListener != nil {
 		go func() {
-			err := s.runRsyncServer(ctx, s.TLSListener, "accept tls rsync connection")
+			err := s.runRsyncServer(ctx, s.TLSListener, listenerTLS, "accept tls rsync connection")
+			if err != nil {
+				errC <- err
+			}
+		}()
+		go s.watchTLSCertificate(ctx)
+	}
+	if s.HTTPConnectListener != nil {
+		go func() {
+			err := s.runRsyncServer(ctx, s.HTTPConnectListener, listenerHTTPConnect, "accept http connect rsync connection")
 			if err != nil {
 				errC <- err
 			}
@@ -1,18 +1,24 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -21,6 +27,7 @@ import (
 
 	"github.com/ustclug/rsync-proxy/pkg/queue"
 	"github.com/ustclug/rsync-proxy/test/fake/rsync"
+	"github.com/ustclug/rsync-proxy/test/fake/tunnel"
 )
 
 func setupAccessLog(t *testing.T, srv *Server) string {
@@ -381,6 +388,67 @@ func TestStatusIncludesSelectedUpstream(t *testing.T) {
 	wg.Done()
 }
 
+func TestClientGreetingIsRecorded(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		require.NoError(t, err)
+		wg.Wait()
+	})
+	fakeRsync.Start()
+	defer fakeRsync.Close()
+
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+	rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	conn := rsync.NewConn(rawConn)
+	defer conn.Close()
+
+	_, err = doClientHandshake(conn, []byte("@RSYNCD: 29.0 sha1 md5\n"), "fake")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		infos := srv.ListConnectionInfo()
+		return len(infos) == 1 && infos[0].snapshot().Upstream == "u1"
+	}, time.Second, 10*time.Millisecond)
+
+	resp, err := testHTTPClient().Get("http://" + srv.HTTPListener.Addr().String() + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var status struct {
+		Connections []connInfoSnapshot `json:"connections"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Len(t, status.Connections, 1)
+	assert.Equal(t, 29, status.Connections[0].ClientProtocol)
+	assert.Equal(t, []string{"sha1", "md5"}, status.Connections[0].ClientDigests)
+
+	resp, err = testHTTPClient().Get("http://" + srv.HTTPListener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "rsync_proxy_client_protocol_connections_total{protocol=\"29\"} 1\n")
+
+	wg.Done()
+}
+
+func TestClientProtocolLabel(t *testing.T) {
+	assert.Equal(t, "31", clientProtocolLabel(31))
+	assert.Equal(t, "0", clientProtocolLabel(0))
+	assert.Equal(t, "other", clientProtocolLabel(-1))
+	assert.Equal(t, "other", clientProtocolLabel(1000))
+}
+
 func TestMetricsEndpointNoConnections(t *testing.T) {
 	srv := startServer(t)
 	defer srv.Close()
@@ -764,6 +832,100 @@ func TestPrometheusLabelValueEscaping(t *testing.T) {
 	assert.Equal(t, `unknown`, prometheusLabelValueOrUnknown(""))
 }
 
+func TestConnectionLifecycleState(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	release := make(chan struct{})
+	var started atomic.Int32
+	fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		require.NoError(t, err)
+		if started.Add(1) == 1 {
+			<-release
+			return
+		}
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	fakeRsync.Start()
+	defer fakeRsync.Close()
+
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(1, 0)}
+
+	stateOf := func(remote string) (connInfoSnapshot, bool) {
+		for _, info := range srv.ListConnectionInfo() {
+			if snapshot := info.snapshot(); snapshot.RemoteAddr == remote {
+				return snapshot, true
+			}
+		}
+		return connInfoSnapshot{}, false
+	}
+
+	client1Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client1 := rsync.NewConn(client1Raw)
+	defer client1.Close()
+	_, err = doClientHandshake(client1, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		snapshot, ok := stateOf(client1Raw.LocalAddr().String())
+		return ok && snapshot.State == connStateRelaying
+	}, time.Second, 10*time.Millisecond)
+
+	client2Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client2 := rsync.NewConn(client2Raw)
+	defer client2.Close()
+	_, err = doClientHandshake(client2, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	_, err = client2.ReadLine()
+	require.NoError(t, err)
+	_, err = client2.ReadLine()
+	require.NoError(t, err)
+
+	snapshot, ok := stateOf(client2Raw.LocalAddr().String())
+	require.True(t, ok)
+	assert.Equal(t, connStateQueued, snapshot.State)
+	assert.Equal(t, 1, snapshot.QueuePosition)
+	assert.Equal(t, 1, snapshot.QueueLength)
+
+	resp, err := testHTTPClient().Get("http://" + srv.HTTPListener.Addr().String() + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), `"state":"queued"`)
+	assert.Contains(t, string(body), `"queuePosition":1`)
+
+	close(release)
+	require.Eventually(t, func() bool {
+		snapshot, ok = stateOf(client2Raw.LocalAddr().String())
+		_, ok1 := stateOf(client1Raw.LocalAddr().String())
+		return ok && !ok1 && snapshot.State == connStateRelaying
+	}, time.Second, 10*time.Millisecond)
+	var states []connState
+	for _, transition := range snapshot.Transitions {
+		states = append(states, transition.State)
+	}
+	assert.Equal(t, []connState{connStateHandshake, connStateQueued, connStateDialing, connStateRelaying}, states)
+	assert.Zero(t, snapshot.QueuePosition)
+
+	resp, err = testHTTPClient().Get("http://" + srv.HTTPListener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	text := string(body)
+	assert.Contains(t, text, "rsync_proxy_connections_by_state{state=\"relaying\"} 1\n")
+	assert.Contains(t, text, "rsync_proxy_connections_by_state{state=\"queued\"} 0\n")
+	assert.Contains(t, text, "rsync_proxy_connection_state_duration_seconds_count{state=\"queued\"} 1\n")
+	assert.Contains(t, text, "rsync_proxy_connection_state_duration_seconds_count{state=\"closing\"} 1\n")
+}
+
 func TestPerUpstreamQueueIsolation(t *testing.T) {
 	srv := startServer(t)
 	defer srv.Close()
@@ -853,6 +1015,84 @@ func TestPerUpstreamQueueIsolation(t *testing.T) {
 	}, time.Second, 10*time.Millisecond)
 }
 
+func TestPerModuleQueue(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	var (
+		release sync.WaitGroup
+		started atomic.Int32
+	)
+	release.Add(1)
+
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		require.NoError(t, err)
+		started.Add(1)
+		release.Wait()
+	})
+	upstream.Start()
+	defer upstream.Close()
+
+	srv.modules = map[string][]Target{
+		"big":   {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
+		"small": {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
+	}
+	upstreamQueue := queue.New(2, 2)
+	moduleQueue := queue.New(1, 1)
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": upstreamQueue}
+	srv.moduleQueues = map[string]*queue.Queue{"big": moduleQueue}
+
+	dial := func(module string) *rsync.Conn {
+		raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		require.NoError(t, err)
+		conn := rsync.NewConn(raw)
+		t.Cleanup(func() { _ = conn.Close() })
+		_, err = doClientHandshake(conn, RsyncdServerVersion, module)
+		require.NoError(t, err)
+		return conn
+	}
+
+	dial("big")
+	require.Eventually(t, func() bool {
+		return started.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Queued for the module without taking a slot of the upstream
+	client2 := dial("big")
+	queuedLine, err := client2.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "Module big has reached the maximum number of 1 connections. Your request is being queued.\n", queuedLine)
+	queuedPos, err := client2.ReadLine()
+	require.NoError(t, err)
+	assert.Contains(t, queuedPos, "Your position: 1, Total queued: 1")
+	assert.Equal(t, 1, upstreamQueue.ActiveLen())
+
+	client3 := dial("big")
+	line, err := client3.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "Server queue is full for this module. Please retry later.\n", line)
+
+	// Other modules of the upstream are still served
+	dial("small")
+	require.Eventually(t, func() bool {
+		return started.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+
+	var buf bytes.Buffer
+	srv.writePrometheusMetrics(&buf, time.Now())
+	metrics := buf.String()
+	assert.Contains(t, metrics, `rsync_proxy_module_active_connections{module="big"} 1`)
+	assert.Contains(t, metrics, `rsync_proxy_module_queued_connections{module="big"} 1`)
+	assert.Contains(t, metrics, `rsync_proxy_module_queue_full_rejected_total{module="big"} 1`)
+
+	release.Done()
+	require.Eventually(t, func() bool {
+		return started.Load() == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
 func TestQueueFullRejectsConnection(t *testing.T) {
 	srv := startServer(t)
 	defer srv.Close()
@@ -873,7 +1113,8 @@ func TestQueueFullRejectsConnection(t *testing.T) {
 	srv.modules = map[string][]Target{
 		"fake": {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
 	}
-	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(1, 1)}
+	q := queue.New(1, 1)
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": q}
 
 	client1Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
 	require.NoError(t, err)
@@ -881,6 +1122,9 @@ func TestQueueFullRejectsConnection(t *testing.T) {
 	defer client1.Close()
 	_, err = doClientHandshake(client1, RsyncdServerVersion, "fake")
 	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return q.ActiveLen() == 1
+	}, time.Second, 10*time.Millisecond)
 
 	client2Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
 	require.NoError(t, err)
@@ -916,224 +1160,2562 @@ func TestQueueFullRejectsConnection(t *testing.T) {
 	assert.Contains(t, string(logData), "queue full for module fake")
 }
 
-func TestStartupFailsWhenModuleDiscoveryFails(t *testing.T) {
-	srv := New()
-	srv.ReadTimeout = time.Second
-	srv.WriteTimeout = time.Second
+func TestQueueFullDisplacesLowerPriority(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
+
+	var release sync.WaitGroup
+	release.Add(1)
+	defer release.Done()
 
 	upstream := rsync.NewServer(func(conn *rsync.Conn) {
 		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		require.NoError(t, err)
+		release.Wait()
 	})
 	upstream.Start()
 	defer upstream.Close()
 
-	configContent := `
-[upstreams.u1]
-address = "` + upstream.Listener.Addr().String() + `"
-discover_modules = true
-`
-	err := srv.ReadConfig(strings.NewReader(configContent), true)
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "discover modules from upstream")
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
+	}
+	q := queue.New(1, 1)
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": q}
+
+	client1Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client1 := rsync.NewConn(client1Raw)
+	defer client1.Close()
+	_, err = doClientHandshake(client1, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return q.ActiveLen() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	client2Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client2 := rsync.NewConn(client2Raw)
+	defer client2.Close()
+	_, err = doClientHandshake(client2, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	_, err = client2.ReadLine()
+	require.NoError(t, err)
+	_, err = client2.ReadLine()
+	require.NoError(t, err)
+
+	// A client of a higher priority takes the place of the queued one
+	h := q.AcquireClient(queue.Client{Priority: 10})
+	defer h.Release()
+	require.NoError(t, client2Raw.SetReadDeadline(time.Now().Add(5*time.Second)))
+	var line string
+	for {
+		line, err = client2.ReadLine()
+		require.NoError(t, err)
+		if !strings.HasPrefix(line, "Your position") {
+			break
+		}
+	}
+	assert.Contains(t, line, "Server queue is full")
+	exit, err := client2.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, string(RsyncdExit), exit)
+	assert.EqualValues(t, 1, srv.getUpstreamCounters("u1").queueFull.Load())
+
+	logData, err := os.ReadFile(accessLogPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(logData), "queue full for module fake")
 }
 
-func TestReloadKeepsPreviousModulesWhenDiscoveryFails(t *testing.T) {
-	dir := t.TempDir()
-	configPath := filepath.Join(dir, "config.toml")
+func TestQueuedClientDisconnectReleasesPlace(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
 
-	firstUpstream := rsync.NewModuleListServer([]string{"foo"})
-	firstUpstream.Start()
-	defer firstUpstream.Close()
+	var release sync.WaitGroup
+	release.Add(1)
+	defer release.Done()
 
-	secondUpstream := rsync.NewServer(func(conn *rsync.Conn) {
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
 		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		require.NoError(t, err)
+		release.Wait()
 	})
-	secondUpstream.Start()
-	defer secondUpstream.Close()
-
-	writeConfig := func(addr string) {
-		configContent := fmt.Sprintf(`
-[proxy]
-listen = "127.0.0.1:0"
-listen_http = "127.0.0.1:0"
+	upstream.Start()
+	defer upstream.Close()
 
-[upstreams.u1]
-address = %q
-discover_modules = true
-`, addr)
-		require.NoError(t, os.WriteFile(configPath, []byte(configContent), 0600))
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
 	}
+	q := queue.New(1, 0)
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": q}
 
-	writeConfig(firstUpstream.Listener.Addr().String())
-	srv := New()
-	srv.ConfigPath = configPath
-	srv.ReadTimeout = time.Second
-	srv.WriteTimeout = time.Second
-	require.NoError(t, srv.ReadConfigFromFile(true))
-	require.Contains(t, srv.modules, "foo")
-
-	writeConfig(secondUpstream.Listener.Addr().String())
-	err := srv.ReadConfigFromFile(true)
-	require.Error(t, err)
+	client1Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client1 := rsync.NewConn(client1Raw)
+	defer client1.Close()
+	_, err = doClientHandshake(client1, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return q.ActiveLen() == 1
+	}, time.Second, 10*time.Millisecond)
 
-	srv.reloadLock.RLock()
-	defer srv.reloadLock.RUnlock()
-	_, hasFoo := srv.modules["foo"]
-	_, hasBar := srv.modules["bar"]
-	assert.True(t, hasFoo)
-	assert.False(t, hasBar)
-}
+	client2Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client2 := rsync.NewConn(client2Raw)
+	_ = client2Raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = doClientHandshake(client2, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	_, err = client2.ReadLine()
+	require.NoError(t, err)
+	_, err = client2.ReadLine()
+	require.NoError(t, err)
 
-func TestListUpstreamModules(t *testing.T) {
-	srv := New()
-	srv.reloadLock.Lock()
-	srv.upstreams = []upstreamConfig{
-		{Name: "u1", Modules: []string{"foo", "bar"}},
-		{Name: "u2", Modules: []string{"baz"}},
-	}
-	srv.reloadLock.Unlock()
+	client3Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client3 := rsync.NewConn(client3Raw)
+	defer client3.Close()
+	_ = client3Raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = doClientHandshake(client3, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	_, err = client3.ReadLine()
+	require.NoError(t, err)
+	line, err := client3.ReadLine()
+	require.NoError(t, err)
+	assert.Contains(t, line, "Your position: 2, Total queued: 2")
 
-	modules, err := srv.ListUpstreamModules("u1", false)
+	require.NoError(t, client2.Close())
+
+	_ = client3Raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err = client3.ReadLine()
 	require.NoError(t, err)
-	assert.Equal(t, []string{"bar", "foo"}, modules)
+	assert.Contains(t, line, "Your position: 1, Total queued: 1")
+	assert.Equal(t, 1, q.QueuedLen())
 
-	_, err = srv.ListUpstreamModules("missing", false)
-	require.Error(t, err)
-	assert.Contains(t, err.Error(), "unknown upstream")
+	logData, err := os.ReadFile(accessLogPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(logData), "leaves the queue for module fake")
 }
 
-func TestListUpstreamModulesForceDiscover(t *testing.T) {
-	upstream := rsync.NewModuleListServer([]string{"bar", "foo"})
+func TestMaxQueueWait(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
+
+	var release sync.WaitGroup
+	release.Add(1)
+	defer release.Done()
+
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		require.NoError(t, err)
+		release.Wait()
+	})
 	upstream.Start()
 	defer upstream.Close()
 
-	srv := New()
-	srv.ReadTimeout = time.Second
-	srv.WriteTimeout = time.Second
-	srv.reloadLock.Lock()
-	srv.upstreams = []upstreamConfig{
-		{
-			Name:            "u1",
-			Target:          Target{Upstream: "u1", Addr: upstream.Listener.Addr().String()},
-			Modules:         []string{"stale"},
-			DiscoverModules: false,
-		},
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: upstream.Listener.Addr().String(), MaxQueueWait: 200 * time.Millisecond}},
 	}
-	srv.reloadLock.Unlock()
+	q := queue.New(1, 0)
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": q}
+	srv.getUpstreamCounters("u1").relayDurations.add(90 * time.Second)
 
-	modules, err := srv.ListUpstreamModules("u1", true)
+	client1Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
 	require.NoError(t, err)
-	assert.Equal(t, []string{"bar", "foo"}, modules)
-}
+	client1 := rsync.NewConn(client1Raw)
+	defer client1.Close()
+	_, err = doClientHandshake(client1, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return q.ActiveLen() == 1
+	}, time.Second, 10*time.Millisecond)
 
-func TestDiscoverModules(t *testing.T) {
-	upstream := rsync.NewModuleListServer([]string{"bar", "foo"})
-	upstream.Start()
-	defer upstream.Close()
+	client2Raw, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	client2 := rsync.NewConn(client2Raw)
+	defer client2.Close()
+	_ = client2Raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = doClientHandshake(client2, RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	_, err = client2.ReadLine()
+	require.NoError(t, err)
+	line, err := client2.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "Your position: 1, Total queued: 1, Estimated wait: 1m30s\n", line)
 
-	srv := New()
-	srv.ReadTimeout = time.Second
-	srv.WriteTimeout = time.Second
+	line, err = client2.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "@ERROR: max queue wait (200ms) exceeded for upstream u1, please retry later\n", line)
+	require.Eventually(t, func() bool {
+		return q.QueuedLen() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 1, srv.getUpstreamCounters("u1").queueTimeout.Load())
 
-	modules, err := srv.DiscoverModules(upstream.Listener.Addr().String())
+	logData, err := os.ReadFile(accessLogPath)
 	require.NoError(t, err)
-	assert.Equal(t, []string{"bar", "foo"}, modules)
+	assert.Contains(t, string(logData), "waited too long in the queue for module fake")
 }
 
-func TestDiscoverModulesWithProxyProtocol(t *testing.T) {
-	upstream := rsync.NewModuleListServerWithProxyProtocol([]string{"bar", "foo"})
-	upstream.Start()
-	defer upstream.Close()
+func TestClientKey(t *testing.T) {
+	assert.Equal(t, "", clientKey("", "192.0.2.1"))
+	assert.Equal(t, "192.0.2.1", clientKey(clientKeyIP, "192.0.2.1"))
+	assert.Equal(t, "192.0.2.1", clientKey(clientKeyIP, "::ffff:192.0.2.1"))
+	assert.Equal(t, "192.0.2.0/24", clientKey(clientKeySubnet, "192.0.2.1"))
+	assert.Equal(t, "2001:db8:1:2::/64", clientKey(clientKeySubnet, "2001:db8:1:2:3::4"))
+	assert.Equal(t, "/run/rsync.sock", clientKey(clientKeySubnet, "/run/rsync.sock"))
+}
 
-	srv := New()
-	srv.ReadTimeout = time.Second
-	srv.WriteTimeout = time.Second
+func TestQueueClient(t *testing.T) {
+	target := Target{
+		FairQueueing: clientKeyIP,
+		PriorityClasses: []priorityClass{
+			{Name: "mirrors", Networks: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, Priority: 10},
+			{Name: "any", Networks: []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}, Priority: 1},
+		},
+	}
+	assert.Equal(t, queue.Client{Key: "192.0.2.1", Priority: 10, Class: "mirrors"}, queueClient(target, "192.0.2.1"))
+	assert.Equal(t, queue.Client{Key: "192.0.2.1", Priority: 10, Class: "mirrors"}, queueClient(target, "::ffff:192.0.2.1"))
+	assert.Equal(t, queue.Client{Key: "198.51.100.1", Priority: 1, Class: "any"}, queueClient(target, "198.51.100.1"))
+	assert.Equal(t, queue.Client{Key: "2001:db8::1"}, queueClient(target, "2001:db8::1"))
+}
 
-	modules, err := srv.DiscoverModulesWithProxyProtocol(upstream.Listener.Addr().String(), true)
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	limit := rateLimit{burst: 2, period: 2 * time.Second}
+	now := time.Now()
+	assert.True(t, l.allow("a", limit, now))
+	assert.True(t, l.allow("a", limit, now))
+	assert.False(t, l.allow("a", limit, now))
+	assert.True(t, l.allow("b", limit, now))
+	assert.True(t, l.allow("a", rateLimit{}, now), "no limit")
+
+	// One token is regained every second
+	now = now.Add(time.Second)
+	assert.True(t, l.allow("a", limit, now))
+	assert.False(t, l.allow("a", limit, now))
+
+	// Full buckets are dropped
+	l.sweep(limit, now.Add(time.Second))
+	assert.Contains(t, l.buckets, "a")
+	l.sweep(limit, now.Add(2*time.Second))
+	assert.Empty(t, l.buckets)
+}
+
+func TestBansPersistAcrossRestarts(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	config := fmt.Sprintf(`
+[proxy]
+ban_duration = "1h"
+ban_file = %q
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`, banFile)
+
+	s := New()
+	require.NoError(t, s.ReadConfig(strings.NewReader(config), false))
+	ban, err := s.BanClient("::ffff:192.0.2.1", 0, "")
 	require.NoError(t, err)
-	assert.Equal(t, []string{"bar", "foo"}, modules)
+	assert.Equal(t, "192.0.2.1", ban.IP)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), ban.Until, time.Minute)
+	_, err = s.BanClient("2001:db8::1", time.Minute, "test")
+	require.NoError(t, err)
+	_, err = s.BanClient("example.com", time.Minute, "")
+	assert.ErrorContains(t, err, "invalid address")
+
+	s = New()
+	require.NoError(t, s.ReadConfig(strings.NewReader(config), false))
+	bans := s.ListBans()
+	require.Len(t, bans, 2)
+	assert.Equal(t, "192.0.2.1", bans[0].IP)
+	assert.Equal(t, "banned manually", bans[0].Reason)
+	assert.Equal(t, "2001:db8::1", bans[1].IP)
+	assert.Equal(t, "test", bans[1].Reason)
+
+	removed, err := s.UnbanClient("2001:db8::1")
+	require.NoError(t, err)
+	assert.True(t, removed)
+	removed, err = s.UnbanClient("2001:db8::1")
+	require.NoError(t, err)
+	assert.False(t, removed)
+
+	s = New()
+	require.NoError(t, s.ReadConfig(strings.NewReader(config), false))
+	bans = s.ListBans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "192.0.2.1", bans[0].IP)
 }
 
-func TestDiscoverModulesFromProxyStyleListing(t *testing.T) {
-	upstream := rsync.NewServer(func(conn *rsync.Conn) {
-		defer conn.Close()
+func TestBanListFlush(t *testing.T) {
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	var l banList
+	require.NoError(t, l.setFile(banFile, nil))
+	now := time.Now()
 
-		line, err := conn.ReadLine()
+	readSaved := func() []Ban {
+		bans, err := readBanFile(banFile, now)
 		require.NoError(t, err)
-		require.Equal(t, string(RsyncdServerVersion), line)
+		return bans
+	}
+	l.add(Ban{IP: "192.0.2.1", Until: now.Add(time.Hour)})
+	assert.Empty(t, readSaved(), "bans must only be saved by flush")
+	require.NoError(t, l.flush())
+	assert.Len(t, readSaved(), 1)
+
+	// Nothing changed, the file is left alone
+	require.NoError(t, os.Remove(banFile))
+	require.NoError(t, l.flush())
+	assert.NoFileExists(t, banFile)
+
+	assert.True(t, l.remove("192.0.2.1", now))
+	require.NoError(t, l.flush())
+	assert.Empty(t, readSaved())
+	assert.FileExists(t, banFile)
+}
 
-		_, err = conn.Write(RsyncdServerVersion)
-		require.NoError(t, err)
+func TestConnCounter(t *testing.T) {
+	var c connCounter[string]
+	assert.Equal(t, 1, c.add("a"))
+	assert.Equal(t, 2, c.add("a"))
+	assert.Equal(t, 1, c.add("b"))
+	c.done("a")
+	c.done("a")
+	assert.NotContains(t, c.counts, "a")
+	assert.Equal(t, 1, c.add("a"))
+}
 
-		line, err = conn.ReadLine()
-		require.NoError(t, err)
-		require.Equal(t, "\n", line)
+func TestQueueDeadlines(t *testing.T) {
+	now := time.Now()
+	u1 := waitingQueue{kind: queueKindUpstream, name: "u1", maxWait: time.Minute}
+	u2 := waitingQueue{kind: queueKindUpstream, name: "u2", maxWait: time.Minute}
 
-		_, err = conn.Write([]byte("Served by rsync-proxy\n\nfoo\nbar\n@RSYNCD: EXIT\n"))
+	var once queueDeadlines
+	assert.Equal(t, now.Add(time.Minute), once.deadline(u1, now))
+
+	d := queueDeadlines{}
+	assert.Equal(t, now.Add(time.Minute), d.deadline(u1, now))
+	// Requeued for the same upstream later
+	assert.Equal(t, now.Add(time.Minute), d.deadline(u1, now.Add(30*time.Second)))
+	assert.Equal(t, now.Add(90*time.Second), d.deadline(u2, now.Add(30*time.Second)))
+}
+
+func TestEstimateQueueWait(t *testing.T) {
+	var r relayDurations
+	_, ok := r.mean()
+	assert.False(t, ok)
+	for i := 1; i <= relayDurationSamples+2; i++ {
+		r.add(time.Duration(i) * time.Second)
+	}
+	// The two oldest samples were dropped
+	mean, ok := r.mean()
+	require.True(t, ok)
+	assert.Equal(t, time.Duration(relayDurationSamples+5)*time.Second/2, mean)
+
+	assert.Equal(t, time.Minute, estimateQueueWait(time.Minute, 1, 4))
+	assert.Equal(t, time.Minute, estimateQueueWait(time.Minute, 4, 4))
+	assert.Equal(t, 2*time.Minute, estimateQueueWait(time.Minute, 5, 4))
+	assert.Equal(t, 3*time.Minute, estimateQueueWait(time.Minute, 3, 0))
+}
+
+func TestClientConnectionLimit(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
+
+	release := make(chan struct{})
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
 		require.NoError(t, err)
+		<-release
 	})
 	upstream.Start()
 	defer upstream.Close()
 
-	srv := New()
-	srv.ReadTimeout = time.Second
-	srv.WriteTimeout = time.Second
+	srv.reloadLock.Lock()
+	srv.modules = map[string][]Target{
+		"fake":  {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
+		"other": {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+	srv.moduleSettings = map[string]*moduleSettings{
+		"fake": {maxConnsPerClient: 1},
+	}
+	srv.clientLimit = clientLimit{max: 2, scope: clientKeyIP}
+	srv.reloadLock.Unlock()
 
-	modules, err := srv.DiscoverModules(upstream.Listener.Addr().String())
+	connect := func(module string) (net.Conn, *rsync.Conn) {
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		require.NoError(t, err)
+		conn := rsync.NewConn(rawConn)
+		_, err = doClientHandshake(conn, RsyncdServerVersion, module)
+		require.NoError(t, err)
+		return rawConn, conn
+	}
+	// Connections counted for the client globally and for the module
+	counts := func() (int, int) {
+		srv.clientConns.mu.Lock()
+		defer srv.clientConns.mu.Unlock()
+		srv.moduleClientConns.mu.Lock()
+		defer srv.moduleClientConns.mu.Unlock()
+		return srv.clientConns.counts["127.0.0.1"], srv.moduleClientConns.counts[moduleClientKey{module: "fake", client: "127.0.0.1"}]
+	}
+	waitCounts := func(global, module int) {
+		require.Eventually(t, func() bool {
+			g, m := counts()
+			return g == global && m == module
+		}, time.Second, 10*time.Millisecond)
+	}
+	expectRejected := func(rawConn net.Conn, conn *rsync.Conn, limit int) {
+		defer conn.Close()
+		_ = rawConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := conn.ReadLine()
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("@ERROR: max connections per client (%d) reached -- try again later\n", limit), line)
+	}
+
+	_, client1 := connect("fake")
+	defer client1.Close()
+	require.Eventually(t, func() bool {
+		return srv.GetActiveConnectionCount() == 1 && len(srv.ListConnectionInfo()) == 1 &&
+			srv.ListConnectionInfo()[0].snapshot().State == connStateRelaying
+	}, time.Second, 10*time.Millisecond)
+
+	waitCounts(1, 1)
+
+	// Over the limit of the module, but not the global one. The rejected
+	// connection is no longer counted once the client is told
+	rawConn, conn := connect("fake")
+	expectRejected(rawConn, conn, 1)
+	g, m := counts()
+	assert.Equal(t, 1, g)
+	assert.Equal(t, 1, m)
+	_, client2 := connect("other")
+	defer client2.Close()
+	waitCounts(2, 1)
+
+	// Over the global limit
+	rawConn, conn = connect("other")
+	expectRejected(rawConn, conn, 2)
+	g, _ = counts()
+	assert.Equal(t, 2, g)
+	assert.EqualValues(t, 2, srv.clientLimitRejected.Load())
+
+	// Connections are no longer counted once they finish
+	close(release)
+	waitCounts(0, 0)
+	srv.clientConns.mu.Lock()
+	assert.Empty(t, srv.clientConns.counts)
+	srv.clientConns.mu.Unlock()
+	srv.moduleClientConns.mu.Lock()
+	assert.Empty(t, srv.moduleClientConns.counts)
+	srv.moduleClientConns.mu.Unlock()
+
+	logData, err := os.ReadFile(accessLogPath)
 	require.NoError(t, err)
-	assert.Equal(t, []string{"bar", "foo"}, modules)
+	assert.Contains(t, string(logData), "reaches the connection limit (1) for module fake")
+	assert.Contains(t, string(logData), "reaches the connection limit (2)\n")
 }
 
-func TestDiscoverModulesFromTrailingModuleBlock(t *testing.T) {
-	upstream := rsync.NewServer(func(conn *rsync.Conn) {
-		defer conn.Close()
+// flakyListener fails to accept with the errors queued in errs first.
+type flakyListener struct {
+	net.Listener
+	errs chan error
+}
 
-		line, err := conn.ReadLine()
-		require.NoError(t, err)
-		require.Equal(t, string(RsyncdServerVersion), line)
+func (l *flakyListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+		return l.Listener.Accept()
+	}
+}
 
-		_, err = conn.Write(RsyncdServerVersion)
+func TestRetryTemporaryAcceptErrors(t *testing.T) {
+	srv := New()
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	serve := func(errs ...error) (*flakyListener, <-chan error) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
 		require.NoError(t, err)
+		fl := &flakyListener{Listener: l, errs: make(chan error, len(errs))}
+		for _, err := range errs {
+			fl.errs <- err
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- srv.runRsyncServer(context.Background(), fl, listenerPlain, "accept rsync connection")
+		}()
+		return fl, done
+	}
 
-		line, err = conn.ReadLine()
-		require.NoError(t, err)
-		require.Equal(t, "\n", line)
+	l, done := serve(emfile, emfile, emfile)
+	rawConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn := rsync.NewConn(rawConn)
+	_, err = doClientHandshake(conn, RsyncdServerVersion, "")
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	assert.EqualValues(t, 3, srv.acceptErrors[listenerPlain].Load())
+	require.NoError(t, l.Close())
+	require.NoError(t, <-done)
+
+	l, done = serve(emfile, errors.New("boom"))
+	defer l.Close()
+	err = <-done
+	assert.ErrorContains(t, err, "accept rsync connection: boom")
+	assert.EqualValues(t, 4, srv.acceptErrors[listenerPlain].Load())
+}
 
-		_, err = conn.Write([]byte("Welcome to upstream\nMirror notice\n\nfoo comment\nbar\n@RSYNCD: EXIT\n"))
+func TestMaxConnections(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	srv.reloadLock.Lock()
+	srv.connLimits = connLimits{maxConns: 1}
+	srv.reloadLock.Unlock()
+
+	// Connected, but not sending anything yet
+	client1, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer client1.Close()
+	require.Eventually(t, func() bool {
+		return len(srv.ListConnectionInfo()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	client2, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer client2.Close()
+	_ = client2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client2.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.EqualValues(t, 1, srv.maxConnsRejected.Load())
+	assert.EqualValues(t, 1, srv.GetActiveConnectionCount())
+	assert.EqualValues(t, 1, srv.handshakingConnCount.Load())
+
+	// Banned clients are turned away before the limit applies
+	_, err = srv.BanClient("127.0.0.1", time.Minute, "test")
+	require.NoError(t, err)
+	banned, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer banned.Close()
+	_ = banned.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = banned.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.EqualValues(t, 1, srv.bannedConns.Load())
+	assert.EqualValues(t, 1, srv.maxConnsRejected.Load())
+	_, err = srv.UnbanClient("127.0.0.1")
+	require.NoError(t, err)
+
+	// A slot is available again once client1 goes away
+	require.NoError(t, client1.Close())
+	require.Eventually(t, func() bool {
+		return srv.GetActiveConnectionCount() == 0 && srv.handshakingConnCount.Load() == 0
+	}, time.Second, 10*time.Millisecond)
+	client3, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer client3.Close()
+	conn := rsync.NewConn(client3)
+	_, err = doClientHandshake(conn, RsyncdServerVersion, "")
+	require.NoError(t, err)
+}
+
+func TestMaxHandshakingConnections(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
 		require.NoError(t, err)
+		<-release
 	})
 	upstream.Start()
 	defer upstream.Close()
 
-	srv := New()
-	srv.ReadTimeout = time.Second
-	srv.WriteTimeout = time.Second
+	srv.reloadLock.Lock()
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+	srv.connLimits = connLimits{maxHandshaking: 1}
+	srv.reloadLock.Unlock()
 
-	modules, err := srv.DiscoverModules(upstream.Listener.Addr().String())
+	// Relaying connections do not count
+	client1, err := net.Dial("tcp", srv.TCPListener.Addr().String())
 	require.NoError(t, err)
-	assert.Equal(t, []string{"bar", "foo"}, modules)
-}
+	defer client1.Close()
+	_, err = doClientHandshake(rsync.NewConn(client1), RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		infos := srv.ListConnectionInfo()
+		return len(infos) == 1 && infos[0].snapshot().State == connStateRelaying
+	}, time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 0, srv.handshakingConnCount.Load())
 
-func TestModuleCountersNormalizeEmptyKeyToUnknown(t *testing.T) {
-	srv := New()
+	client2, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer client2.Close()
+	require.Eventually(t, func() bool {
+		return len(srv.ListConnectionInfo()) == 2
+	}, time.Second, 10*time.Millisecond)
 
-	// Both empty and "unknown" inputs must point at the same internal
-	// counter, so a scrape cannot emit two lines that share the same
+	client3, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer client3.Close()
+	_ = client3.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client3.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+	assert.EqualValues(t, 1, srv.maxHandshakingRejected.Load())
+	assert.EqualValues(t, 0, srv.maxConnsRejected.Load())
+
+	resp, err := testHTTPClient().Get("http://" + srv.HTTPListener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "rsync_proxy_handshaking_connections 1\n")
+	assert.Contains(t, string(body), `rsync_proxy_connection_limit_rejected_total{limit="max_handshaking_connections"} 1`+"\n")
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		require.NoError(t, err)
+		<-release
+	})
+	upstream.Start()
+	defer upstream.Close()
+
+	const timeout = 300 * time.Millisecond
+	srv.reloadLock.Lock()
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: upstream.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+	srv.connLimits = connLimits{handshakeTimeout: timeout}
+	srv.reloadLock.Unlock()
+
+	// Each read is within ReadTimeout, but the whole handshake is not
+	slow, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer slow.Close()
+	start := time.Now()
+	conn := rsync.NewConn(slow)
+	_, err = conn.Write(RsyncdServerVersion)
+	require.NoError(t, err)
+	_, err = conn.ReadLine()
+	require.NoError(t, err)
+	_ = slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = slow.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), srv.ReadTimeout)
+	assert.EqualValues(t, 1, srv.handshakeTimeouts.Load())
+
+	// Connections past the handshake are not affected
+	client, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = doClientHandshake(rsync.NewConn(client), RsyncdServerVersion, "fake")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		infos := srv.ListConnectionInfo()
+		return len(infos) == 1 && infos[0].snapshot().State == connStateRelaying
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(2 * timeout)
+	assert.Len(t, srv.ListConnectionInfo(), 1)
+	assert.EqualValues(t, 1, srv.handshakeTimeouts.Load())
+	require.Eventually(t, func() bool {
+		return srv.handshakingConnCount.Load() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestConnectionRateLimitBansClient(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
+	banFile := filepath.Join(t.TempDir(), "bans.json")
+	require.NoError(t, srv.bans.setFile(banFile, nil))
+
+	srv.reloadLock.Lock()
+	srv.rateLimits = rateLimits{
+		conn:        rateLimit{burst: 2, period: time.Hour},
+		banDuration: time.Hour,
+	}
+	srv.reloadLock.Unlock()
+
+	connect := func() error {
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		require.NoError(t, err)
+		defer rawConn.Close()
+		_ = rawConn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn := rsync.NewConn(rawConn)
+		_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+		if err != nil {
+			return err
+		}
+		_, err = conn.ReadLine()
+		return err
+	}
+
+	require.NoError(t, connect())
+	require.NoError(t, connect())
+	// Over the rate, the client is banned
+	require.Error(t, connect())
+	require.Error(t, connect())
+	assert.EqualValues(t, 1, srv.connRateLimited.Load())
+	assert.EqualValues(t, 1, srv.clientBans.Load())
+	assert.EqualValues(t, 1, srv.bannedConns.Load())
+
+	content, err := os.ReadFile(accessLogPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "client 127.0.0.1 is banned for 1h0m0s: too many connections\n")
+
+	// The ban is saved in the background
+	var saved []Ban
+	require.Eventually(t, func() bool {
+		content, err := os.ReadFile(banFile)
+		return err == nil && json.Unmarshal(content, &saved) == nil && len(saved) == 1
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "127.0.0.1", saved[0].IP)
+
+	bansURL := "http://" + srv.HTTPListener.Addr().String() + "/bans"
+	resp, err := testHTTPClient().Get(bansURL)
+	require.NoError(t, err)
+	var result struct {
+		Count int   `json:"count"`
+		Bans  []Ban `json:"bans"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	_ = resp.Body.Close()
+	assert.Equal(t, 1, result.Count)
+	assert.Equal(t, "too many connections", result.Bans[0].Reason)
+
+	unban := func() int {
+		req, err := http.NewRequest(http.MethodDelete, bansURL+"?ip=127.0.0.1", nil)
+		require.NoError(t, err)
+		resp, err := testHTTPClient().Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, unban())
+	assert.Equal(t, http.StatusNotFound, unban())
+
+	// The client starts over once unbanned
+	require.NoError(t, connect())
+
+	resp, err = testHTTPClient().PostForm(bansURL, map[string][]string{"ip": {"127.0.0.1"}, "duration": {"1m"}})
+	require.NoError(t, err)
+	var ban Ban
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&ban))
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "127.0.0.1", ban.IP)
+	require.Error(t, connect())
+
+	resp, err = testHTTPClient().PostForm(bansURL, map[string][]string{"ip": {"bogus"}})
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestUnknownModuleRateLimitBansClient(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
+
+	srv.reloadLock.Lock()
+	srv.rateLimits = rateLimits{
+		unknownModule: rateLimit{burst: 2, period: time.Hour},
+		banDuration:   time.Hour,
+	}
+	srv.reloadLock.Unlock()
+
+	requestUnknownModule := func() (string, error) {
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		require.NoError(t, err)
+		defer rawConn.Close()
+		_ = rawConn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn := rsync.NewConn(rawConn)
+		_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+		if err != nil {
+			return "", err
+		}
+		return conn.ReadLine()
+	}
+
+	for range 3 {
+		line, err := requestUnknownModule()
+		require.NoError(t, err)
+		assert.Equal(t, "@ERROR: Unknown module 'fake'\n", line)
+	}
+	_, err := requestUnknownModule()
+	require.Error(t, err)
+	assert.EqualValues(t, 1, srv.unknownModuleRateLimited.Load())
+	assert.EqualValues(t, 1, srv.bannedConns.Load())
+
+	content, err := os.ReadFile(accessLogPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "client 127.0.0.1 is banned for 1h0m0s: too many requests for unknown modules\n")
+}
+
+func TestHostsRules(t *testing.T) {
+	blocklist := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklist, []byte("# bad networks\n192.0.2.0/24\n\n  2001:db8::/32 # comment\n198.51.100.7\n"), 0o644))
+
+	for _, tc := range []struct {
+		name     string
+		acl      HostsACL
+		allowed  []string
+		denied   []string
+		expected string
+	}{
+		{
+			name:    "allow only",
+			acl:     HostsACL{HostsAllow: []string{"10.0.0.0/8"}},
+			allowed: []string{"10.1.2.3", "::ffff:10.0.0.1"},
+			denied:  []string{"192.0.2.1", "2001:db8::1"},
+		},
+		{
+			name:    "deny file only",
+			acl:     HostsACL{HostsDenyFile: blocklist},
+			allowed: []string{"10.1.2.3", "198.51.100.8"},
+			denied:  []string{"192.0.2.1", "2001:db8::1", "198.51.100.7"},
+		},
+		{
+			name:    "allow takes precedence",
+			acl:     HostsACL{HostsAllow: []string{"192.0.2.1"}, HostsDeny: []string{"192.0.2.0/24"}},
+			allowed: []string{"192.0.2.1", "10.1.2.3"},
+			denied:  []string{"192.0.2.2"},
+		},
+	} {
+		rules, err := loadHostsRules(tc.acl)
+		require.NoError(t, err, tc.name)
+		for _, ip := range tc.allowed {
+			assert.True(t, rules.allows(netip.MustParseAddr(ip)), "%s: %s", tc.name, ip)
+		}
+		for _, ip := range tc.denied {
+			assert.False(t, rules.allows(netip.MustParseAddr(ip)), "%s: %s", tc.name, ip)
+		}
+	}
+
+	rules, err := loadHostsRules(HostsACL{})
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+	assert.True(t, rules.allows(netip.MustParseAddr("192.0.2.1")))
+
+	require.NoError(t, os.WriteFile(blocklist, []byte("192.0.2.0/24\n192.0.2.300\n"), 0o644))
+	_, err = loadHostsRules(HostsACL{HostsDenyFile: blocklist})
+	assert.ErrorContains(t, err, blocklist+`:2: invalid network "192.0.2.300"`)
+}
+
+func TestHostsAccess(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
+
+	rules := func(acl HostsACL) *hostsRules {
+		r, err := loadHostsRules(acl)
+		require.NoError(t, err)
+		return r
+	}
+	srv.reloadLock.Lock()
+	srv.modules = map[string][]Target{
+		"foo":    {{Upstream: "u1", Addr: "127.0.0.1:1"}},
+		"secret": {{Upstream: "u1", Addr: "127.0.0.1:1"}},
+	}
+	srv.moduleSettings = map[string]*moduleSettings{
+		"secret": {hosts: rules(HostsACL{HostsAllow: []string{"10.0.0.0/8"}})},
+	}
+	srv.reloadLock.Unlock()
+
+	request := func(module string) []string {
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		require.NoError(t, err)
+		defer rawConn.Close()
+		_ = rawConn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn := rsync.NewConn(rawConn)
+		_, err = doClientHandshake(conn, RsyncdServerVersion, module)
+		require.NoError(t, err)
+		var lines []string
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return lines
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	// Modules that the client may not access are not listed
+	assert.Equal(t, []string{"foo\n", string(RsyncdExit)}, request(""))
+	assert.Equal(t, []string{"@ERROR: access denied to secret from 127.0.0.1\n"}, request("secret"))
+
+	srv.reloadLock.Lock()
+	srv.listenerHostsRules = map[listenerKind]*hostsRules{
+		listenerPlain: rules(HostsACL{HostsDeny: []string{"127.0.0.0/8"}}),
+	}
+	srv.reloadLock.Unlock()
+	assert.Equal(t, []string{"@ERROR: access denied from 127.0.0.1\n"}, request(""))
+
+	srv.reloadLock.Lock()
+	srv.listenerHostsRules = nil
+	srv.hostsRules = rules(HostsACL{HostsAllow: []string{"::1"}})
+	srv.reloadLock.Unlock()
+	assert.Equal(t, []string{"@ERROR: access denied to foo from 127.0.0.1\n"}, request("foo"))
+
+	assert.EqualValues(t, 1, srv.hostsDenied[hostsScopeGlobal].Load())
+	assert.EqualValues(t, 1, srv.hostsDenied[hostsScopeListener].Load())
+	assert.EqualValues(t, 1, srv.hostsDenied[hostsScopeModule].Load())
+
+	content, err := os.ReadFile(accessLogPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "client 127.0.0.1 is denied access to module secret by module hosts rules\n")
+	assert.Contains(t, string(content), "client 127.0.0.1 is denied listing modules by listener hosts rules\n")
+	assert.Contains(t, string(content), "client 127.0.0.1 is denied access to module foo by global hosts rules\n")
+}
+
+func TestStartupFailsWhenModuleDiscoveryFails(t *testing.T) {
+	srv := New()
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+	})
+	upstream.Start()
+	defer upstream.Close()
+
+	configContent := `
+[upstreams.u1]
+address = "` + upstream.Listener.Addr().String() + `"
+discover_modules = true
+`
+	err := srv.ReadConfig(strings.NewReader(configContent), true)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "discover modules from upstream")
+}
+
+func TestReloadKeepsPreviousModulesWhenDiscoveryFails(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+
+	firstUpstream := rsync.NewModuleListServer([]string{"foo"})
+	firstUpstream.Start()
+	defer firstUpstream.Close()
+
+	secondUpstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+	})
+	secondUpstream.Start()
+	defer secondUpstream.Close()
+
+	writeConfig := func(addr string) {
+		configContent := fmt.Sprintf(`
+[proxy]
+listen = "127.0.0.1:0"
+listen_http = "127.0.0.1:0"
+
+[upstreams.u1]
+address = %q
+discover_modules = true
+`, addr)
+		require.NoError(t, os.WriteFile(configPath, []byte(configContent), 0600))
+	}
+
+	writeConfig(firstUpstream.Listener.Addr().String())
+	srv := New()
+	srv.ConfigPath = configPath
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+	require.NoError(t, srv.ReadConfigFromFile(true))
+	require.Contains(t, srv.modules, "foo")
+
+	writeConfig(secondUpstream.Listener.Addr().String())
+	err := srv.ReadConfigFromFile(true)
+	require.Error(t, err)
+
+	srv.reloadLock.RLock()
+	defer srv.reloadLock.RUnlock()
+	_, hasFoo := srv.modules["foo"]
+	_, hasBar := srv.modules["bar"]
+	assert.True(t, hasFoo)
+	assert.False(t, hasBar)
+}
+
+func TestListUpstreamModules(t *testing.T) {
+	srv := New()
+	srv.reloadLock.Lock()
+	srv.upstreams = []upstreamConfig{
+		{Name: "u1", Modules: []string{"foo", "bar"}},
+		{Name: "u2", Modules: []string{"baz"}},
+	}
+	srv.reloadLock.Unlock()
+
+	modules, err := srv.ListUpstreamModules("u1", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, modules)
+
+	_, err = srv.ListUpstreamModules("missing", false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown upstream")
+}
+
+func TestListUpstreamModulesForceDiscover(t *testing.T) {
+	upstream := rsync.NewModuleListServer([]string{"bar", "foo"})
+	upstream.Start()
+	defer upstream.Close()
+
+	srv := New()
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+	srv.reloadLock.Lock()
+	srv.upstreams = []upstreamConfig{
+		{
+			Name:            "u1",
+			Target:          Target{Upstream: "u1", Addr: upstream.Listener.Addr().String()},
+			Modules:         []string{"stale"},
+			DiscoverModules: false,
+		},
+	}
+	srv.reloadLock.Unlock()
+
+	modules, err := srv.ListUpstreamModules("u1", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, modules)
+}
+
+func TestDiscoverModules(t *testing.T) {
+	upstream := rsync.NewModuleListServer([]string{"bar", "foo"})
+	upstream.Start()
+	defer upstream.Close()
+
+	srv := New()
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+
+	modules, err := srv.DiscoverModules(upstream.Listener.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, modules)
+}
+
+func TestDiscoverModulesWithProxyProtocol(t *testing.T) {
+	upstream := rsync.NewModuleListServerWithProxyProtocol([]string{"bar", "foo"})
+	upstream.Start()
+	defer upstream.Close()
+
+	srv := New()
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+
+	modules, err := srv.DiscoverModulesWithProxyProtocol(upstream.Listener.Addr().String(), true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, modules)
+}
+
+func TestDiscoverModulesFromProxyStyleListing(t *testing.T) {
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+
+		line, err := conn.ReadLine()
+		require.NoError(t, err)
+		require.Equal(t, string(RsyncdServerVersion), line)
+
+		_, err = conn.Write(RsyncdServerVersion)
+		require.NoError(t, err)
+
+		line, err = conn.ReadLine()
+		require.NoError(t, err)
+		require.Equal(t, "\n", line)
+
+		_, err = conn.Write([]byte("Served by rsync-proxy\n\nfoo\nbar\n@RSYNCD: EXIT\n"))
+		require.NoError(t, err)
+	})
+	upstream.Start()
+	defer upstream.Close()
+
+	srv := New()
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+
+	modules, err := srv.DiscoverModules(upstream.Listener.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, modules)
+}
+
+func TestDiscoverModulesFromTrailingModuleBlock(t *testing.T) {
+	upstream := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+
+		line, err := conn.ReadLine()
+		require.NoError(t, err)
+		require.Equal(t, string(RsyncdServerVersion), line)
+
+		_, err = conn.Write(RsyncdServerVersion)
+		require.NoError(t, err)
+
+		line, err = conn.ReadLine()
+		require.NoError(t, err)
+		require.Equal(t, "\n", line)
+
+		_, err = conn.Write([]byte("Welcome to upstream\nMirror notice\n\nfoo comment\nbar\n@RSYNCD: EXIT\n"))
+		require.NoError(t, err)
+	})
+	upstream.Start()
+	defer upstream.Close()
+
+	srv := New()
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+
+	modules, err := srv.DiscoverModules(upstream.Listener.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bar", "foo"}, modules)
+}
+
+func TestModuleCountersNormalizeEmptyKeyToUnknown(t *testing.T) {
+	srv := New()
+
+	// Both empty and "unknown" inputs must point at the same internal
+	// counter, so a scrape cannot emit two lines that share the same
 	// rendered Prometheus label set.
 	c1 := srv.getModuleCounters("", "")
 	c2 := srv.getModuleCounters("unknown", "unknown")
 	assert.Same(t, c1, c2)
 
-	c1.completed.Add(7)
+	c1.completed.Add(7)
+
+	// metrics.go uses prometheusEscapeLabelValue on the stored key only,
+	// so the rendered output must show the normalized "unknown" value.
+	var buf bytes.Buffer
+	srv.writePrometheusMetrics(&buf, time.Now())
+	text := buf.String()
+	assert.Contains(t, text, "rsync_proxy_module_completed_connections_total{module=\"unknown\",upstream=\"unknown\"} 7\n")
+
+	// And there should be exactly one such line — i.e. no second line with
+	// an empty-string label rendered separately.
+	assert.Equal(t, 1, strings.Count(text, "rsync_proxy_module_completed_connections_total{"))
+}
+
+func TestTLSMinVersionAndConnectionState(t *testing.T) {
+	dir := t.TempDir()
+	tlsFiles := writeTestTLSCert(t, dir, "server", "rsync-proxy-tls")
+
+	configPath := filepath.Join(dir, "config.toml")
+	configContent := fmt.Sprintf(`
+[proxy]
+listen = "127.0.0.1:0"
+listen_http = "127.0.0.1:0"
+listen_tls = "127.0.0.1:0"
+tls_cert_file = %q
+tls_key_file = %q
+tls_min_version = "1.3"
+tls_session_ticket_key_rotation = "1h"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`, tlsFiles.certPath, tlsFiles.keyPath)
+	require.NoError(t, os.WriteFile(configPath, []byte(configContent), 0600))
+
+	srv := New()
+	srv.ConfigPath = configPath
+	srv.ReadTimeout = time.Second
+	srv.WriteTimeout = time.Second
+	require.NoError(t, srv.ReadConfigFromFile(true))
+	require.NoError(t, srv.Listen())
+	defer srv.Close()
+
+	go func() {
+		err := srv.Run()
+		assert.NoErrorf(t, err, "Fail to run server")
+	}()
+
+	_, err := tls.Dial("tcp", srv.TLSListenAddr, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	require.Error(t, err, "TLS 1.2 client should be rejected")
+	require.Eventually(t, func() bool {
+		return srv.tlsHandshakeErrors.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	rawConn, err := tls.Dial("tcp", srv.TLSListenAddr, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "localhost",
+	})
+	require.NoError(t, err)
+	defer rawConn.Close()
+
+	require.Eventually(t, func() bool {
+		infos := srv.ListConnectionInfo()
+		return len(infos) == 1 && infos[0].snapshot().TLSVersion != ""
+	}, time.Second, 10*time.Millisecond)
+	snapshot := srv.ListConnectionInfo()[0].snapshot()
+	assert.Equal(t, "TLS 1.3", snapshot.TLSVersion)
+	assert.Equal(t, tls.CipherSuiteName(rawConn.ConnectionState().CipherSuite), snapshot.TLSCipher)
+	assert.Equal(t, "localhost", snapshot.TLSServerName)
+
+	var buf bytes.Buffer
+	srv.writePrometheusMetrics(&buf, time.Now())
+	text := buf.String()
+	assert.Contains(t, text, fmt.Sprintf("rsync_proxy_tls_handshakes_total{version=\"TLS 1.3\",cipher=\"%s\"} 1\n", snapshot.TLSCipher))
+	assert.Contains(t, text, "rsync_proxy_tls_handshake_errors_total 1\n")
+}
+
+func TestWatchTLSCertificateReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	liveCert := writeTestTLSCert(t, dir, "live", "first-cert")
+	secondCert := writeTestTLSCert(t, dir, "second", "second-cert")
+	thirdCert := writeTestTLSCert(t, dir, "third", "third-cert")
+
+	configContent := fmt.Sprintf(`
+[proxy]
+listen_tls = "127.0.0.1:0"
+tls_cert_file = %q
+tls_key_file = %q
+tls_watch_interval = "1s"
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+`, liveCert.certPath, liveCert.keyPath)
+	srv := New()
+	require.NoError(t, srv.ReadConfig(strings.NewReader(configContent), true))
+	// The test certificate is only valid for an hour
+	assert.True(t, srv.tlsExpiryWarned.Load())
+
+	commonName := func() string {
+		leaf, err := tlsCertificateLeaf(srv.tlsCertificate)
+		require.NoError(t, err)
+		return leaf.Subject.CommonName
+	}
+	replace := func(src, dst string, mtime time.Time) {
+		data, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, data, 0600))
+		require.NoError(t, os.Chtimes(dst, mtime, mtime))
+	}
+
+	srv.checkTLSCertificate(time.Now())
+	assert.Equal(t, "first-cert", commonName())
+
+	// Only the certificate has been renewed, the key does not match yet
+	replace(secondCert.certPath, liveCert.certPath, time.Now().Add(time.Minute))
+	srv.checkTLSCertificate(time.Now())
+	assert.Equal(t, "first-cert", commonName())
+
+	replace(secondCert.keyPath, liveCert.keyPath, time.Now().Add(time.Minute))
+	srv.checkTLSCertificate(time.Now())
+	assert.Equal(t, "second-cert", commonName())
+
+	replace(thirdCert.certPath, liveCert.certPath, time.Now().Add(2*time.Minute))
+	replace(thirdCert.keyPath, liveCert.keyPath, time.Now().Add(2*time.Minute))
+	srv.checkTLSCertificate(time.Now())
+	assert.Equal(t, "third-cert", commonName())
+
+	// A watcher that started before the certificate was last loaded must not
+	// overwrite it
+	current := srv.tlsCertificate
+	srv.reloadTLSCertificateIfChanged(srv.tlsSettings, tlsFileStamp{})
+	assert.Same(t, current, srv.tlsCertificate)
+
+	leaf, err := tlsCertificateLeaf(srv.tlsCertificate)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	srv.writePrometheusMetrics(&buf, time.Now())
+	assert.Contains(t, buf.String(), fmt.Sprintf("rsync_proxy_tls_certificate_expiry_timestamp_seconds %d\n", leaf.NotAfter.Unix()))
+}
+
+func startHTTPConnectServer(t *testing.T, allowedHosts ...string) *Server {
+	srv := New()
+	const (
+		addr    = "127.0.0.1:0"
+		timeout = time.Second
+	)
+	srv.HTTPListenAddr = addr
+	srv.ListenAddr = addr
+	srv.HTTPConnectListenAddr = addr
+	srv.ReadTimeout = timeout
+	srv.WriteTimeout = timeout
+	for _, host := range allowedHosts {
+		target, err := normalizeHTTPConnectTarget(host)
+		require.NoError(t, err)
+		srv.httpConnectAllowedHosts = append(srv.httpConnectAllowedHosts, target)
+	}
+	require.NoError(t, srv.Listen())
+
+	go func() {
+		err := srv.Run()
+		assert.NoErrorf(t, err, "Fail to run server")
+	}()
+	return srv
+}
+
+func TestHTTPConnectListener(t *testing.T) {
+	srv := startHTTPConnectServer(t, "Mirrors.Example.org")
+	defer srv.Close()
+
+	fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, module, err := doServerHandshake(conn, RsyncdServerVersion)
+		assert.NoError(t, err)
+		assert.Equal(t, "fake\n", module)
+		_, _ = conn.Write([]byte("data\n"))
+	})
+	fakeRsync.Start()
+	defer fakeRsync.Close()
+
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+	r := require.New(t)
+
+	rawConn, err := net.Dial("tcp", srv.HTTPConnectListenAddr)
+	r.NoError(err)
+	conn := rsync.NewConn(rawConn)
+	defer conn.Close()
+
+	// rsync sends the version right after the CONNECT response, but a
+	// pipelining client must not lose the bytes that follow the headers.
+	_, err = conn.Write(append([]byte("CONNECT mirrors.example.org:873 HTTP/1.0\r\nProxy-Authorization: Basic Zm9vOmJhcg==\r\n\r\n"), RsyncdServerVersion...))
+	r.NoError(err)
+	status, err := conn.ReadLine()
+	r.NoError(err)
+	r.Equal("HTTP/1.0 200 Connection established\r\n", status)
+	blank, err := conn.ReadLine()
+	r.NoError(err)
+	r.Equal("\r\n", blank)
+
+	version, err := conn.ReadLine()
+	r.NoError(err)
+	r.Equal(string(RsyncdServerVersion), version)
+	_, err = conn.Write([]byte("fake\n"))
+	r.NoError(err)
+
+	allData, err := io.ReadAll(conn)
+	r.NoError(err)
+	r.Equal("data\n", string(allData))
+}
+
+func TestHTTPConnectRejectsDisallowedTarget(t *testing.T) {
+	srv := startHTTPConnectServer(t, "mirrors.example.org")
+	defer srv.Close()
+	accessLogPath := setupAccessLog(t, srv)
+
+	for request, expected := range map[string]string{
+		"CONNECT evil.example.org:873 HTTP/1.0\r\n\r\n":    "HTTP/1.0 403 Forbidden\r\n",
+		"CONNECT mirrors.example.org:22 HTTP/1.0\r\n\r\n":  "HTTP/1.0 403 Forbidden\r\n",
+		"GET http://mirrors.example.org/ HTTP/1.0\r\n\r\n": "HTTP/1.0 405 Method Not Allowed\r\n",
+		"CONNECT mirrors.example.org:873\r\n\r\n":          "HTTP/1.0 400 Bad Request\r\n",
+		"CONNECT [::1 HTTP/1.1\r\nHost: [::1\r\n\r\n":      "HTTP/1.0 400 Bad Request\r\n",
+		"CONNECT mirrors.example.org:873 SPDY/3\r\n\r\n":   "HTTP/1.0 400 Bad Request\r\n",
+	} {
+		rawConn, err := net.Dial("tcp", srv.HTTPConnectListenAddr)
+		require.NoError(t, err)
+		conn := rsync.NewConn(rawConn)
+		_, err = conn.Write([]byte(request))
+		require.NoError(t, err)
+		status, err := conn.ReadLine()
+		require.NoError(t, err, request)
+		assert.Equal(t, expected, status, request)
+		conn.Close()
+	}
+
+	logData, err := os.ReadFile(accessLogPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(logData), "HTTP CONNECT to disallowed target evil.example.org:873")
+}
 
-	// metrics.go uses prometheusEscapeLabelValue on the stored key only,
-	// so the rendered output must show the normalized "unknown" value.
-	var buf bytes.Buffer
-	srv.writePrometheusMetrics(&buf, time.Now())
-	text := buf.String()
-	assert.Contains(t, text, "rsync_proxy_module_completed_connections_total{module=\"unknown\",upstream=\"unknown\"} 7\n")
+func TestRelayThroughUpstreamProxy(t *testing.T) {
+	for name, newTunnel := range map[string]func(username, password string) *tunnel.Server{
+		upstreamProxySOCKS5: tunnel.NewSOCKS5Server,
+		upstreamProxyHTTP:   tunnel.NewHTTPConnectServer,
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := startServer(t)
+			defer srv.Close()
+
+			header := make(chan string, 1)
+			fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+				defer conn.Close()
+				line, err := conn.ReadLine()
+				assert.NoError(t, err)
+				header <- line
+				_, module, err := doServerHandshake(conn, RsyncdServerVersion)
+				assert.NoError(t, err)
+				assert.Equal(t, "fake\n", module)
+				_, _ = conn.Write([]byte("data\n"))
+			})
+			fakeRsync.Start()
+			defer fakeRsync.Close()
+
+			jump := newTunnel("user", "secret")
+			jump.Start()
+			defer jump.Close()
+
+			upstreamAddr := fakeRsync.Listener.Addr().String()
+			srv.modules = map[string][]Target{
+				"fake": {{
+					Upstream:         "u1",
+					Addr:             upstreamAddr,
+					UseProxyProtocol: true,
+					Via: &upstreamProxy{
+						Scheme:   name,
+						Addr:     jump.Listener.Addr().String(),
+						Username: "user",
+						Password: "secret",
+					},
+				}},
+			}
+			srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+			rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+			require.NoError(t, err)
+			conn := rsync.NewConn(rawConn)
+			defer conn.Close()
+
+			_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+			require.NoError(t, err)
+			allData, err := io.ReadAll(conn)
+			require.NoError(t, err)
+			assert.Equal(t, "data\n", string(allData))
+			assert.Equal(t, []string{upstreamAddr}, jump.Targets())
+			// The header tells the upstream's address, not the jump proxy's
+			_, port, _ := net.SplitHostPort(upstreamAddr)
+			fields := strings.Fields(<-header)
+			require.Len(t, fields, 6)
+			assert.Equal(t, port, fields[5])
+		})
+	}
+}
 
-	// And there should be exactly one such line — i.e. no second line with
-	// an empty-string label rendered separately.
-	assert.Equal(t, 1, strings.Count(text, "rsync_proxy_module_completed_connections_total{"))
+func TestUpstreamProxyRejectsWrongCredentials(t *testing.T) {
+	jump := tunnel.NewSOCKS5Server("user", "secret")
+	jump.Start()
+	defer jump.Close()
+
+	srv := New()
+	srv.ReadTimeout = time.Second
+	_, err := srv.dialUpstream(t.Context(), Target{
+		Upstream: "u1",
+		Addr:     "127.0.0.1:873",
+		Via: &upstreamProxy{
+			Scheme:   upstreamProxySOCKS5,
+			Addr:     jump.Listener.Addr().String(),
+			Username: "user",
+			Password: "wrong",
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "authentication failed")
+	assert.Empty(t, jump.Targets())
+}
+
+func TestSOCKS5RejectsUnexpectedAuthVersion(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer proxy.Close()
+		buf := make([]byte, 64)
+		_, _ = proxy.Read(buf)
+		_, _ = proxy.Write([]byte{0x05, 0x02})
+		_, _ = proxy.Read(buf)
+		// A SOCKS5 version byte instead of the username/password one
+		_, _ = proxy.Write([]byte{0x05, 0x00})
+	}()
+	err := socks5Connect(client, "127.0.0.1:873", "user", "secret")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected authentication version 5")
+}
+
+func TestSOCKS5RejectsUnexpectedReplyVersion(t *testing.T) {
+	client, proxy := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer proxy.Close()
+		buf := make([]byte, 64)
+		_, _ = proxy.Read(buf)
+		_, _ = proxy.Write([]byte{0x05, 0x00})
+		_, _ = proxy.Read(buf)
+		// Not a SOCKS5 reply, though the second byte reads as success
+		_, _ = proxy.Write([]byte("H\x00\x00\x01"))
+	}()
+	err := socks5Connect(client, "127.0.0.1:873", "", "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected reply version 72")
+}
+
+func TestModuleAuthentication(t *testing.T) {
+	tests := map[string]struct {
+		greeting string
+		digest   string
+		user     string
+		password string
+		ok       bool
+	}{
+		"sha256 from client list": {"@RSYNCD: 31.0 sha256 md5\n", "sha256", "alice", "wonderland", true},
+		"md5 without list":        {"@RSYNCD: 30.0\n", "md5", "alice", "wonderland", true},
+		"wrong password":          {"@RSYNCD: 31.0 sha512 md5\n", "sha512", "alice", "wrong", false},
+		"unknown user":            {"@RSYNCD: 31.0 md5\n", "md5", "mallory", "wonderland", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := startServer(t)
+			defer srv.Close()
+			logPath := setupAccessLog(t, srv)
+
+			upstreamDialed := make(chan struct{}, 1)
+			fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+				defer conn.Close()
+				upstreamDialed <- struct{}{}
+				_, module, err := doServerHandshake(conn, RsyncdServerVersion)
+				assert.NoError(t, err)
+				assert.Equal(t, "private\n", module)
+				_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+			})
+			fakeRsync.Start()
+			defer fakeRsync.Close()
+
+			srv.modules = map[string][]Target{
+				"private": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+			}
+			srv.moduleSettings = map[string]*moduleSettings{
+				"private": {auth: &moduleAuth{users: map[string]string{"alice": "wonderland"}}},
+			}
+			srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+			r := require.New(t)
+			rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+			r.NoError(err)
+			conn := rsync.NewConn(rawConn)
+			defer conn.Close()
+
+			_, err = doClientHandshake(conn, []byte(tc.greeting), "private")
+			r.NoError(err)
+			line, err := conn.ReadLine()
+			r.NoError(err)
+			challenge, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "@RSYNCD: AUTHREQD ")
+			r.True(ok, "unexpected challenge line: %q", line)
+			_, err = conn.Write([]byte(tc.user + " " + authResponse(tc.digest, tc.password, challenge) + "\n"))
+			r.NoError(err)
+
+			allData, err := io.ReadAll(conn)
+			r.NoError(err)
+			logContent, err := os.ReadFile(logPath)
+			r.NoError(err)
+			if tc.ok {
+				r.Equal("@RSYNCD: OK\n", string(allData))
+				r.Contains(string(logContent), "authenticated as alice for module private")
+				return
+			}
+			r.Equal("@ERROR: auth failed on module private\n", string(allData))
+			r.Contains(string(logContent), "auth failed on module private")
+			r.Empty(upstreamDialed, "upstream must not be dialed for unauthenticated clients")
+		})
+	}
+}
+
+func TestAuthDigestForClient(t *testing.T) {
+	advertised, err := parseRsyncdGreeting(RsyncdServerVersion)
+	require.NoError(t, err)
+	digestFor := func(greeting string, advertised rsyncdGreeting) (string, error) {
+		g, err := parseRsyncdGreeting([]byte(greeting))
+		if err != nil {
+			return "", err
+		}
+		return authDigestForClient(g, advertised)
+	}
+	for greeting, expected := range map[string]string{
+		"@RSYNCD: 32.0 sha512 sha256 sha1 md5 md4\n": "sha512",
+		"@RSYNCD: 31.0 md4 sha1\n":                   "sha1",
+		"@RSYNCD: 30.0\n":                            "md5",
+	} {
+		digest, err := digestFor(greeting, advertised)
+		require.NoError(t, err, greeting)
+		assert.Equal(t, expected, digest, greeting)
+	}
+	for _, greeting := range []string{"@RSYNCD: 29.0\n", "@RSYNCD: 31.0 md4\n", "@RSYNCD: x\n"} {
+		_, err := digestFor(greeting, advertised)
+		assert.Error(t, err, greeting)
+	}
+
+	// The client only picks from the digests we advertised
+	older, err := parseRsyncdGreeting([]byte("@RSYNCD: 31.0 sha1 md5\n"))
+	require.NoError(t, err)
+	digest, err := digestFor("@RSYNCD: 32.0 sha512 sha256 sha1 md5 md4\n", older)
+	require.NoError(t, err)
+	assert.Equal(t, "sha1", digest)
+}
+
+func TestInjectUpstreamCredentials(t *testing.T) {
+	for name, network := range map[string]string{
+		"allowed client":    "127.0.0.0/8",
+		"disallowed client": "10.0.0.0/8",
+	} {
+		t.Run(name, func(t *testing.T) {
+			allowed := network == "127.0.0.0/8"
+			srv := startServer(t)
+			defer srv.Close()
+
+			fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+				defer conn.Close()
+				cliVersion, module, err := doServerHandshake(conn, []byte("@RSYNCD: 31.0 sha256 md5\n"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, "private\n", module)
+				if allowed {
+					assert.Equal(t, "@RSYNCD: 31.0 sha512 sha256 sha1 md5\n", cliVersion)
+				} else {
+					assert.Equal(t, "@RSYNCD: 31.0 md5\n", cliVersion)
+				}
+				_, _ = conn.Write([]byte("@RSYNCD: AUTHREQD challenge\n"))
+				line, err := conn.ReadLine()
+				if !assert.NoError(t, err) {
+					return
+				}
+				if allowed {
+					assert.Equal(t, "mirror "+authResponse("sha256", "secret", "challenge")+"\n", line)
+				} else {
+					assert.Equal(t, "client response\n", line)
+				}
+				_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+			})
+			fakeRsync.Start()
+			defer fakeRsync.Close()
+
+			srv.modules = map[string][]Target{
+				"private": {{
+					Upstream: "u1",
+					Addr:     fakeRsync.Listener.Addr().String(),
+					Credentials: &upstreamCredentials{
+						Username: "mirror",
+						Password: "secret",
+						Networks: []netip.Prefix{netip.MustParsePrefix(network)},
+					},
+				}},
+			}
+			srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+			r := require.New(t)
+			rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+			r.NoError(err)
+			conn := rsync.NewConn(rawConn)
+			defer conn.Close()
+
+			_, err = doClientHandshake(conn, []byte("@RSYNCD: 31.0 md5\n"), "private")
+			r.NoError(err)
+			line, err := conn.ReadLine()
+			r.NoError(err)
+			if !allowed {
+				r.Equal("@RSYNCD: AUTHREQD challenge\n", line)
+				_, err = conn.Write([]byte("client response\n"))
+				r.NoError(err)
+				line, err = conn.ReadLine()
+				r.NoError(err)
+			}
+			r.Equal("@RSYNCD: OK\n", line)
+		})
+	}
+}
+
+func TestUpstreamModuleResponseIsRecorded(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	logPath := setupAccessLog(t, srv)
+
+	const rejection = "@ERROR: max connections (10) reached -- try again later\n"
+	fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, RsyncdServerVersion)
+		assert.NoError(t, err)
+		_, _ = conn.Write([]byte(rejection))
+	})
+	fakeRsync.Start()
+	defer fakeRsync.Close()
+
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+	r := require.New(t)
+	rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	r.NoError(err)
+	conn := rsync.NewConn(rawConn)
+	defer conn.Close()
+
+	_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+	r.NoError(err)
+	allData, err := io.ReadAll(conn)
+	r.NoError(err)
+	r.Equal(rejection, string(allData), "the reply must still be forwarded to the client")
+
+	r.Eventually(func() bool {
+		return srv.GetActiveConnectionCount() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+
+	resp, err := testHTTPClient().Get("http://" + srv.HTTPListener.Addr().String() + "/metrics")
+	r.NoError(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	r.NoError(err)
+	r.Contains(string(body), "rsync_proxy_upstream_module_responses_total{upstream=\"u1\",reason=\"max_connections\"} 1\n")
+
+	logContent, err := os.ReadFile(logPath)
+	r.NoError(err)
+	r.Contains(string(logContent), "rejected by upstream u1 for module fake (max_connections): @ERROR: max connections (10) reached")
+}
+
+func TestModuleResponseSniffer(t *testing.T) {
+	tests := map[string]struct {
+		chunks  []string
+		reason  string
+		message string
+	}{
+		"ok after motd":      {[]string{"motd line\n@RSY", "NCD: OK\n\x00\x01binary"}, moduleResponseOK, "@RSYNCD: OK"},
+		"auth then ok":       {[]string{"@RSYNCD: AUTHREQD abc\n", "@RSYNCD: OK\n"}, moduleResponseOK, "@RSYNCD: OK"},
+		"access denied":      {[]string{"@ERROR: access denied to fake from host (1.2.3.4)\r\n"}, moduleResponseAccessDenied, "@ERROR: access denied to fake from host (1.2.3.4)"},
+		"auth failed":        {[]string{"@RSYNCD: AUTHREQD abc\n@ERROR: auth failed on module fake\n"}, moduleResponseAuthFailed, "@ERROR: auth failed on module fake"},
+		"long line skipped":  {[]string{strings.Repeat("@ERROR", maxModuleResponseLineSize) + "\n", "@RSYNCD: OK\n"}, moduleResponseOK, "@RSYNCD: OK"},
+		"no response at all": {[]string{"data\n", "data\n"}, "", ""},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var reason, message string
+			var calls int
+			// MultiReader keeps the chunk boundaries
+			readers := make([]io.Reader, 0, len(tc.chunks))
+			for _, chunk := range tc.chunks {
+				readers = append(readers, strings.NewReader(chunk))
+			}
+			sniffer := &moduleResponseSniffer{
+				reader: io.MultiReader(readers...),
+				onResponse: func(r, m string) {
+					calls++
+					reason, message = r, m
+				},
+			}
+			data, err := io.ReadAll(sniffer)
+			require.NoError(t, err)
+			assert.Equal(t, strings.Join(tc.chunks, ""), string(data))
+			assert.Equal(t, tc.reason, reason)
+			assert.Equal(t, tc.message, message)
+			if tc.reason != "" {
+				assert.Equal(t, 1, calls)
+			}
+		})
+	}
+}
+
+func TestRetryOnUpstreamMaxConnections(t *testing.T) {
+	const rejection = "@ERROR: max connections (1) reached -- try again later\n"
+	newUpstream := func(motd string, reject func() bool) *rsync.Server {
+		return rsync.NewServer(func(conn *rsync.Conn) {
+			defer conn.Close()
+			_, _, err := doServerHandshake(conn, append(RsyncdServerVersion, motd...))
+			assert.NoError(t, err)
+			if reject() {
+				_, _ = conn.Write([]byte(rejection))
+				return
+			}
+			_, _ = conn.Write([]byte("@RSYNCD: OK\ndata\n"))
+		})
+	}
+
+	t.Run(maxConnectionsRetry, func(t *testing.T) {
+		srv := startServer(t)
+		defer srv.Close()
+		logPath := setupAccessLog(t, srv)
+
+		busy := newUpstream("busy motd\n", func() bool { return true })
+		busy.Start()
+		defer busy.Close()
+		idle := newUpstream("idle motd\n", func() bool { return false })
+		idle.Start()
+		defer idle.Close()
+
+		policy := maxConnectionsPolicy{Action: maxConnectionsRetry, RetryDelay: time.Second, Retries: 1}
+		targets := make([]Target, 2)
+		first := chooseTargetByClientIP(net.ParseIP("127.0.0.1"), len(targets))
+		targets[first] = Target{Upstream: "busy", Addr: busy.Listener.Addr().String(), MaxConnections: policy}
+		targets[1-first] = Target{Upstream: "idle", Addr: idle.Listener.Addr().String(), MaxConnections: policy}
+		srv.modules = map[string][]Target{"fake": targets}
+		srv.upstreamQueues = map[string]*queue.Queue{"busy": queue.New(0, 0), "idle": queue.New(0, 0)}
+
+		r := require.New(t)
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		r.NoError(err)
+		conn := rsync.NewConn(rawConn)
+		defer conn.Close()
+
+		_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+		r.NoError(err)
+		allData, err := io.ReadAll(conn)
+		r.NoError(err)
+		r.Equal("idle motd\n@RSYNCD: OK\ndata\n", string(allData))
+
+		r.Eventually(func() bool {
+			return srv.GetActiveConnectionCount() == 0
+		}, 3*time.Second, 10*time.Millisecond)
+		logContent, err := os.ReadFile(logPath)
+		r.NoError(err)
+		r.Contains(string(logContent), "retries module fake on upstream idle after max connections on upstream busy")
+		// What the busy upstream sent has been discarded
+		r.Contains(string(logContent), fmt.Sprintf("finishes module fake (sent: %d,", len(allData)))
+		r.Equal(1, strings.Count(string(logContent), "starts requesting module fake"))
+	})
+
+	t.Run(maxConnectionsRequeue, func(t *testing.T) {
+		srv := startServer(t)
+		defer srv.Close()
+		logPath := setupAccessLog(t, srv)
+
+		var attempts atomic.Int32
+		upstream := newUpstream("", func() bool { return attempts.Add(1) == 1 })
+		upstream.Start()
+		defer upstream.Close()
+
+		srv.modules = map[string][]Target{
+			"fake": {{
+				Upstream:       "u1",
+				Addr:           upstream.Listener.Addr().String(),
+				MaxConnections: maxConnectionsPolicy{Action: maxConnectionsRequeue, RetryDelay: 10 * time.Millisecond, Retries: 1},
+			}},
+		}
+		srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+		r := require.New(t)
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		r.NoError(err)
+		conn := rsync.NewConn(rawConn)
+		defer conn.Close()
+
+		_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+		r.NoError(err)
+		allData, err := io.ReadAll(conn)
+		r.NoError(err)
+		r.Equal("@RSYNCD: OK\ndata\n", string(allData))
+		r.EqualValues(2, attempts.Load())
+
+		logContent, err := os.ReadFile(logPath)
+		r.NoError(err)
+		r.Contains(string(logContent), "requeued for module fake after max connections on upstream u1")
+	})
+
+	t.Run("client leaves while requeued", func(t *testing.T) {
+		srv := startServer(t)
+		defer srv.Close()
+		logPath := setupAccessLog(t, srv)
+
+		upstream := newUpstream("", func() bool { return true })
+		upstream.Start()
+		defer upstream.Close()
+
+		srv.modules = map[string][]Target{
+			"fake": {{
+				Upstream:       "u1",
+				Addr:           upstream.Listener.Addr().String(),
+				MaxConnections: maxConnectionsPolicy{Action: maxConnectionsRequeue, RetryDelay: time.Hour, Retries: 1},
+			}},
+		}
+		srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+		r := require.New(t)
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		r.NoError(err)
+		conn := rsync.NewConn(rawConn)
+
+		_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+		r.NoError(err)
+		r.Eventually(func() bool {
+			logContent, _ := os.ReadFile(logPath)
+			return strings.Contains(string(logContent), "requeued for module fake")
+		}, 3*time.Second, 10*time.Millisecond)
+		r.NoError(conn.Close())
+
+		r.Eventually(func() bool {
+			return srv.GetActiveConnectionCount() == 0
+		}, 3*time.Second, 10*time.Millisecond)
+		logContent, err := os.ReadFile(logPath)
+		r.NoError(err)
+		r.Contains(string(logContent), "client 127.0.0.1 leaves the queue for module fake")
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		srv := startServer(t)
+		defer srv.Close()
+
+		var attempts atomic.Int32
+		upstream := newUpstream("", func() bool { attempts.Add(1); return true })
+		upstream.Start()
+		defer upstream.Close()
+
+		srv.modules = map[string][]Target{
+			"fake": {{
+				Upstream:       "u1",
+				Addr:           upstream.Listener.Addr().String(),
+				MaxConnections: maxConnectionsPolicy{Action: maxConnectionsRequeue, RetryDelay: 10 * time.Millisecond, Retries: 2},
+			}},
+		}
+		srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+		r := require.New(t)
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		r.NoError(err)
+		conn := rsync.NewConn(rawConn)
+		defer conn.Close()
+
+		_, err = doClientHandshake(conn, RsyncdServerVersion, "fake")
+		r.NoError(err)
+		allData, err := io.ReadAll(conn)
+		r.NoError(err)
+		r.Equal(rejection, string(allData))
+		r.EqualValues(3, attempts.Load())
+	})
+}
+
+func TestParseClientArgs(t *testing.T) {
+	tests := map[string]struct {
+		raw     string
+		options []string
+		paths   []string
+		sender  bool
+		refused string
+	}{
+		"pull": {
+			raw:     "--server\x00--sender\x00-vlogDtpre.iLsfxC\x00.\x00fake/dir\x00\x00",
+			options: []string{"--sender", "-vlogDtpre.iLsfxC"},
+			paths:   []string{"fake/dir"},
+			sender:  true,
+		},
+		"push with delete": {
+			raw:     "--server\x00-vlogDtpre.iLsfxC\x00--delete-after\x00.\x00fake/\x00\x00",
+			options: []string{"-vlogDtpre.iLsfxC", "--delete-after"},
+			paths:   []string{"fake/"},
+			refused: "--delete-after",
+		},
+		"old protocol": {
+			raw:     "--server\n--sender\n-vlogDtprz\n.\nfake/a\nfake/b\n\n",
+			options: []string{"--sender", "-vlogDtprz"},
+			paths:   []string{"fake/a", "fake/b"},
+			sender:  true,
+			refused: "-z",
+		},
+		"protected args": {
+			raw:     "--server\x00-s\x00\x00rsync\x00--sender\x00-vlre.iLsfxC\x00--delete\x00.\x00fake/dir\x00\x00",
+			options: []string{"-s", "--sender", "-vlre.iLsfxC", "--delete"},
+			paths:   []string{"fake/dir"},
+			sender:  true,
+			refused: "--delete",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var raw bytes.Buffer
+			br := bufio.NewReader(strings.NewReader(tc.raw + "rest"))
+			args, err := readClientArgs(br, &raw)
+			require.NoError(t, err)
+			assert.Equal(t, tc.raw, raw.String())
+			assert.Equal(t, tc.options, args.Options)
+			assert.Equal(t, tc.paths, args.Paths)
+			assert.Equal(t, tc.sender, args.Sender)
+			refused, _ := args.refusedOption([]string{"delete*", "z"})
+			assert.Equal(t, tc.refused, refused)
+		})
+	}
+
+	var raw bytes.Buffer
+	_, err := readClientArgs(bufio.NewReader(strings.NewReader(strings.Repeat("a", maxClientArgsSize+1))), &raw)
+	assert.Error(t, err)
+}
+
+func TestModuleArgsPolicy(t *testing.T) {
+	const pullArgs = "--server\x00--sender\x00-vlogDtpre.iLsfxC\x00.\x00fake/dir\x00\x00"
+	const pushArgs = "--server\x00-vlogDtpre.iLsfxC\x00.\x00fake/dir\x00\x00"
+	tests := map[string]struct {
+		args     string
+		refused  bool
+		logEntry string
+	}{
+		"pull allowed": {pullArgs, false, `pulls from module fake (paths: ["fake/dir"], options: ["--sender" "-vlogDtpre.iLsfxC"])`},
+		"push refused": {pushArgs, true, "refused by module fake policy: uploads are not allowed"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := startServer(t)
+			defer srv.Close()
+			logPath := setupAccessLog(t, srv)
+
+			received := make(chan string, 1)
+			fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+				defer conn.Close()
+				_, _, err := doServerHandshake(conn, []byte("@RSYNCD: 31.0\n"))
+				assert.NoError(t, err)
+				_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+				data, _ := io.ReadAll(conn)
+				received <- string(data)
+			})
+			fakeRsync.Start()
+			defer fakeRsync.Close()
+
+			srv.modules = map[string][]Target{
+				"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+			}
+			srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+			srv.moduleSettings = map[string]*moduleSettings{
+				"fake": {args: argsPolicy{DenyPush: true}},
+			}
+
+			r := require.New(t)
+			rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+			r.NoError(err)
+			conn := rsync.NewConn(rawConn)
+			defer conn.Close()
+
+			_, err = doClientHandshake(conn, []byte("@RSYNCD: 31.0\n"), "fake")
+			r.NoError(err)
+			line, err := conn.ReadLine()
+			r.NoError(err)
+			r.Equal("@RSYNCD: OK\n", line)
+			_, err = conn.Write([]byte(tc.args))
+			r.NoError(err)
+			if !tc.refused {
+				_, err = conn.Write([]byte("data"))
+				r.NoError(err)
+				r.NoError(rawConn.(*net.TCPConn).CloseWrite())
+			}
+
+			reply, err := io.ReadAll(conn)
+			r.NoError(err)
+			if tc.refused {
+				r.Equal(clientSetupError(31, "uploads are not allowed"), reply)
+				r.Empty(<-received, "refused arguments must not reach the upstream")
+			} else {
+				r.Empty(reply)
+				r.Equal(tc.args+"data", <-received)
+			}
+
+			r.Eventually(func() bool {
+				return srv.GetActiveConnectionCount() == 0
+			}, 3*time.Second, 10*time.Millisecond)
+			logContent, err := os.ReadFile(logPath)
+			r.NoError(err)
+			r.Contains(string(logContent), tc.logEntry)
+		})
+	}
+}
+
+func TestModuleArgsPipelinedBeforeAccepted(t *testing.T) {
+	const pushArgs = "--server\x00-vlogDtpre.iLsfxC\x00.\x00fake/dir\x00\x00"
+	tests := map[string]struct {
+		policy   argsPolicy
+		refused  bool
+		logEntry string
+	}{
+		"no policy": {argsPolicy{}, false, `pushes to module fake (paths: ["fake/dir"], options: ["-vlogDtpre.iLsfxC"])`},
+		"deny push": {argsPolicy{DenyPush: true}, true, "refused by module fake policy: uploads are not allowed"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := startServer(t)
+			defer srv.Close()
+			logPath := setupAccessLog(t, srv)
+
+			requested := make(chan struct{})
+			reply := make(chan struct{})
+			received := make(chan string, 1)
+			fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+				defer conn.Close()
+				_, _, err := doServerHandshake(conn, []byte("@RSYNCD: 31.0\n"))
+				assert.NoError(t, err)
+				close(requested)
+				<-reply
+				_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+				data, _ := io.ReadAll(conn)
+				received <- string(data)
+			})
+			fakeRsync.Start()
+			defer fakeRsync.Close()
+
+			srv.modules = map[string][]Target{
+				"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+			}
+			srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+			srv.moduleSettings = map[string]*moduleSettings{
+				"fake": {args: tc.policy},
+			}
+
+			r := require.New(t)
+			rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+			r.NoError(err)
+			conn := rsync.NewConn(rawConn)
+			defer conn.Close()
+
+			_, err = doClientHandshake(conn, []byte("@RSYNCD: 31.0\n"), "fake")
+			r.NoError(err)
+			// Send the arguments without waiting for the reply
+			<-requested
+			_, err = conn.Write([]byte(pushArgs))
+			r.NoError(err)
+			time.Sleep(50 * time.Millisecond)
+			close(reply)
+			line, err := conn.ReadLine()
+			r.NoError(err)
+			r.Equal("@RSYNCD: OK\n", line)
+			if !tc.refused {
+				_, err = conn.Write([]byte("data"))
+				r.NoError(err)
+				r.NoError(rawConn.(*net.TCPConn).CloseWrite())
+			}
+
+			data, err := io.ReadAll(conn)
+			r.NoError(err)
+			if tc.refused {
+				r.Equal(clientSetupError(31, "uploads are not allowed"), data)
+				r.Empty(<-received, "refused arguments must not reach the upstream")
+			} else {
+				r.Empty(data)
+				r.Equal(pushArgs+"data", <-received)
+			}
+
+			r.Eventually(func() bool {
+				return srv.GetActiveConnectionCount() == 0
+			}, 3*time.Second, 10*time.Millisecond)
+			logContent, err := os.ReadFile(logPath)
+			r.NoError(err)
+			r.Contains(string(logContent), tc.logEntry)
+		})
+	}
+}
+
+func TestModuleArgsUnreadable(t *testing.T) {
+	// Arguments cut short by the end of the client's data
+	const cutArgs = "--server\x00--sender\x00-vlogDtpre.iLsfxC"
+	tests := map[string]struct {
+		policy    argsPolicy
+		pipelined bool
+		forwarded bool
+	}{
+		"no policy":           {argsPolicy{}, false, true},
+		"no policy pipelined": {argsPolicy{}, true, true},
+		"deny push":           {argsPolicy{DenyPush: true}, false, false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := startServer(t)
+			defer srv.Close()
+			logPath := setupAccessLog(t, srv)
+
+			requested := make(chan struct{})
+			reply := make(chan struct{})
+			received := make(chan string, 1)
+			fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+				defer conn.Close()
+				_, _, err := doServerHandshake(conn, []byte("@RSYNCD: 31.0\n"))
+				assert.NoError(t, err)
+				close(requested)
+				<-reply
+				_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+				data, _ := io.ReadAll(conn)
+				received <- string(data)
+			})
+			fakeRsync.Start()
+			defer fakeRsync.Close()
+
+			srv.modules = map[string][]Target{
+				"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+			}
+			srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+			srv.moduleSettings = map[string]*moduleSettings{
+				"fake": {args: tc.policy},
+			}
+
+			r := require.New(t)
+			rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+			r.NoError(err)
+			conn := rsync.NewConn(rawConn)
+			defer conn.Close()
+
+			_, err = doClientHandshake(conn, []byte("@RSYNCD: 31.0\n"), "fake")
+			r.NoError(err)
+			<-requested
+			if tc.pipelined {
+				_, err = conn.Write([]byte(cutArgs))
+				r.NoError(err)
+				time.Sleep(50 * time.Millisecond)
+			}
+			close(reply)
+			line, err := conn.ReadLine()
+			r.NoError(err)
+			r.Equal("@RSYNCD: OK\n", line)
+			if !tc.pipelined {
+				_, err = conn.Write([]byte(cutArgs))
+				r.NoError(err)
+			}
+			_, err = conn.Write([]byte("data"))
+			r.NoError(err)
+			r.NoError(rawConn.(*net.TCPConn).CloseWrite())
+
+			data, err := io.ReadAll(conn)
+			r.NoError(err)
+			r.Empty(data)
+			if tc.forwarded {
+				r.Equal(cutArgs+"data", <-received)
+			} else {
+				r.Empty(<-received, "unchecked arguments must not reach the upstream")
+			}
+
+			r.Eventually(func() bool {
+				return srv.GetActiveConnectionCount() == 0
+			}, 3*time.Second, 10*time.Millisecond)
+			if tc.forwarded {
+				logContent, err := os.ReadFile(logPath)
+				r.NoError(err)
+				r.Contains(string(logContent), "sends arguments to module fake that cannot be read")
+			}
+		})
+	}
+}
+
+func TestModuleReadOnly(t *testing.T) {
+	const pushArgs = "--server\x00-vlogDtpre.iLsfxC\x00.\x00fake/dir\x00\x00"
+	srv := startServer(t)
+	defer srv.Close()
+	logPath := setupAccessLog(t, srv)
+
+	received := make(chan string, 1)
+	fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		_, _, err := doServerHandshake(conn, []byte("@RSYNCD: 31.0\n"))
+		assert.NoError(t, err)
+		_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	})
+	fakeRsync.Start()
+	defer fakeRsync.Close()
+
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+	}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+	srv.moduleSettings = map[string]*moduleSettings{
+		"fake": {args: argsPolicy{DenyPush: true, ReadOnlyMessage: true}},
+	}
+
+	r := require.New(t)
+	rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	r.NoError(err)
+	conn := rsync.NewConn(rawConn)
+	defer conn.Close()
+
+	_, err = doClientHandshake(conn, []byte("@RSYNCD: 31.0\n"), "fake")
+	r.NoError(err)
+	line, err := conn.ReadLine()
+	r.NoError(err)
+	r.Equal("@RSYNCD: OK\n", line)
+	_, err = conn.Write([]byte(pushArgs))
+	r.NoError(err)
+
+	reply, err := io.ReadAll(conn)
+	r.NoError(err)
+	r.Equal(clientSetupMessage(31, "@ERROR: module is read only"), reply)
+	r.Empty(<-received, "refused arguments must not reach the upstream")
+
+	r.Eventually(func() bool {
+		return srv.GetActiveConnectionCount() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	logContent, err := os.ReadFile(logPath)
+	r.NoError(err)
+	r.Contains(string(logContent), "refused by module fake policy: module is read only")
+}
+
+func TestEarlyInput(t *testing.T) {
+	tests := map[string]struct {
+		payload string
+		// Send everything in one write, as rsync does
+		oneWrite bool
+	}{
+		"short":              {"hello", false},
+		"one write":          {"hello", true},
+		"larger than buffer": {strings.Repeat("x", maxHandshakeLineSize+1), true},
+		"maximum size":       {strings.Repeat("y", maxEarlyInputSize), false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := startServer(t)
+			defer srv.Close()
+
+			type request struct {
+				earlyInput string
+				module     string
+			}
+			received := make(chan request, 1)
+			fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+				defer conn.Close()
+				_, err := conn.ReadLine()
+				assert.NoError(t, err)
+				_, _ = conn.Write(RsyncdServerVersion)
+				line, err := conn.ReadLine()
+				assert.NoError(t, err)
+				var size int
+				_, err = fmt.Sscanf(line, "#early_input=%d\n", &size)
+				assert.NoError(t, err)
+				payload := make([]byte, size)
+				_, err = io.ReadFull(conn, payload)
+				assert.NoError(t, err)
+				module, err := conn.ReadLine()
+				assert.NoError(t, err)
+				received <- request{earlyInput: string(payload), module: module}
+				_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+			})
+			fakeRsync.Start()
+			defer fakeRsync.Close()
+
+			srv.modules = map[string][]Target{
+				"fake": {{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}},
+			}
+			srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+
+			r := require.New(t)
+			rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+			r.NoError(err)
+			conn := rsync.NewConn(rawConn)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("@RSYNCD: 31.0\n"))
+			r.NoError(err)
+			_, err = conn.ReadLine()
+			r.NoError(err)
+			header := fmt.Sprintf("#early_input=%d\n", len(tc.payload))
+			if tc.oneWrite {
+				_, err = conn.Write([]byte(header + tc.payload + "fake\n"))
+				r.NoError(err)
+			} else {
+				for _, part := range []string{header, tc.payload, "fake\n"} {
+					_, err = conn.Write([]byte(part))
+					r.NoError(err)
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			line, err := conn.ReadLine()
+			r.NoError(err)
+			r.Equal("@RSYNCD: OK\n", line)
+			req := <-received
+			r.Equal(tc.payload, req.earlyInput)
+			r.Equal("fake\n", req.module)
+		})
+	}
+}
+
+func TestInvalidEarlyInput(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	srv.modules = map[string][]Target{
+		"fake": {{Upstream: "u1", Addr: "127.0.0.1:1"}},
+	}
+
+	for _, header := range []string{"#early_input=0\n", "#early_input=abc\n", fmt.Sprintf("#early_input=%d\n", maxEarlyInputSize+1)} {
+		r := require.New(t)
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		r.NoError(err)
+		conn := rsync.NewConn(rawConn)
+
+		_, err = doClientHandshake(conn, []byte("@RSYNCD: 31.0\n"), strings.TrimSuffix(header, "\n"))
+		r.NoError(err)
+		allData, err := io.ReadAll(conn)
+		r.NoError(err)
+		r.Equal("@ERROR: invalid early_input length\n", string(allData), header)
+		conn.Close()
+	}
+}
+
+func TestHandshakeLineTooLong(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+
+	r := require.New(t)
+	rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+	r.NoError(err)
+	conn := rsync.NewConn(rawConn)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("@RSYNCD: 31.0\n"))
+	r.NoError(err)
+	_, err = conn.ReadLine()
+	r.NoError(err)
+	// A full buffer without a newline, so that nothing is left unread
+	_, err = conn.Write([]byte(strings.Repeat("m", maxHandshakeLineSize)))
+	r.NoError(err)
+	allData, err := io.ReadAll(conn)
+	r.NoError(err)
+	r.Equal("@ERROR: protocol startup error\n", string(allData))
+}
+
+func TestMinGreeting(t *testing.T) {
+	parse := func(line string) rsyncdGreeting {
+		g, err := parseRsyncdGreeting([]byte(line))
+		require.NoError(t, err, line)
+		return g
+	}
+	ours := parse(string(RsyncdServerVersion))
+	tests := map[string]struct {
+		upstreams []string
+		expected  string
+	}{
+		"unknown upstreams": {nil, string(RsyncdServerVersion)},
+		"single old upstream is relayed verbatim": {
+			[]string{"@RSYNCD: 30.0\n"},
+			"@RSYNCD: 30.0\n",
+		},
+		"same greetings": {
+			[]string{"@RSYNCD: 31.0 sha256 md5\n", "@RSYNCD: 31.0 sha256 md5\n"},
+			"@RSYNCD: 31.0 sha256 md5\n",
+		},
+		"oldest version and common digests": {
+			[]string{"@RSYNCD: 32.0 sha512 sha256 sha1 md5 md4\n", "@RSYNCD: 31.0 sha1 md5 md4\n"},
+			"@RSYNCD: 31.0 sha1 md5 md4\n",
+		},
+		"upstream without digest list": {
+			[]string{"@RSYNCD: 32.0 sha512 md5\n", "@RSYNCD: 30.0\n"},
+			"@RSYNCD: 30.0 md5\n",
+		},
+		"no common digest": {
+			[]string{"@RSYNCD: 31.0 sha512\n", "@RSYNCD: 29\n"},
+			"@RSYNCD: 29\n",
+		},
+		"newer upstream": {
+			[]string{"@RSYNCD: 33.0 xxh64 sha512\n"},
+			"@RSYNCD: 32.0 sha512\n",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var upstreams []rsyncdGreeting
+			for _, line := range tc.upstreams {
+				upstreams = append(upstreams, parse(line))
+			}
+			assert.Equal(t, tc.expected, string(minGreeting(ours, upstreams)))
+		})
+	}
+}
+
+func TestProtocolNegotiationWithOlderUpstream(t *testing.T) {
+	srv := startServer(t)
+	defer srv.Close()
+	logPath := setupAccessLog(t, srv)
+
+	received := make(chan string, 1)
+	fakeRsync := rsync.NewServer(func(conn *rsync.Conn) {
+		defer conn.Close()
+		// The module is not sent to us if the proxy refuses the client
+		cliVersion, _, err := doServerHandshake(conn, []byte("@RSYNCD: 30.0\n"))
+		received <- cliVersion
+		if err == nil {
+			_, _ = conn.Write([]byte("@RSYNCD: OK\n"))
+		}
+	})
+	fakeRsync.Start()
+	defer fakeRsync.Close()
+
+	target := Target{Upstream: "u1", Addr: fakeRsync.Listener.Addr().String()}
+	srv.modules = map[string][]Target{"fake": {target}}
+	srv.upstreams = []upstreamConfig{{Name: "u1", Target: target, Modules: []string{"fake"}}}
+	srv.upstreamQueues = map[string]*queue.Queue{"u1": queue.New(0, 0)}
+	srv.protocolNegotiation = protocolNegotiationMin
+
+	request := func(clientGreeting string) (serverGreeting, reply string) {
+		r := require.New(t)
+		rawConn, err := net.Dial("tcp", srv.TCPListener.Addr().String())
+		r.NoError(err)
+		conn := rsync.NewConn(rawConn)
+		defer conn.Close()
+		serverGreeting, err = doClientHandshake(conn, []byte(clientGreeting), "fake")
+		r.NoError(err)
+		reply, err = conn.ReadLine()
+		r.NoError(err)
+		return serverGreeting, reply
+	}
+
+	r := require.New(t)
+	// The upstream's greeting is not known yet, so the client cannot be
+	// served, but it is learned
+	serverGreeting, reply := request("@RSYNCD: 31.0 sha512 md5\n")
+	r.Equal(string(RsyncdServerVersion), serverGreeting)
+	r.Equal("@RSYNCD: 31.0 sha512 md5\n", <-received)
+	r.Equal("@ERROR: protocol version of the upstream changed -- try again later\n", reply)
+
+	serverGreeting, reply = request("@RSYNCD: 31.0 sha512 md5\n")
+	r.Equal("@RSYNCD: 30.0\n", serverGreeting)
+	r.Equal("@RSYNCD: 30.0 sha512 md5\n", <-received, "the upstream must be sent the advertised version")
+	r.Equal("@RSYNCD: OK\n", reply)
+
+	serverGreeting, reply = request("@RSYNCD: 29\n")
+	r.Equal("@RSYNCD: 30.0\n", serverGreeting)
+	r.Equal("@RSYNCD: 29\n", <-received, "older clients are relayed verbatim")
+	r.Equal("@RSYNCD: OK\n", reply)
+
+	r.Eventually(func() bool {
+		return srv.GetActiveConnectionCount() == 0
+	}, 3*time.Second, 10*time.Millisecond)
+	logContent, err := os.ReadFile(logPath)
+	r.NoError(err)
+	r.Contains(string(logContent), "cannot use upstream u1: protocol 30 is older than the advertised 31")
+}
+
+func TestCloseStopsUpstreamGreetingProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		// Never answer the probe
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	srv := New()
+	configContent := fmt.Sprintf(`
+[proxy]
+protocol_negotiation = "min"
+
+[upstreams.u1]
+address = %q
+modules = ["foo"]
+`, l.Addr().String())
+	require.NoError(t, srv.ReadConfig(strings.NewReader(configContent), true))
+
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream not probed")
+	}
+	defer conn.Close()
+	srv.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, err = io.ReadAll(conn)
+	assert.NoError(t, err, "the probe must hang up once the server is closed")
 }
@@ -0,0 +1,433 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ustclug/rsync-proxy/pkg/queue"
+)
+
+// Actions for an upstream rejecting a module request with "max connections".
+const (
+	// Try another upstream serving the module
+	maxConnectionsRetry = "retry"
+	// Wait and put the client back into the proxy's queue for the upstream
+	maxConnectionsRequeue = "requeue"
+
+	defaultMaxConnectionsRetryDelay = 5 * time.Second
+	defaultMaxConnectionsRetries    = 3
+)
+
+// maxConnectionsPolicy tells what to do when an upstream rejects a module
+// request with "max connections". The zero value passes the rejection on to
+// the client.
+type maxConnectionsPolicy struct {
+	Action     string
+	RetryDelay time.Duration
+	Retries    int
+}
+
+func parseMaxConnectionsPolicy(u *Upstream) (maxConnectionsPolicy, error) {
+	p := maxConnectionsPolicy{
+		Action:     u.OnMaxConnections,
+		RetryDelay: u.MaxConnectionsRetryDelay,
+		Retries:    u.MaxConnectionsRetries,
+	}
+	switch p.Action {
+	case "":
+		return maxConnectionsPolicy{}, nil
+	case maxConnectionsRetry, maxConnectionsRequeue:
+	default:
+		return p, fmt.Errorf("invalid on_max_connections %q, expecting %s or %s", p.Action, maxConnectionsRetry, maxConnectionsRequeue)
+	}
+	if p.RetryDelay < 0 || p.Retries < 0 {
+		return p, fmt.Errorf("max_connections_retry_delay and max_connections_retries must not be negative")
+	}
+	if p.RetryDelay == 0 {
+		p.RetryDelay = defaultMaxConnectionsRetryDelay
+	}
+	if p.Retries == 0 {
+		p.Retries = defaultMaxConnectionsRetries
+	}
+	return p, nil
+}
+
+// upstreamSession is a module request sent to an upstream on behalf of a
+// client.
+type upstreamSession struct {
+	target Target
+	handle *queue.Handle
+	conn   net.Conn
+	// reader relays the rest of the upstream's data to the client
+	reader io.Reader
+	// Output of the upstream held back from the client until the outcome of
+	// the request is known, so that the request can be retried elsewhere
+	pending []byte
+	held    bool
+	// The reply is read before relaying anything from the client, so that
+	// everything the client sends after it, i.e. its arguments, is checked
+	strict bool
+
+	reason  string
+	message string
+	// Protocol negotiated between the client and the upstream
+	protocol int
+	// Closed once the upstream accepted the module request
+	accepted chan struct{}
+}
+
+// retryable reports whether the request was rejected with "max connections"
+// before the client has seen anything of the upstream.
+func (u *upstreamSession) retryable() bool {
+	return u.held && u.reason == moduleResponseMaxConnections
+}
+
+// flush sends the held output to the client.
+func (u *upstreamSession) flush(downConn net.Conn, timeout time.Duration) error {
+	if len(u.pending) == 0 {
+		return nil
+	}
+	_, err := writeWithTimeout(downConn, u.pending, timeout)
+	u.pending = nil
+	return err
+}
+
+func (u *upstreamSession) close() {
+	if u.conn != nil {
+		u.conn.Close()
+	}
+	u.handle.Release()
+}
+
+// waitForQueue waits for a slot of the queue of an upstream or a module,
+// keeping the client informed of its position. If the queue is full, or
+// becomes full for the client when one of a higher priority takes its place,
+// or the client waited longer than the queue's max_queue_wait, the client has
+// already been told so and ok is false; ok is also false if the client hangs
+// up while queued.
+func (s *Server) waitForQueue(downConn *handshakeConn, info *ConnInfo, handle *queue.Handle, w waitingQueue, moduleName, ip string, requeued bool) (ok bool, err error) {
+	writeTimeout := s.WriteTimeout
+	status := <-handle.C
+	if status.Full {
+		s.rejectQueueFull(downConn, w, moduleName, ip)
+		return false, nil
+	}
+	if status.Ok {
+		return true, nil
+	}
+
+	// Logged once per connection, not again when queued for the upstream
+	// after the module, or requeued
+	if !requeued && !info.wasQueued() {
+		s.accessLog.F("client %s starts queueing for module %s", ip, moduleName)
+	}
+	s.setConnState(info, connStateQueued)
+	info.SetQueuePosition(status.Index+1, status.Max)
+	// Queueing is isolated per upstream and per module.
+	msg := fmt.Sprintf("%s has reached the maximum number of %d connections. Your request is being queued.\n", w.title(), w.queue.GetMax())
+	msg += s.queuePositionNotice(w, status)
+	if _, err := writeWithTimeout(downConn, []byte(msg), writeTimeout); err != nil {
+		return false, fmt.Errorf("send queue notice to client %s: %w", ip, err)
+	}
+
+	// Give up the place as soon as the client is gone rather than at the
+	// next position update
+	closed, stopWatch := downConn.watchClose()
+	defer stopWatch()
+	var expired <-chan time.Time
+	if w.maxWait > 0 {
+		timer := time.NewTimer(time.Until(w.deadlines.deadline(w, time.Now())))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for !status.Ok {
+		select {
+		case status = <-handle.C:
+			if status.Ok {
+				return true, nil
+			}
+			if status.Full {
+				// Displaced by a client of a higher priority
+				s.rejectQueueFull(downConn, w, moduleName, ip)
+				return false, nil
+			}
+		case <-closed:
+			s.accessLog.F("client %s leaves the queue for module %s", ip, moduleName)
+			return false, nil
+		case <-expired:
+			w.counters.queueTimeout.Add(1)
+			s.accessLog.F("client %s waited too long in the queue for module %s", ip, moduleName)
+			msg := fmt.Sprintf("@ERROR: max queue wait (%s) exceeded for %s %s, please retry later\n", w.maxWait, w.kind, w.name)
+			_, _ = writeWithTimeout(downConn, []byte(msg), writeTimeout)
+			return false, nil
+		case <-time.After(1 * time.Minute):
+		}
+		info.SetQueuePosition(status.Index+1, status.Max)
+
+		msg := s.queuePositionNotice(w, status)
+		if _, err := writeWithTimeout(downConn, []byte(msg), writeTimeout); err != nil {
+			return false, fmt.Errorf("send queue notice to client %s: %w", ip, err)
+		}
+	}
+	return true, nil
+}
+
+// rejectQueueFull tells the client that the queue is full.
+func (s *Server) rejectQueueFull(downConn *handshakeConn, w waitingQueue, moduleName, ip string) {
+	w.counters.queueFull.Add(1)
+	s.accessLog.F("client %s queue full for module %s", ip, moduleName)
+	_, _ = writeWithTimeout(downConn, []byte(fmt.Sprintf("Server queue is full for this %s. Please retry later.\n", w.kind)), s.WriteTimeout)
+	_, _ = writeWithTimeout(downConn, RsyncdExit, s.WriteTimeout)
+}
+
+// acquireModuleSlot waits for a slot of the module's own queue, if it has
+// one, and returns its handle, or nil if the module has no queue. The module
+// slot is taken before and released after the upstream slot, so a client
+// holding an upstream slot never waits for a module slot and the two queues
+// cannot deadlock. ok is false like for waitForQueue.
+func (s *Server) acquireModuleSlot(downConn *handshakeConn, info *ConnInfo, moduleName, ip string, settings *moduleSettings) (_ *queue.Handle, ok bool, err error) {
+	moduleQueue, ok := s.getQueueForModule(moduleName)
+	if !ok {
+		return nil, true, nil
+	}
+	w := waitingQueue{
+		queue:    moduleQueue,
+		kind:     queueKindModule,
+		name:     moduleName,
+		maxWait:  settings.maxQueueWait,
+		counters: s.getModuleQueueCounters(moduleName),
+	}
+	// The targets of a module may be on upstreams with different
+	// fair_queueing and priority_classes, so the module queue is FIFO
+	handle := moduleQueue.Acquire("")
+	ok, err = s.waitForQueue(downConn, info, handle, w, moduleName, ip, false)
+	if err != nil || !ok {
+		handle.Release()
+		return nil, false, err
+	}
+	return handle, true, nil
+}
+
+// openUpstreamSession waits for a slot of the target's queue, then sends the
+// module request, preceded by the client's early input if any, to the target
+// and handles its reply as far as needed. clientGreeting is the greeting to
+// send on behalf of the client. It returns nil if the client has been told
+// that the queue is full or that the upstream is too old for it, or if it
+// left the queue. deadlines carries the client's max_queue_wait deadlines
+// over attempts, and attempt counts the upstreams tried for the client,
+// starting from 1.
+func (s *Server) openUpstreamSession(ctx context.Context, downConn *handshakeConn, info *ConnInfo, ip string, target Target, moduleName string, clientGreeting, earlyInput []byte, settings *moduleSettings, deadlines queueDeadlines, attempt int) (_ *upstreamSession, err error) {
+	writeTimeout := s.WriteTimeout
+	info.SetUpstream(target.Upstream)
+
+	upstreamGreeting := clientGreeting
+	credentials := target.Credentials
+	if settings.credentials != nil {
+		credentials = settings.credentials
+	}
+	if credentials != nil && credentials.allows(ip) {
+		var ok bool
+		upstreamGreeting, ok = greetingForCredentials(clientGreeting)
+		if !ok {
+			s.accessLog.F("client %s cannot be authenticated to upstream %s on behalf of: protocol too old", ip, target.Upstream)
+			upstreamGreeting, credentials = clientGreeting, nil
+		}
+	} else {
+		credentials = nil
+	}
+
+	upstreamQueue, ok := s.getQueueForUpstream(target.Upstream)
+	if !ok {
+		return nil, fmt.Errorf("no queue configured for upstream %s", target.Upstream)
+	}
+	u := &upstreamSession{
+		target:   target,
+		handle:   upstreamQueue.AcquireClient(queueClient(target, ip)),
+		held:     target.MaxConnections.Action != "",
+		strict:   settings.args.restricts(),
+		accepted: make(chan struct{}),
+	}
+	defer func() {
+		if err != nil {
+			u.close()
+		}
+	}()
+	ok, err = s.waitForQueue(downConn, info, u.handle, s.upstreamWaitingQueue(target, upstreamQueue, deadlines), moduleName, ip, attempt > 1)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		u.close()
+		return nil, nil
+	}
+
+	s.setConnState(info, connStateDialing)
+	upConn, err := s.dialUpstream(ctx, target)
+	if err != nil {
+		s.getUpstreamCounters(target.Upstream).dialError.Add(1)
+		return nil, fmt.Errorf("dial to upstream: %s: %w", target.Addr, err)
+	}
+	u.conn = upConn
+	destAddr := upConn.RemoteAddr()
+	upAddr := netAddrToString(destAddr)
+	if target.Via != nil {
+		// upConn leads to the jump proxy rather than to the upstream, whose
+		// address is only looked up for the PROXY header
+		upAddr = target.Addr
+		if target.UseProxyProtocol {
+			destAddr, err = s.resolveUpstreamAddr(ctx, target)
+			if err != nil {
+				return nil, fmt.Errorf("resolve upstream %s: %w", target.Addr, err)
+			}
+		}
+	}
+	if target.UseProxyProtocol {
+		err := writeProxyProtocolHeader(upConn, downConn.RemoteAddr(), destAddr, writeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("send proxy protocol header to upstream %s: %w", upAddr, err)
+		}
+	}
+
+	_, err = writeWithTimeout(upConn, upstreamGreeting, writeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("send version to upstream %s: %w", upAddr, err)
+	}
+
+	// The rest of the upstream's output, starting with its MOTD, is relayed
+	// from u.conn, which keeps what is read ahead here
+	hu := newHandshakeConn(upConn)
+	u.conn = hu
+	line, err := hu.readLine(s.ReadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("read version from upstream %s: %w", upAddr, err)
+	}
+	greeting, err := parseRsyncdGreeting(line)
+	if err != nil {
+		return nil, fmt.Errorf("unknown version from upstream %s: %s", upAddr, line)
+	}
+	s.recordUpstreamGreeting(target.Upstream, greeting)
+	upstreamVersion := greeting.Raw
+	sent, _ := parseRsyncdGreeting(clientGreeting)
+	u.protocol = min(sent.Protocol, greeting.Protocol)
+	if u.protocol < sent.Protocol && s.getProtocolNegotiation() == protocolNegotiationMin {
+		// The client would speak a newer protocol than the upstream.
+		// Now that the upstream's greeting is known, later clients are
+		// advertised its version.
+		s.accessLog.F("client %s cannot use upstream %s: protocol %d is older than the advertised %d", ip, target.Upstream, greeting.Protocol, sent.Protocol)
+		_, _ = writeWithTimeout(downConn, []byte("@ERROR: protocol version of the upstream changed -- try again later\n"), writeTimeout)
+		u.close()
+		return nil, nil
+	}
+
+	if len(earlyInput) > 0 {
+		if _, err := writeWithTimeout(upConn, earlyInputMessage(earlyInput), writeTimeout); err != nil {
+			return nil, fmt.Errorf("send early input to upstream %s: %w", upAddr, err)
+		}
+	}
+
+	_, err = writeWithTimeout(upConn, []byte(moduleName+"\n"), writeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("send module to upstream %s: %w", upAddr, err)
+	}
+
+	if attempt == 1 {
+		snapshot := info.snapshot()
+		s.accessLog.F("client %s starts requesting module %s (protocol: %d, digests: %q)", ip, moduleName, snapshot.ClientProtocol, snapshot.ClientDigests)
+	}
+
+	if credentials == nil && !u.held && !u.strict {
+		u.reader = &moduleResponseSniffer{
+			reader: u.conn,
+			onResponse: func(reason, message string) {
+				s.recordModuleResponse(info, ip, reason, message)
+				if reason == moduleResponseOK {
+					close(u.accepted)
+				}
+			},
+		}
+		return u, nil
+	}
+	// The reply has to be handled before relaying, either to answer the
+	// upstream's auth challenge, to retry on "max connections" or to keep
+	// the client's arguments from reaching the upstream unchecked
+	if err := s.relayModuleResponse(u, downConn, info, ip, credentials, upstreamVersion); err != nil {
+		return nil, fmt.Errorf("relay module response from upstream %s: %w", upAddr, err)
+	}
+	s.recordModuleResponse(info, ip, u.reason, u.message)
+	if u.reason == moduleResponseOK {
+		close(u.accepted)
+	}
+	u.reader = u.conn
+	return u, nil
+}
+
+// nextTargetAfterMaxConnections picks where to send the module request after
+// the upstream of targets[index] rejected it with "max connections". tried
+// marks the targets already tried, and requeued counts the previous requeues.
+func nextTargetAfterMaxConnections(targets []Target, index int, tried []bool, requeued int) (next int, requeue bool, ok bool) {
+	policy := targets[index].MaxConnections
+	switch policy.Action {
+	case maxConnectionsRetry:
+		for i := 1; i < len(targets); i++ {
+			next := (index + i) % len(targets)
+			if !tried[next] {
+				return next, false, true
+			}
+		}
+	case maxConnectionsRequeue:
+		if requeued < policy.Retries {
+			return index, true, true
+		}
+	}
+	return 0, false, false
+}
+
+// openUpstreamSessionWithRetries opens a session to one of targets, starting
+// from targets[index], retrying according to the upstreams' max connections
+// policy. It returns nil if the client has been told that the queue is full
+// or left the queue.
+func (s *Server) openUpstreamSessionWithRetries(ctx context.Context, downConn *handshakeConn, info *ConnInfo, ip string, targets []Target, index int, moduleName string, clientGreeting, earlyInput []byte, settings *moduleSettings) (*upstreamSession, error) {
+	tried := make([]bool, len(targets))
+	requeued := 0
+	deadlines := queueDeadlines{}
+	for attempt := 1; ; attempt++ {
+		target := targets[index]
+		tried[index] = true
+		// Output held back during an attempt that is retried never reaches
+		// the client
+		sent := info.SentBytes.Load()
+		u, err := s.openUpstreamSession(ctx, downConn, info, ip, target, moduleName, clientGreeting, earlyInput, settings, deadlines, attempt)
+		if err != nil || u == nil || !u.retryable() {
+			return u, err
+		}
+		next, requeue, ok := nextTargetAfterMaxConnections(targets, index, tried, requeued)
+		if !ok {
+			return u, nil
+		}
+		u.close()
+		info.SentBytes.Store(sent)
+		if requeue {
+			requeued++
+			s.accessLog.F("client %s requeued for module %s after max connections on upstream %s", ip, moduleName, target.Upstream)
+			s.setConnState(info, connStateQueued)
+			closed, stopWatch := downConn.watchClose()
+			select {
+			case <-time.After(target.MaxConnections.RetryDelay):
+			case <-closed:
+				stopWatch()
+				s.accessLog.F("client %s leaves the queue for module %s", ip, moduleName)
+				return nil, nil
+			case <-ctx.Done():
+				stopWatch()
+				return nil, ctx.Err()
+			}
+			stopWatch()
+		} else {
+			s.accessLog.F("client %s retries module %s on upstream %s after max connections on upstream %s", ip, moduleName, targets[next].Upstream, target.Upstream)
+		}
+		index = next
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// connState is the phase of the lifecycle of a client connection.
+type connState int
+
+const (
+	// Reading the greeting and module request, including TLS and
+	// authentication
+	connStateHandshake connState = iota
+	// Sending the list of modules
+	connStateListing
+	// Waiting for a slot of the upstream's queue
+	connStateQueued
+	// Connecting to the upstream and sending the module request
+	connStateDialing
+	// Relaying data between the client and the upstream
+	connStateRelaying
+	// One side has finished, waiting for the other
+	connStateClosing
+
+	numConnStates
+)
+
+var connStateNames = [numConnStates]string{
+	connStateHandshake: "handshake",
+	connStateListing:   "listing",
+	connStateQueued:    "queued",
+	connStateDialing:   "dialing",
+	connStateRelaying:  "relaying",
+	connStateClosing:   "closing",
+}
+
+func (st connState) String() string {
+	if st < 0 || st >= numConnStates {
+		return "unknown"
+	}
+	return connStateNames[st]
+}
+
+func (st connState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(st.String())
+}
+
+func (st *connState) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	i := slices.Index(connStateNames[:], name)
+	if i < 0 {
+		return fmt.Errorf("unknown connection state %q", name)
+	}
+	*st = connState(i)
+	return nil
+}
+
+// connStateTransition records when a connection entered a state.
+type connStateTransition struct {
+	State connState `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+// connStateCounters accumulates the time connections spent in a state.
+type connStateCounters struct {
+	// Number of times a connection left the state
+	count atomic.Uint64
+	// Total time spent in the state, in nanoseconds
+	nanoseconds atomic.Uint64
+}
+
+// setState moves the connection to state at now. It returns the state left
+// and how long the connection was in it, or ok is false if there was no
+// previous state or the state did not change.
+func (c *ConnInfo) setState(state connState, now time.Time) (prev connState, spent time.Duration, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.Transitions) > 0 {
+		if c.State == state {
+			return 0, 0, false
+		}
+		prev, spent, ok = c.State, now.Sub(c.StateSince), true
+	}
+	c.State = state
+	c.StateSince = now
+	c.Transitions = append(c.Transitions, connStateTransition{State: state, At: now})
+	if state != connStateQueued {
+		c.QueuePosition, c.QueueLength = 0, 0
+	}
+	return prev, spent, ok
+}
+
+// wasQueued reports whether the connection has been queued before.
+func (c *ConnInfo) wasQueued() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.ContainsFunc(c.Transitions, func(t connStateTransition) bool {
+		return t.State == connStateQueued
+	})
+}
+
+// SetQueuePosition records the 1-based position of a queued connection.
+func (c *ConnInfo) SetQueuePosition(position, length int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.QueuePosition, c.QueueLength = position, length
+}
+
+// setConnState moves the connection to state, accounting the time spent in
+// the previous one.
+func (s *Server) setConnState(info *ConnInfo, state connState) {
+	prev, spent, ok := info.setState(state, time.Now())
+	if ok {
+		s.recordConnState(prev, spent)
+	}
+}
+
+// finishConnState accounts the time spent in the last state of a connection
+// that is going away.
+func (s *Server) finishConnState(info *ConnInfo) {
+	info.mu.RLock()
+	state, since := info.State, info.StateSince
+	info.mu.RUnlock()
+	s.recordConnState(state, time.Since(since))
+}
+
+func (s *Server) recordConnState(state connState, spent time.Duration) {
+	if state < 0 || state >= numConnStates || spent < 0 {
+		return
+	}
+	c := &s.connStateCounters[state]
+	c.count.Add(1)
+	c.nanoseconds.Add(uint64(spent))
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSessionTicketKeys is the number of session ticket keys kept when
+// rotation is enabled. The first key encrypts new tickets, the others are
+// only used to decrypt tickets issued before the last rotations.
+const maxSessionTicketKeys = 3
+
+const (
+	// defaultTLSExpiryWarning is used when tls_expiry_warning is not set.
+	defaultTLSExpiryWarning = 14 * 24 * time.Hour
+	// tlsExpiryCheckInterval is how often the certificate expiry is checked
+	// when tls_watch_interval is not set.
+	tlsExpiryCheckInterval = time.Hour
+)
+
+var tlsVersionsByName = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurvesByName = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P256":           tls.CurveP256,
+	"P384":           tls.CurveP384,
+	"P521":           tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+// tlsSettings is the parsed form of the tls_* options in ProxySettings.
+type tlsSettings struct {
+	MinVersion             uint16
+	CipherSuites           []uint16
+	CurvePreferences       []tls.CurveID
+	SessionTicketKeyRotate time.Duration
+	CertFile               string
+	KeyFile                string
+	WatchInterval          time.Duration
+	ExpiryWarning          time.Duration
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersionsByName[strings.TrimPrefix(strings.ToUpper(s), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown tls version: %s", s)
+	}
+	return v, nil
+}
+
+func parseTLSCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, c := range tls.CipherSuites() {
+		known[c.Name] = c.ID
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		known[c.Name] = c.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func parseTLSCurvePreferences(names []string) ([]tls.CurveID, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		curve, ok := tlsCurvesByName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls curve: %s", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+func parseTLSSettings(p *ProxySettings) (tlsSettings, error) {
+	var (
+		settings tlsSettings
+		err      error
+	)
+	if settings.MinVersion, err = parseTLSVersion(p.TLSMinVersion); err != nil {
+		return settings, err
+	}
+	if settings.CipherSuites, err = parseTLSCipherSuites(p.TLSCipherSuites); err != nil {
+		return settings, err
+	}
+	if settings.CurvePreferences, err = parseTLSCurvePreferences(p.TLSCurvePreferences); err != nil {
+		return settings, err
+	}
+	if p.TLSSessionTicketKeyRotation < 0 {
+		return settings, fmt.Errorf("tls_session_ticket_key_rotation must not be negative")
+	}
+	settings.SessionTicketKeyRotate = p.TLSSessionTicketKeyRotation
+	if p.TLSWatchInterval < 0 {
+		return settings, fmt.Errorf("tls_watch_interval must not be negative")
+	}
+	settings.CertFile = p.TLSCertFile
+	settings.KeyFile = p.TLSKeyFile
+	settings.WatchInterval = p.TLSWatchInterval
+	settings.ExpiryWarning = p.TLSExpiryWarning
+	if settings.ExpiryWarning <= 0 {
+		settings.ExpiryWarning = defaultTLSExpiryWarning
+	}
+	return settings, nil
+}
+
+// newTLSConfig builds the per-handshake TLS config returned by
+// getTLSConfigForClient.
+func (s *Server) newTLSConfig(settings tlsSettings) *tls.Config {
+	return &tls.Config{
+		GetCertificate:   s.getTLSCertificate,
+		MinVersion:       settings.MinVersion,
+		CipherSuites:     slices.Clone(settings.CipherSuites),
+		CurvePreferences: slices.Clone(settings.CurvePreferences),
+	}
+}
+
+// sessionTicketKeys rotates session ticket keys lazily, i.e. when a new
+// handshake arrives after the rotation interval has elapsed. The keys
+// survive config reloads so that resumption keeps working across them.
+type sessionTicketKeys struct {
+	mu        sync.Mutex
+	keys      [][32]byte
+	rotatedAt time.Time
+	applied   *tls.Config
+}
+
+func (k *sessionTicketKeys) apply(cfg *tls.Config, interval time.Duration, now time.Time) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	rotate := len(k.keys) == 0 || now.Sub(k.rotatedAt) >= interval
+	if rotate {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return fmt.Errorf("generate session ticket key: %w", err)
+		}
+		k.keys = append([][32]byte{key}, k.keys...)
+		if len(k.keys) > maxSessionTicketKeys {
+			k.keys = k.keys[:maxSessionTicketKeys]
+		}
+		k.rotatedAt = now
+	}
+	if rotate || k.applied != cfg {
+		cfg.SetSessionTicketKeys(k.keys)
+		k.applied = cfg
+	}
+	return nil
+}
+
+func (s *Server) getTLSConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.reloadLock.RLock()
+	cfg := s.tlsConfig
+	rotation := s.tlsSettings.SessionTicketKeyRotate
+	s.reloadLock.RUnlock()
+	if cfg == nil {
+		// Fall back to the listener's base config
+		return nil, nil
+	}
+	if rotation > 0 {
+		if err := s.tlsTicketKeys.apply(cfg, rotation, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// tlsCounterKey identifies a negotiated (version, cipher suite) pair.
+type tlsCounterKey struct {
+	version string
+	cipher  string
+}
+
+// getTLSHandshakeCounter returns the counter of successful handshakes for
+// the given version and cipher suite, creating it lazily.
+func (s *Server) getTLSHandshakeCounter(version, cipher string) *atomic.Uint64 {
+	key := tlsCounterKey{version: version, cipher: cipher}
+	if v, ok := s.tlsHandshakeCounters.Load(key); ok {
+		return v.(*atomic.Uint64)
+	}
+	v, _ := s.tlsHandshakeCounters.LoadOrStore(key, &atomic.Uint64{})
+	return v.(*atomic.Uint64)
+}
+
+// tlsFileStamp records what the certificate and key files looked like when
+// they were last loaded, so that the watcher can tell when they changed.
+type tlsFileStamp struct {
+	certModTime time.Time
+	certSize    int64
+	keyModTime  time.Time
+	keySize     int64
+}
+
+func (a tlsFileStamp) equal(b tlsFileStamp) bool {
+	return a.certModTime.Equal(b.certModTime) && a.certSize == b.certSize &&
+		a.keyModTime.Equal(b.keyModTime) && a.keySize == b.keySize
+}
+
+func statTLSFiles(certFile, keyFile string) (tlsFileStamp, error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return tlsFileStamp{}, err
+	}
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return tlsFileStamp{}, err
+	}
+	return tlsFileStamp{
+		certModTime: certInfo.ModTime(),
+		certSize:    certInfo.Size(),
+		keyModTime:  keyInfo.ModTime(),
+		keySize:     keyInfo.Size(),
+	}, nil
+}
+
+func tlsCertificateLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("empty certificate chain")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
+
+// watchTLSCertificate periodically reloads the certificate when its files
+// change and warns when it is about to expire.
+func (s *Server) watchTLSCertificate(ctx context.Context) {
+	for {
+		s.reloadLock.RLock()
+		interval := s.tlsSettings.WatchInterval
+		s.reloadLock.RUnlock()
+		if interval <= 0 {
+			interval = tlsExpiryCheckInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		s.checkTLSCertificate(time.Now())
+	}
+}
+
+// checkTLSCertificate reloads the certificate if tls_watch_interval is set
+// and the files changed since they were last loaded. A new key pair is only
+// swapped in once it loads successfully, so a certificate renewed before its
+// key (or the other way around) keeps the old pair until both are in place.
+func (s *Server) checkTLSCertificate(now time.Time) {
+	s.reloadLock.RLock()
+	settings := s.tlsSettings
+	stamp := s.tlsFileStamp
+	s.reloadLock.RUnlock()
+	if settings.CertFile == "" || settings.KeyFile == "" {
+		return
+	}
+
+	if settings.WatchInterval > 0 {
+		s.reloadTLSCertificateIfChanged(settings, stamp)
+	}
+
+	s.reloadLock.RLock()
+	cert := s.tlsCertificate
+	s.reloadLock.RUnlock()
+	s.checkTLSCertificateExpiry(cert, settings.ExpiryWarning, now)
+}
+
+func (s *Server) reloadTLSCertificateIfChanged(settings tlsSettings, stamp tlsFileStamp) {
+	newStamp, err := statTLSFiles(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		s.errorLog.F("[WARN] stat tls certificate: %v", err)
+		return
+	}
+	if newStamp.equal(stamp) {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		// Most likely only one of the files has been replaced yet, try
+		// again on the next tick.
+		log.Printf("[WARN] tls certificate changed but cannot be loaded yet: %v", err)
+		s.errorLog.F("[WARN] tls certificate changed but cannot be loaded yet: %v", err)
+		return
+	}
+
+	s.reloadLock.Lock()
+	if s.tlsSettings.CertFile != settings.CertFile || s.tlsSettings.KeyFile != settings.KeyFile ||
+		!s.tlsFileStamp.equal(stamp) {
+		// Config has been reloaded meanwhile and already has a certificate
+		// at least as fresh as the one loaded here
+		s.reloadLock.Unlock()
+		return
+	}
+	s.tlsCertificate = &cert
+	s.tlsFileStamp = newStamp
+	s.reloadLock.Unlock()
+	s.tlsExpiryWarned.Store(false)
+
+	log.Printf("[INFO] reloaded tls certificate from %s", settings.CertFile)
+	s.errorLog.F("[INFO] reloaded tls certificate from %s", settings.CertFile)
+}
+
+// checkTLSCertificateExpiry logs a warning once per loaded certificate when
+// it expires within the given duration.
+func (s *Server) checkTLSCertificateExpiry(cert *tls.Certificate, warning time.Duration, now time.Time) {
+	if cert == nil {
+		return
+	}
+	leaf, err := tlsCertificateLeaf(cert)
+	if err != nil {
+		s.errorLog.F("[WARN] parse tls certificate: %v", err)
+		return
+	}
+	remaining := leaf.NotAfter.Sub(now)
+	if remaining > warning || s.tlsExpiryWarned.Swap(true) {
+		return
+	}
+	log.Printf("[WARN] tls certificate %q expires at %s (in %s)", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339), remaining.Truncate(time.Second))
+	s.errorLog.F("[WARN] tls certificate %q expires at %s (in %s)", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339), remaining.Truncate(time.Second))
+}
+
+// tlsCertificateExpiry returns the expiry time of the current certificate.
+func (s *Server) tlsCertificateExpiry() (time.Time, bool) {
+	s.reloadLock.RLock()
+	cert := s.tlsCertificate
+	s.reloadLock.RUnlock()
+	if cert == nil {
+		return time.Time{}, false
+	}
+	leaf, err := tlsCertificateLeaf(cert)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return leaf.NotAfter, true
+}
@@ -67,28 +67,6 @@ func generateProxyProtocolHeader(sourceAddr, destAddr net.Addr) (string, error)
 	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", ipVersion, sourceIP.String(), destIP.String(), sourcePort, destPort), nil
 }
 
-// readLine will read as much as it can until the last read character is a newline character.
-func readLine(conn net.Conn, buf []byte, timeout time.Duration) (n int, err error) {
-	max := len(buf)
-	for {
-		if timeout > 0 {
-			_ = conn.SetReadDeadline(time.Now().Add(timeout))
-		}
-		var nr int
-		nr, err = conn.Read(buf[n:])
-		n += nr
-		if n > 0 && buf[n-1] == '\n' {
-			return n, nil
-		}
-		if n == max {
-			return n, nil
-		}
-		if err != nil {
-			return
-		}
-	}
-}
-
 func listenTCPOrUnix(addr string) (net.Listener, error) {
 	if strings.HasPrefix(addr, "/") {
 		os.Remove(addr)
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
 	"path/filepath"
@@ -57,20 +59,155 @@ func (c *fakeConn) SetWriteDeadline(t time.Time) error {
 }
 
 func TestReadLine(t *testing.T) {
-	c := &fakeConn{fragments: [][]byte{
+	c := newHandshakeConn(&fakeConn{fragments: [][]byte{
 		RsyncdVersionPrefix,
 		[]byte(" 31.0"),
 		{'\n'},
-	}}
+	}})
 
-	buf := make([]byte, ReadBufferSize)
-	n, err := readLine(c, buf, time.Minute)
+	got, err := c.readLine(time.Minute)
 	require.NoError(t, err)
-	got := buf[:n]
 	expected := []byte("@RSYNCD: 31.0\n")
 	assert.Equal(t, expected, got, "unexpected data")
 }
 
+func TestReadLineKeepsDataReadAhead(t *testing.T) {
+	c := newHandshakeConn(&fakeConn{fragments: [][]byte{
+		[]byte("@RSYNCD: 31.0\nmod"),
+		[]byte("ule\n\x00args"),
+	}})
+
+	line, err := c.readLine(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "@RSYNCD: 31.0\n", string(line))
+	line, err = c.readLine(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "module\n", string(line))
+	rest, err := io.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, "\x00args", string(rest))
+}
+
+func TestReadLineTooLong(t *testing.T) {
+	long := bytes.Repeat([]byte("a"), maxHandshakeLineSize)
+	c := newHandshakeConn(&fakeConn{fragments: [][]byte{long, []byte("\n")}})
+	_, err := c.readLine(time.Minute)
+	assert.ErrorIs(t, err, errHandshakeLineTooLong)
+
+	c = newHandshakeConn(&fakeConn{fragments: [][]byte{long[:maxHandshakeLineSize-1], []byte("\n")}})
+	line, err := c.readLine(time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, line, maxHandshakeLineSize)
+}
+
+func TestWatchClose(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newHandshakeConn(server)
+
+	// Data sent while watching is kept
+	closed, stop := c.watchClose()
+	_, err := client.Write([]byte("args\n"))
+	require.NoError(t, err)
+	stop()
+	select {
+	case <-closed:
+		t.Fatal("connection should not be reported closed")
+	default:
+	}
+	line, err := c.readLine(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "args\n", string(line))
+
+	// Stopping an idle watch leaves the connection usable
+	_, stop = c.watchClose()
+	stop()
+	go func() { _, _ = client.Write([]byte("more\n")) }()
+	line, err = c.readLine(time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "more\n", string(line))
+
+	closed, stop = c.watchClose()
+	defer stop()
+	require.NoError(t, client.Close())
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close of the client not detected")
+	}
+
+	// A client hanging up after sending data is noticed too
+	client, server = net.Pipe()
+	defer server.Close()
+	c = newHandshakeConn(server)
+	closed, stop = c.watchClose()
+	defer stop()
+	_, err = client.Write([]byte("args\n"))
+	require.NoError(t, err)
+	require.NoError(t, client.Close())
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close of the client not detected after data")
+	}
+
+	// So is a client filling the buffer while it waits
+	client, server = net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	c = newHandshakeConn(server)
+	closed, stop = c.watchClose()
+	defer stop()
+	go func() { _, _ = client.Write(bytes.Repeat([]byte("a"), maxHandshakeLineSize)) }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("full buffer not reported")
+	}
+}
+
+func FuzzReadLine(f *testing.F) {
+	f.Add([]byte("@RSYNCD: 31.0\nmodule\n"), 3)
+	f.Add([]byte("#early_input=3\nabcmodule\n\x00rest"), 1)
+	f.Add(bytes.Repeat([]byte("a"), 2*maxHandshakeLineSize), 7)
+	f.Fuzz(func(t *testing.T, data []byte, fragmentSize int) {
+		if fragmentSize <= 0 {
+			fragmentSize = 1
+		}
+		var fragments [][]byte
+		for rest := data; len(rest) > 0; {
+			n := min(fragmentSize, len(rest))
+			fragments = append(fragments, rest[:n])
+			rest = rest[n:]
+		}
+		c := newHandshakeConn(&fakeConn{fragments: fragments})
+
+		// Lines read followed by the rest of the connection must give back
+		// the input, unless a line is too long
+		var got []byte
+		for {
+			line, err := c.readLine(time.Minute)
+			if errors.Is(err, errHandshakeLineTooLong) {
+				return
+			}
+			if len(line) > maxHandshakeLineSize {
+				t.Fatalf("line of %d bytes exceeds the limit", len(line))
+			}
+			if err == nil && line[len(line)-1] != '\n' {
+				t.Fatalf("line %q does not end with a newline", line)
+			}
+			got = append(got, line...)
+			if err != nil {
+				break
+			}
+		}
+		rest, err := io.ReadAll(c)
+		require.NoError(t, err)
+		got = append(got, rest...)
+		assert.Equal(t, string(data), string(got))
+	})
+}
+
 func TestListenAndDialUnixSocket(t *testing.T) {
 	addr := filepath.Join(t.TempDir(), "rsync-proxy.sock")
 
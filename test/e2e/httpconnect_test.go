@@ -0,0 +1,51 @@
+package e2e
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ustclug/rsync-proxy/pkg/server"
+)
+
+func TestHTTPConnectListModules(t *testing.T) {
+	r := require.New(t)
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	r.NoError(os.WriteFile(configPath, []byte(`
+[proxy]
+listen_http_connect = "127.0.0.1:8080"
+http_connect_allowed_hosts = ["mirrors.example.org"]
+
+[upstreams.u1]
+address = "127.0.0.1:1234"
+modules = ["foo"]
+
+[upstreams.u2]
+address = "127.0.0.1:1235"
+modules = ["bar"]
+`), 0600))
+
+	proxy := startProxy(t, func(s *server.Server) {
+		s.ConfigPath = configPath
+		s.HTTPConnectListenAddr = LocalBindAddr
+	})
+
+	cmd := newRsyncCommand("rsync://mirrors.example.org/")
+	cmd.Env = append(os.Environ(), "RSYNC_PROXY="+proxy.HTTPConnectListenAddr)
+	outputBytes, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Log(string(outputBytes))
+		r.NoError(err)
+	}
+	r.Equal("bar\nfoo\n", string(outputBytes))
+
+	host, _, err := net.SplitHostPort(proxy.ListenAddr)
+	r.NoError(err)
+	cmd = newRsyncCommand("rsync://" + host + "/")
+	cmd.Env = append(os.Environ(), "RSYNC_PROXY="+proxy.HTTPConnectListenAddr)
+	r.Error(cmd.Run(), "target not in http_connect_allowed_hosts should be rejected")
+}
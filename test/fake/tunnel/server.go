@@ -0,0 +1,227 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is an in-process jump proxy accepting either SOCKS5 or HTTP
+// CONNECT requests and relaying them to the requested target.
+type Server struct {
+	handshake func(conn net.Conn, br *bufio.Reader) (string, error)
+
+	mu      sync.Mutex
+	targets []string
+
+	Listener net.Listener
+	Username string
+	Password string
+}
+
+func newServer(username, password string) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("faketunnel: fail to listen: %v", err))
+	}
+	return &Server{
+		Listener: l,
+		Username: username,
+		Password: password,
+	}
+}
+
+// NewSOCKS5Server creates a SOCKS5 proxy. Username/password authentication
+// is required if username is not empty.
+func NewSOCKS5Server(username, password string) *Server {
+	s := newServer(username, password)
+	s.handshake = s.socks5Handshake
+	return s
+}
+
+// NewHTTPConnectServer creates an HTTP CONNECT proxy. Basic authentication
+// is required if username is not empty.
+func NewHTTPConnectServer(username, password string) *Server {
+	s := newServer(username, password)
+	s.handshake = s.httpConnectHandshake
+	return s
+}
+
+func (s *Server) Start() {
+	go s.serve()
+}
+
+func (s *Server) Close() {
+	_ = s.Listener.Close()
+}
+
+// Targets returns the addresses clients asked to be connected to.
+func (s *Server) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.targets...)
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.Listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				panic(fmt.Sprintf("faketunnel: fail to accept connection: %v", err))
+			}
+			return
+		}
+		go s.handleConn(c)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	target, err := s.handshake(conn, br)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.targets = append(s.targets, target)
+	s.mu.Unlock()
+
+	upConn, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(upConn, br)
+		closeWrite(upConn)
+		close(done)
+	}()
+	_, _ = io.Copy(conn, upConn)
+	closeWrite(conn)
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+}
+
+func (s *Server) socks5Handshake(conn net.Conn, br *bufio.Reader) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return "", err
+	}
+
+	if s.Username == "" {
+		_, _ = conn.Write([]byte{0x05, 0x00})
+	} else {
+		_, _ = conn.Write([]byte{0x05, 0x02})
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return "", err
+		}
+		user := make([]byte, header[1])
+		if _, err := io.ReadFull(br, user); err != nil {
+			return "", err
+		}
+		passLen, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		pass := make([]byte, passLen)
+		if _, err := io.ReadFull(br, pass); err != nil {
+			return "", err
+		}
+		if string(user) != s.Username || string(pass) != s.Password {
+			_, _ = conn.Write([]byte{0x01, 0x01})
+			return "", fmt.Errorf("authentication failed")
+		}
+		_, _ = conn.Write([]byte{0x01, 0x00})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x04:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		l, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(br, port[:]); err != nil {
+		return "", err
+	}
+	_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+func (s *Server) httpConnectHandshake(conn net.Conn, br *bufio.Reader) (string, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "CONNECT" {
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return "", fmt.Errorf("bad request: %q", line)
+	}
+	authorized := s.Username == ""
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(s.Username+":"+s.Password))
+	for {
+		header, err := br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		header = strings.TrimRight(header, "\r\n")
+		if header == "" {
+			break
+		}
+		name, value, _ := strings.Cut(header, ":")
+		if strings.EqualFold(name, "Proxy-Authorization") && strings.TrimSpace(value) == expected {
+			authorized = true
+		}
+	}
+	if !authorized {
+		_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+		return "", fmt.Errorf("authentication failed")
+	}
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return fields[1], nil
+}